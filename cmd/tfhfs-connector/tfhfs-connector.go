@@ -28,6 +28,8 @@ func main() {
 		flag.PrintDefaults()
 	}
 	interval := flag.Duration("interval", time.Second*10, "Interval at which synchronization is run (0 = once)")
+	leftPartial := flag.Bool("left-metadata-only", false, "Whether left is partial replica which gets only metadata (and fetches file data from its -replica-peer on demand)")
+	rightPartial := flag.Bool("right-metadata-only", false, "Whether right is partial replica which gets only metadata (and fetches file data from its -replica-peer on demand)")
 	flag.Parse()
 	if flag.NArg() < 6 {
 		flag.Usage()
@@ -36,10 +38,12 @@ func main() {
 
 	c1 := connector.Connection{Address: flag.Arg(0),
 		RootName:      flag.Arg(1),
-		OtherRootName: flag.Arg(2)}
+		OtherRootName: flag.Arg(2),
+		MetadataOnly:  *leftPartial}
 	c2 := connector.Connection{Address: flag.Arg(3),
 		RootName:      flag.Arg(4),
-		OtherRootName: flag.Arg(5)}
+		OtherRootName: flag.Arg(5),
+		MetadataOnly:  *rightPartial}
 	c := connector.Connector{Left: c1, Right: c2}
 	for {
 		ops, err := c.Run()
@@ -0,0 +1,113 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Tue Apr  3 13:05:20 2018 mstenber
+ * Last modified: Tue Apr  3 13:31:02 2018 mstenber
+ * Edit time:     18 min
+ *
+ */
+
+// tfhfs-fsck checks (and optionally repairs) the block reference
+// counts of an unmounted tfhfs storage directory.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fingon/go-tfhfs/fs"
+	"github.com/fingon/go-tfhfs/fsck"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n\n%s [flags] STORAGEDIR [NAME..]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "By default, every name in the storage is checked. Blocks not reachable from the names are considered leaked, so -repair requires every name in use to be given.\n\nFlags:\n\n")
+		flag.PrintDefaults()
+	}
+	password := flag.String("password", "siikret", "Password")
+	salt := flag.String("salt", "salt", "Salt (only for legacy storage without header)")
+	backend := flag.String("backend", "badger",
+		fmt.Sprintf("Backend to use (possible: %v)", factory.List()))
+	repair := flag.Bool("repair", false, "Whether to fix reference counts and remove leaked blocks")
+	verbose := flag.Bool("verbose", false, "Whether to print every problem found")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	var names []string
+	if flag.NArg() > 1 {
+		names = flag.Args()[1:]
+	}
+
+	// The intent log holds changes that are not in the backend
+	// yet; the reference counts do not add up until it has been
+	// replayed (by mounting the storage once).
+	if fi, err := os.Stat(filepath.Join(flag.Arg(0), storage.IntentLogFilename)); err == nil && fi.Size() > 0 {
+		if *repair {
+			fmt.Fprintf(os.Stderr, "Refusing to repair; %s is not empty (mount the storage once to replay it).\n", storage.IntentLogFilename)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s is not empty; the problems may be due to it not being replayed yet.\n", storage.IntentLogFilename)
+	}
+
+	beconf := storage.BackendConfiguration{Directory: flag.Arg(0)}
+	conf := factory.CryptoStorageConfiguration{BackendConfiguration: beconf,
+		BackendName: *backend, Password: *password, Salt: *salt}
+	be, c := factory.NewCryptoBackend(conf)
+	defer be.Close()
+	if *repair && names != nil {
+		given := make(map[string]bool)
+		for _, name := range names {
+			given[name] = true
+		}
+		missing := 0
+		be.IterateNames(func(name, id string) {
+			if !given[name] {
+				fmt.Fprintf(os.Stderr, "Name %s not given\n", name)
+				missing++
+			}
+		})
+		if missing > 0 {
+			fmt.Fprintf(os.Stderr, "Refusing to repair; blocks reachable only from the names would be removed.\n")
+			be.Close()
+			os.Exit(1)
+		}
+	}
+	f := &fsck.Fsck{Backend: be, Codec: c, Names: names, Repair: *repair,
+		IterateReferencesCallback: fs.IterateBlockReferences}
+	f.Run()
+
+	var counts [fsck.NUM_P]int
+	unrepaired := 0
+	for _, p := range f.Problems {
+		counts[p.Type]++
+		if !p.Repaired {
+			unrepaired++
+		}
+		if *verbose {
+			fmt.Printf("%v\n", p)
+		}
+	}
+	fmt.Printf("%d blocks, %d problems (%d not repaired)\n",
+		f.Blocks, len(f.Problems), unrepaired)
+	if f.Missing > 0 {
+		fmt.Printf(" %d blocks without data (partial replica)\n", f.Missing)
+	}
+	for i, count := range counts {
+		if count > 0 {
+			fmt.Printf(" %v: %d\n", fsck.ProblemType(i), count)
+		}
+	}
+	if unrepaired > 0 {
+		be.Close()
+		os.Exit(1)
+	}
+}
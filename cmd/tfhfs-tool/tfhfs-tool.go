@@ -0,0 +1,241 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Mon Mar 26 12:35:10 2018 mstenber
+ * Last modified: Fri Apr 13 13:02:40 2018 mstenber
+ * Edit time:     36 min
+ *
+ */
+
+// tfhfs-tool provides assorted offline maintenance operations on
+// tfhfs storage directories.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fingon/go-tfhfs/codec"
+	"github.com/fingon/go-tfhfs/fs"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/erasure"
+	"github.com/fingon/go-tfhfs/storage/factory"
+)
+
+type command struct {
+	args, description string
+	minArgs           int
+	run               func(args []string)
+}
+
+var password, salt, kdf, backend, rootName *string
+var cipher, compression *string
+var compressionLevel *int
+var skipIncompressible, fromPlain *bool
+
+var commands = map[string]command{
+	"passwd": command{args: "STORAGEDIR",
+		description: "Change the password of the storage to the one read from standard input",
+		minArgs:     1,
+		run:         passwd},
+	"rebuild": command{args: "STORAGEDIR SHARD",
+		description: "Rebuild the (replaced) shard directory SHARD of erasure coded storage (storage must not be mounted)",
+		minArgs:     2,
+		run:         rebuild},
+	"recodec": command{args: "STORAGEDIR",
+		description: "Re-encode the blocks of the storage using the current codec flags (offline: storage must not be mounted while it runs; resumable)",
+		minArgs:     1,
+		run:         recodec},
+	"receive": command{args: "STORAGEDIR [ROOTNAME]",
+		description: "Store the stream (from send) read from standard input, and point ROOTNAME (default: the name it was sent as) at its root",
+		minArgs:     1,
+		run:         receive},
+	"send": command{args: "STORAGEDIR ROOTNAME [-from OLDROOT]",
+		description: "Write stream of the blocks reachable from ROOTNAME (but not OLDROOT, which the receiver has to have) to standard output",
+		minArgs:     2,
+		run:         send},
+	"snapshot": command{args: "STORAGEDIR create|list|delete [NAME]",
+		description: "Create, list or delete read-only snapshots of the root (storage must not be mounted)",
+		minArgs:     2,
+		run:         snapshot},
+}
+
+func cryptoStorageConfiguration(dir string) factory.CryptoStorageConfiguration {
+	beconf := storage.BackendConfiguration{Directory: dir}
+	return factory.CryptoStorageConfiguration{BackendConfiguration: beconf,
+		BackendName: *backend, Password: *password, Salt: *salt,
+		KDF: *kdf, Cipher: *cipher, Compression: *compression,
+		CompressionLevel:   *compressionLevel,
+		SkipIncompressible: *skipIncompressible, IntentLog: true}
+}
+
+func passwd(args []string) {
+	// The new password is not taken as an argument, as those are
+	// visible to other users
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal(err)
+	}
+	newPassword := strings.TrimRight(line, "\r\n")
+	err = factory.ChangePassword(cryptoStorageConfiguration(args[0]), newPassword)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func recodec(args []string) {
+	err := factory.Recodec(cryptoStorageConfiguration(args[0]), *fromPlain)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func rebuild(args []string) {
+	shard, err := strconv.Atoi(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := cryptoStorageConfiguration(args[0])
+	be := factory.NewWithConfig(config.BackendName, config.BackendConfiguration)
+	count, err := erasure.RebuildShard(be, shard)
+	be.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d blocks rebuilt\n", count)
+}
+
+func snapshot(args []string) {
+	if args[1] != "list" && len(args) < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	st := factory.NewCryptoStorage(cryptoStorageConfiguration(args[0]))
+	myfs := fs.NewFs(st, *rootName, 0)
+	var err error
+	switch args[1] {
+	case "create":
+		err = myfs.CreateSnapshot(args[2])
+	case "delete":
+		err = myfs.DeleteSnapshot(args[2])
+	case "list":
+		for _, s := range myfs.Snapshots() {
+			fmt.Printf("%s\t%s\t%x\n", s.Name,
+				time.Unix(0, s.Time).Format(time.RFC3339), s.RootId)
+		}
+	default:
+		err = fmt.Errorf("unknown snapshot command %s", args[1])
+	}
+	myfs.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// streamStorage returns storage whose blocks are encoded by its
+// StreamCodec in the streams, so that they stay encrypted there.
+func streamStorage(config factory.CryptoStorageConfiguration) *storage.Storage {
+	st := factory.NewCryptoStorage(config)
+	st.IterateReferencesCallback = fs.IterateBlockReferences
+	st.ReplayIntentLog()
+	return st
+}
+
+func send(args []string) {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	from := flags.String("from", "", "Name of the root the receiver has already")
+	flags.Parse(args[2:])
+	config := cryptoStorageConfiguration(args[0])
+	header, err := config.EncodedHeader()
+	if err != nil {
+		log.Fatal(err)
+	}
+	st := streamStorage(config)
+	if st.GetBlockIdByName(args[1]) == "" {
+		log.Fatalf("no root named %s", args[1])
+	}
+	myfs := fs.NewFs(st, args[1], 0)
+	err = myfs.Send(os.Stdout, args[1], *from, header)
+	myfs.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func receive(args []string) {
+	name := ""
+	if len(args) > 1 {
+		name = args[1]
+	}
+	sr, err := storage.NewStreamReader(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := cryptoStorageConfiguration(args[0])
+	if sr.Header.StoreHeader != nil {
+		// New storage directory gets the data key of the sender
+		err = config.ImportHeader(sr.Header.StoreHeader)
+		if err != nil && err != factory.ErrNotNewStore {
+			log.Fatal(err)
+		}
+	}
+	st := streamStorage(config)
+	_, err = st.Receive(sr, name)
+	st.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n\n%s [flags] COMMAND [ARGS]\n\nCommands:\n\n", os.Args[0])
+		names := make([]string, 0, len(commands))
+		for k, _ := range commands {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			c := commands[k]
+			fmt.Fprintf(os.Stderr, "  %s %s\n\t%s\n", k, c.args, c.description)
+		}
+		fmt.Fprintf(os.Stderr, "\nFlags:\n\n")
+		flag.PrintDefaults()
+	}
+	password = flag.String("password", "siikret", "Password")
+	salt = flag.String("salt", "salt", "Salt (only for legacy storage without header)")
+	kdf = flag.String("kdf", "",
+		fmt.Sprintf("Key derivation function to use for the new password (possible: %v, default: same as before)", codec.KDFNames()))
+	rootName = flag.String("rootname", "root", "Name of the root reference")
+	backend = flag.String("backend", "badger",
+		fmt.Sprintf("Backend to use (possible: %v)", factory.List()))
+	cipher = flag.String("cipher", "",
+		fmt.Sprintf("Cipher to recodec to (possible: %v, default: same as before)", codec.CipherNames()))
+	compression = flag.String("compression", "snappy",
+		fmt.Sprintf("Compression to recodec to (possible: %v)", codec.CompressionNames()))
+	compressionLevel = flag.Int("compression-level", 0, "Compression level (zstd only; 0 = default)")
+	skipIncompressible = flag.Bool("skip-incompressible", false, "Whether to skip compressing blocks that look random")
+	fromPlain = flag.Bool("from-plain", false, "Whether the storage is currently unencrypted (recodec encrypts it with -password)")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	c, ok := commands[flag.Arg(0)]
+	args := flag.Args()[1:]
+	if !ok || len(args) < c.minArgs {
+		flag.Usage()
+		os.Exit(1)
+	}
+	c.run(args)
+}
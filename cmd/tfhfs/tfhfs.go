@@ -15,15 +15,21 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"time"
 
+	"github.com/fingon/go-tfhfs/codec"
 	"github.com/fingon/go-tfhfs/fs"
 	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/pb"
 	"github.com/fingon/go-tfhfs/server"
 	"github.com/fingon/go-tfhfs/storage"
 	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/fingon/go-tfhfs/storage/remote"
 	"github.com/hanwen/go-fuse/fuse"
 )
 
@@ -33,17 +39,42 @@ func main() {
 		flag.PrintDefaults()
 	}
 	password := flag.String("password", "siikret", "Password")
-	salt := flag.String("salt", "salt", "Salt")
+	salt := flag.String("salt", "salt", "Salt (only for legacy storage without header)")
+	kdf := flag.String("kdf", "",
+		fmt.Sprintf("Key derivation function for new storage (possible: %v, default: %s)", codec.KDFNames(), factory.DefaultKDF))
+	cipher := flag.String("cipher", "",
+		fmt.Sprintf("Cipher for new storage (possible: %v, default: %s)", codec.CipherNames(), factory.DefaultCipher))
+	hash := flag.String("hash", "",
+		fmt.Sprintf("Hash for block ids of new storage (possible: %v, default: %s, or legacy untagged sha256 if storage is not encrypted)", storage.HashNames(), factory.DefaultHash))
+	keyedIds := flag.Bool("keyed-ids", false, "Whether new storage should use block ids keyed with the storage secret (requires password)")
+	compression := flag.String("compression", "snappy",
+		fmt.Sprintf("Compression for new blocks (possible: %v)", codec.CompressionNames()))
+	compressionLevel := flag.Int("compression-level", 0, "Compression level (zstd only; 0 = default)")
+	skipIncompressible := flag.Bool("skip-incompressible", false, "Whether to skip compressing blocks that look random")
 	rootName := flag.String("rootname", "root", "Name of the root reference")
+	snapshot := flag.String("snapshot", "", "Name of the snapshot (of the root) to mount read-only")
 	backendp := flag.String("backend", "badger",
 		fmt.Sprintf("Backend to use (possible: %v)", factory.List()))
 	cpuprofile := flag.String("cpuprofile", "", "CPU profile file")
 	memprofile := flag.String("memprofile", "", "Memory profile file")
 	cachesize := flag.Int("cachesize", 10000, "Number of btree nodes to cache (~few k each, may be up to 2x this due to 2 places using same variable)")
+	readCacheSize := flag.Int("read-cache-size", 64<<20, "Number of bytes of decoded block data to cache")
 	//family := flag.String("family", "tcp", "Address family to use for server")
 	address := flag.String("address", "", "Address to use for server")
 	profile := flag.Bool("profile", false, "Whether to enable profiling 'bonus stuff'")
 	unsafe := flag.Bool("unsafe", false, "Whether to opt for speed instead of safety (bad things happen if machine crashes)")
+	quota := flag.Uint64("quota", 0, "Maximum number of bytes the storage may use (0 = unlimited)")
+	scrubRate := flag.Int("scrub-rate", 0, "Number of blocks per second to verify in background (0 = disabled)")
+	scrubPeer := flag.String("scrub-peer", "", "Address of the (sync peer) server to re-fetch corrupt blocks from")
+	replicaPeer := flag.String("replica-peer", "", "Address of the (sync peer) server to fetch missing blocks of partial replica from")
+	replicaBudget := flag.Uint64("replica-budget", 0, "Number of bytes the storage may use before cold file data is evicted (0 = disabled; requires -replica-peer)")
+	intentLog := flag.Bool("intent-log", true, "Whether to keep write-ahead intent log (makes fsync cheap)")
+	tierColdAge := flag.Duration("tier-cold-age", 24*time.Hour, "How long unread blocks stay in the fast tier (tiered backend only)")
+	tierPromote := flag.Bool("tier-promote", false, "Whether blocks read from the slow tier move back to the fast tier (tiered backend only)")
+	s3URL := flag.String("s3-url", "", "Object store (http(s)://HOST/BUCKET) to use (s3 backend only)")
+	s3Credentials := flag.String("s3-credentials", "", "File with the access key and the secret key of the object store (default: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables)")
+	remoteCacheSize := flag.Int("remote-cache-size", remote.DefaultCacheSize, "Number of bytes of block data to cache locally (remote backend only)")
+	volume := flag.Bool("volume", false, "Whether to serve volume (in the volume subdirectory of the storage) to remote backends (requires -address)")
 
 	flag.Parse()
 
@@ -67,12 +98,41 @@ func main() {
 	}
 
 	// actual filesystem
-	beconf := storage.BackendConfiguration{Directory: storedir, CacheSize: *cachesize, Unsafe: *unsafe}
+	beconf := storage.BackendConfiguration{Directory: storedir, CacheSize: *cachesize, Unsafe: *unsafe,
+		Quota: *quota, TierColdAge: *tierColdAge, TierPromote: *tierPromote,
+		S3URL: *s3URL, S3Credentials: *s3Credentials,
+		RemoteCacheSize: *remoteCacheSize}
 	conf := factory.CryptoStorageConfiguration{BackendConfiguration: beconf,
-		BackendName: *backendp, Password: *password, Salt: *salt}
+		BackendName: *backendp, Password: *password, Salt: *salt,
+		KDF: *kdf, Cipher: *cipher, KeyedIds: *keyedIds, Hash: *hash,
+		Compression: *compression, CompressionLevel: *compressionLevel,
+		SkipIncompressible: *skipIncompressible, ScrubRate: *scrubRate,
+		ReadCacheSize: *readCacheSize, IntentLog: *intentLog}
+	if *scrubPeer != "" {
+		url := fmt.Sprintf("http://%s", *scrubPeer)
+		conf.ScrubPeer = pb.NewFsProtobufClient(url, &http.Client{})
+	}
+	if *replicaPeer != "" {
+		url := fmt.Sprintf("http://%s", *replicaPeer)
+		conf.ReplicaPeer = pb.NewFsProtobufClient(url, &http.Client{})
+	}
 	st := factory.NewCryptoStorage(conf)
-	myfs := fs.NewFs(st, *rootName, *cachesize)
 	opts := &fuse.MountOptions{AllowOther: true}
+	var myfs *fs.Fs
+	if *snapshot != "" {
+		var err error
+		myfs, err = fs.NewSnapshotFs(st, *rootName, *snapshot, *cachesize)
+		if err != nil {
+			st.Close()
+			log.Fatal(err)
+		}
+		opts.Options = append(opts.Options, "ro")
+	} else {
+		myfs = fs.NewFs(st, *rootName, *cachesize)
+		if *replicaBudget > 0 {
+			myfs.StartEvictor(*replicaBudget)
+		}
+	}
 	if mlog.IsEnabled() {
 		opts.Debug = true
 	}
@@ -81,7 +141,15 @@ func main() {
 	var serv *server.Server
 
 	if *address != "" {
-		serv = (&server.Server{Address: *address, Fs: myfs, Storage: st}).Init()
+		var vol storage.Backend
+		if *volume {
+			volconf := storage.BackendConfiguration{Directory: filepath.Join(storedir, "volume"),
+				Unsafe: *unsafe}
+			os.MkdirAll(volconf.Directory, 0700)
+			vol = factory.NewWithConfig(*backendp, volconf)
+		}
+		serv = (&server.Server{Address: *address, Fs: myfs, Storage: st,
+			Volume: vol}).Init()
 	}
 
 	// fuse server
@@ -97,6 +165,9 @@ func main() {
 	// things cleared before we get out for memory profiling etc)
 	if serv != nil {
 		serv.Close()
+		if serv.Volume != nil {
+			serv.Volume.Close()
+		}
 	}
 
 	// myfs will take care of backend clearing as well
@@ -0,0 +1,43 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Wed Mar 28 09:41:55 2018 mstenber
+ * Last modified: Wed Mar 28 10:15:07 2018 mstenber
+ * Edit time:     12 min
+ *
+ */
+
+package codec
+
+import "errors"
+
+const numCipherTypes = CipherType_XCHACHA20_POLY1305 + 1
+
+var ErrUnknownCipher = errors.New("Unknown cipher")
+var ErrInvalidNonce = errors.New("Invalid nonce")
+
+var cipherNames = map[string]CipherType{
+	"aes-gcm":            CipherType_AES_GCM,
+	"xchacha20-poly1305": CipherType_XCHACHA20_POLY1305,
+}
+
+// CipherNames returns the names of supported ciphers.
+func CipherNames() []string {
+	keys := make([]string, 0, len(cipherNames))
+	for k, _ := range cipherNames {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// CipherTypeByName returns the CipherType matching the name (see
+// CipherNames).
+func CipherTypeByName(name string) (CipherType, error) {
+	t, ok := cipherNames[name]
+	if !ok {
+		return CipherType_UNSET, ErrUnknownCipher
+	}
+	return t, nil
+}
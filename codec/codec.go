@@ -24,13 +24,14 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"io"
 	"io/ioutil"
 	"log"
+	"sync"
 
 	"github.com/golang/snappy"
-	"golang.org/x/crypto/pbkdf2"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // Codec
@@ -43,17 +44,33 @@ type Codec interface {
 
 // EncryptingCodec
 //
-// AES GCM based encrypting/decrypting (+authenticating) Codec.
+// AEAD based encrypting/decrypting (+authenticating) Codec. Cipher
+// determines what is used to encrypt; data encrypted with any of the
+// supported ciphers (using the same key) can be decrypted.
 //
 // TBD: Should # of iterations be parametrizable?
 type EncryptingCodec struct {
-	gcm cipher.AEAD
+	// Cipher to use for encryption (default: AES GCM)
+	Cipher CipherType
+
+	aeads [numCipherTypes]cipher.AEAD
+
 	// Main key
 	mk []byte
 }
 
+// Init initializes the codec with key derived from the password.
 func (self EncryptingCodec) Init(password, salt []byte, iter int) *EncryptingCodec {
-	self.mk = pbkdf2.Key(password, salt, iter, 32, sha256.New)
+	return self.InitWithKey(PasswordKey(password, salt, iter))
+}
+
+// InitWithKey initializes the codec with the given (KeySize long)
+// key.
+func (self EncryptingCodec) InitWithKey(key []byte) *EncryptingCodec {
+	self.mk = key
+	if self.Cipher == CipherType_UNSET {
+		self.Cipher = CipherType_AES_GCM
+	}
 	block, err := aes.NewCipher(self.mk)
 	if err != nil {
 		log.Panic(err)
@@ -62,7 +79,12 @@ func (self EncryptingCodec) Init(password, salt []byte, iter int) *EncryptingCod
 	if err != nil {
 		log.Panic(err)
 	}
-	self.gcm = gcm
+	self.aeads[CipherType_AES_GCM] = gcm
+	xcp, err := chacha20poly1305.NewX(self.mk)
+	if err != nil {
+		log.Panic(err)
+	}
+	self.aeads[CipherType_XCHACHA20_POLY1305] = xcp
 	return &self
 }
 
@@ -70,19 +92,41 @@ func (self *EncryptingCodec) DecodeBytes(data, additionalData []byte) (ret []byt
 	var ed EncryptedData
 	_, err = ed.UnmarshalMsg(data)
 	if err != nil {
+		var led legacyEncryptedData
+		_, err2 := led.UnmarshalMsg(data)
+		if err2 != nil {
+			return
+		}
+		ed = EncryptedData{Nonce: led.Nonce,
+			EncryptedData: led.EncryptedData}
+		err = nil
+	}
+	ct := ed.Cipher
+	if ct == CipherType_UNSET {
+		ct = CipherType_AES_GCM
+	}
+	if ct >= numCipherTypes {
+		err = ErrUnknownCipher
 		return
 	}
-	ret, err = self.gcm.Open(nil, ed.Nonce, ed.EncryptedData, additionalData)
+	aead := self.aeads[ct]
+	if len(ed.Nonce) != aead.NonceSize() {
+		err = ErrInvalidNonce
+		return
+	}
+	ret, err = aead.Open(nil, ed.Nonce, ed.EncryptedData, additionalData)
 	return
 }
 
 func (self *EncryptingCodec) EncodeBytes(data, additionalData []byte) (ret []byte, err error) {
-	nonce := make([]byte, self.gcm.NonceSize())
+	aead := self.aeads[self.Cipher]
+	nonce := make([]byte, aead.NonceSize())
 	if _, err = rand.Read(nonce); err != nil {
 		return
 	}
-	ciphertext := self.gcm.Seal(ret, nonce, data, additionalData)
-	ed := EncryptedData{Nonce: nonce, EncryptedData: ciphertext}
+	ciphertext := aead.Seal(ret, nonce, data, additionalData)
+	ed := EncryptedData{Nonce: nonce, EncryptedData: ciphertext,
+		Cipher: self.Cipher}
 	ret, err = ed.MarshalMsg(nil)
 	return
 }
@@ -92,8 +136,20 @@ func (self *EncryptingCodec) EncodeBytes(data, additionalData []byte) (ret []byt
 // On-the-fly compressing Codec. If the result does not improve, the
 // result is marked to be plaintext and passed as-is (at cost of 1
 // byte).
+//
+// If SkipIncompressible is set, a sample of the data is checked
+// first, and if it looks random (e.g. already compressed or
+// encrypted), compression is not even attempted.
 type CompressingCodec struct {
 	CompressionType CompressionType
+
+	// Level is the compression level (only for zstd; 0 = default)
+	Level int
+
+	SkipIncompressible bool
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
 }
 
 func (self *CompressingCodec) DecodeBytes(data, additionalData []byte) (ret []byte, err error) {
@@ -115,6 +171,12 @@ func (self *CompressingCodec) DecodeBytes(data, additionalData []byte) (ret []by
 			return
 		}
 		ret, err = ioutil.ReadAll(r)
+	case CompressionType_ZSTD:
+		ret, err = zstdDecode(cd.RawData)
+	case CompressionType_LZ4:
+		ret, err = lz4Decode(cd.RawData)
+	default:
+		err = ErrUnknownCompression
 	}
 	return
 }
@@ -122,6 +184,22 @@ func (self *CompressingCodec) DecodeBytes(data, additionalData []byte) (ret []by
 func (self *CompressingCodec) EncodeBytes(data, additionalData []byte) (ret []byte, err error) {
 	var rd []byte
 	var ct CompressionType
+	if self.SkipIncompressible && isIncompressible(data) {
+		ct = CompressionType_PLAIN
+		rd = data
+	} else {
+		ct, rd = self.compress(data)
+	}
+	if ct != CompressionType_PLAIN && len(rd) >= len(data) {
+		ct = CompressionType_PLAIN
+		rd = data
+	}
+	cd := CompressedData{CompressionType: ct, RawData: rd}
+	ret, err = cd.MarshalMsg(nil)
+	return
+}
+
+func (self *CompressingCodec) compress(data []byte) (ct CompressionType, rd []byte) {
 	switch self.CompressionType {
 	case CompressionType_ZLIB:
 		var b bytes.Buffer
@@ -131,6 +209,21 @@ func (self *CompressingCodec) EncodeBytes(data, additionalData []byte) (ret []by
 		rd = b.Bytes()
 		ct = CompressionType_ZLIB
 
+	case CompressionType_ZSTD:
+		self.zstdOnce.Do(func() {
+			self.zstdEncoder = newZstdEncoder(self.Level)
+		})
+		rd = self.zstdEncoder.EncodeAll(data, nil)
+		ct = CompressionType_ZSTD
+
+	case CompressionType_LZ4:
+		rd = lz4Encode(data)
+		ct = CompressionType_LZ4
+		if rd == nil {
+			ct = CompressionType_PLAIN
+			rd = data
+		}
+
 	case CompressionType_UNSET:
 		fallthrough
 	case CompressionType_SNAPPY:
@@ -141,12 +234,6 @@ func (self *CompressingCodec) EncodeBytes(data, additionalData []byte) (ret []by
 		ct = CompressionType_PLAIN
 		rd = data
 	}
-	if ct != CompressionType_PLAIN && len(rd) >= len(data) {
-		ct = CompressionType_PLAIN
-		rd = data
-	}
-	cd := CompressedData{CompressionType: ct, RawData: rd}
-	ret, err = cd.MarshalMsg(nil)
 	return
 }
 
@@ -192,3 +279,24 @@ func (self *CodecChain) EncodeBytes(data, additionalData []byte) (ret []byte, er
 	}
 	return
 }
+
+// FallbackCodec
+//
+// Codec that encodes using Codec, but decodes also data encoded with
+// Fallback codec. This is useful only while migrating data from one
+// codec to another.
+type FallbackCodec struct {
+	Codec, Fallback Codec
+}
+
+func (self *FallbackCodec) DecodeBytes(data, additionalData []byte) (ret []byte, err error) {
+	ret, err = self.Codec.DecodeBytes(data, additionalData)
+	if err != nil {
+		ret, err = self.Fallback.DecodeBytes(data, additionalData)
+	}
+	return
+}
+
+func (self *FallbackCodec) EncodeBytes(data, additionalData []byte) (ret []byte, err error) {
+	return self.Codec.EncodeBytes(data, additionalData)
+}
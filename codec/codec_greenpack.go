@@ -18,11 +18,34 @@ package codec
 // This is responsible for hiding (and compressing) bytes in plain
 // sight, so to speak.
 
+type CipherType byte
+
+const (
+	// Not set; AES GCM (the only choice in the past).
+	CipherType_UNSET CipherType = iota
+
+	// AES GCM with 96 bit random nonce.
+	CipherType_AES_GCM
+
+	// XChaCha20-Poly1305 with 192 bit random nonce.
+	CipherType_XCHACHA20_POLY1305
+)
+
 type EncryptedData struct {
-	// nonce used for AES GCM
+	// nonce used for the cipher
 	Nonce []byte `zid:"0"`
 
-	// EncryptedData is AES GCM encrypted CompressedData
+	// EncryptedData is encrypted CompressedData
+	EncryptedData []byte `zid:"1"`
+
+	// Cipher used to produce EncryptedData
+	Cipher CipherType `zid:"2"`
+}
+
+// legacyEncryptedData is EncryptedData without the Cipher; it is used
+// only to decode old AES GCM encrypted data.
+type legacyEncryptedData struct {
+	Nonce         []byte `zid:"0"`
 	EncryptedData []byte `zid:"1"`
 }
 
@@ -39,6 +62,12 @@ const (
 
 	// Golang built-in zlib
 	CompressionType_ZLIB
+
+	// Zstandard (level is not needed for decoding)
+	CompressionType_ZSTD
+
+	// LZ4 block, prefixed with uvarint length of the original data
+	CompressionType_LZ4
 )
 
 type CompressedData struct {
@@ -48,3 +77,30 @@ type CompressedData struct {
 	// RawData is the raw data of the client (whatever it is)
 	RawData []byte `zid:"1"`
 }
+
+type KDFType byte
+
+const (
+	KDFType_UNSET KDFType = iota
+
+	// PBKDF2 with SHA256; Iterations is the only cost parameter.
+	KDFType_PBKDF2
+
+	// Argon2id; Iterations is the time cost, Memory in KiB,
+	// Parallelism the number of threads.
+	KDFType_ARGON2ID
+
+	// scrypt; Iterations is N, Memory is r, Parallelism is p.
+	KDFType_SCRYPT
+)
+
+// KDFParameters describe how a key is derived from a password. They
+// are persisted so that deriving the key again later on needs only
+// the password.
+type KDFParameters struct {
+	Type        KDFType `zid:"0"`
+	Salt        []byte  `zid:"1"`
+	Iterations  uint32  `zid:"2"`
+	Memory      uint32  `zid:"3"`
+	Parallelism uint8   `zid:"4"`
+}
@@ -13,6 +13,7 @@ package codec
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"testing"
@@ -69,6 +70,95 @@ func TestEncryptingCodec(t *testing.T) {
 	assert.Equal(t, p, dec)
 }
 
+func TestCiphers(t *testing.T) {
+	key, err := NewDataKey()
+	assert.Nil(t, err)
+	p := []byte("data")
+	for _, name := range CipherNames() {
+		ct, err := CipherTypeByName(name)
+		assert.Nil(t, err)
+		c := EncryptingCodec{Cipher: ct}.InitWithKey(key)
+		ProdCodec(c, t)
+
+		// Whatever the cipher we use for encoding is, we should
+		// be able to decode data encrypted with the other ones
+		enc, err := c.EncodeBytes(p, nil)
+		assert.Nil(t, err)
+		for _, name2 := range CipherNames() {
+			ct2, _ := CipherTypeByName(name2)
+			c2 := EncryptingCodec{Cipher: ct2}.InitWithKey(key)
+			dec, err := c2.DecodeBytes(enc, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, p, dec)
+		}
+	}
+	_, err = CipherTypeByName("rot13")
+	assert.Equal(t, err, ErrUnknownCipher)
+
+	// Data encoded before Cipher was recorded should still decode
+	c := EncryptingCodec{}.InitWithKey(key)
+	enc, err := c.EncodeBytes(p, nil)
+	assert.Nil(t, err)
+	var ed EncryptedData
+	_, err = ed.UnmarshalMsg(enc)
+	assert.Nil(t, err)
+	led := legacyEncryptedData{Nonce: ed.Nonce,
+		EncryptedData: ed.EncryptedData}
+	enc, err = led.MarshalMsg(nil)
+	assert.Nil(t, err)
+	dec, err := c.DecodeBytes(enc, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, p, dec)
+}
+
+func TestKeyWrap(t *testing.T) {
+	key, err := NewDataKey()
+	assert.Nil(t, err)
+	assert.Equal(t, len(key), KeySize)
+
+	kek := PasswordKey([]byte("foo"), []byte("salt"), 64)
+	wrapped, err := WrapKey(key, kek)
+	assert.Nil(t, err)
+
+	key2, err := UnwrapKey(wrapped, kek)
+	assert.Nil(t, err)
+	assert.Equal(t, key, key2)
+
+	// Wrong password should not work
+	kek2 := PasswordKey([]byte("bar"), []byte("salt"), 64)
+	_, err = UnwrapKey(wrapped, kek2)
+	assert.True(t, err != nil)
+
+	// Codec initialized with the key should be usable
+	ProdCodec(EncryptingCodec{}.InitWithKey(key2), t)
+}
+
+func TestKDF(t *testing.T) {
+	for _, name := range KDFNames() {
+		kt, err := KDFTypeByName(name)
+		assert.Nil(t, err)
+		p, err := NewKDFParameters(kt)
+		assert.Nil(t, err)
+		// Default costs are bit too high for unit tests
+		if kt == KDFType_ARGON2ID {
+			p.Memory = 1024
+		} else {
+			p.Iterations = 1024
+		}
+		k1, err := p.Key([]byte("foo"))
+		assert.Nil(t, err)
+		assert.Equal(t, len(k1), KeySize)
+		k2, err := p.Key([]byte("foo"))
+		assert.Nil(t, err)
+		assert.Equal(t, k1, k2)
+		k3, err := p.Key([]byte("bar"))
+		assert.Nil(t, err)
+		assert.NotEqual(t, k1, k3)
+	}
+	_, err := KDFTypeByName("rot13")
+	assert.Equal(t, err, ErrUnknownKDF)
+}
+
 func TestCompressingCodec(t *testing.T) {
 	c := &CompressingCodec{}
 	ProdCodec(c, t)
@@ -80,6 +170,78 @@ func TestCompressingCodec(t *testing.T) {
 	assert.Equal(t, len(enc), 21) // much less than the original ~100b
 }
 
+func TestCompressionTypes(t *testing.T) {
+	p := []byte(compressible)
+	for _, name := range CompressionNames() {
+		ct, err := CompressionTypeByName(name)
+		assert.Nil(t, err)
+		c := &CompressingCodec{CompressionType: ct}
+		ProdCodec(c, t)
+		if ct != CompressionType_PLAIN {
+			enc, err := c.EncodeBytes(p, nil)
+			assert.Nil(t, err)
+			assert.True(t, len(enc) < len(compressible))
+		}
+	}
+	_, err := CompressionTypeByName("rot13")
+	assert.Equal(t, err, ErrUnknownCompression)
+
+	c := &CompressingCodec{CompressionType: CompressionType_ZSTD, Level: 19}
+	ProdCodec(c, t)
+}
+
+func TestLZ4Length(t *testing.T) {
+	// Maximally compressible data is within the length limits
+	p := make([]byte, 1<<20)
+	enc := lz4Encode(p)
+	assert.True(t, enc != nil)
+	assert.Equal(t, lz4Encode(p), enc)
+	dec, err := lz4Decode(enc)
+	assert.Nil(t, err)
+	assert.Equal(t, len(dec), len(p))
+
+	// Bogus lengths are rejected before allocating anything
+	bogus := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(bogus, 1<<40)
+	_, err = lz4Decode(append(bogus[:n], enc[3:]...))
+	assert.Equal(t, err, ErrInvalidLength)
+	n = binary.PutUvarint(bogus, 1<<20)
+	_, err = lz4Decode(append(bogus[:n], 1, 2, 3))
+	assert.Equal(t, err, ErrInvalidLength)
+}
+
+func TestZstdLength(t *testing.T) {
+	enc := newZstdEncoder(0)
+	p := make([]byte, 1<<20)
+	dec, err := zstdDecode(enc.EncodeAll(p, nil))
+	assert.Nil(t, err)
+	assert.Equal(t, len(dec), len(p))
+
+	// Decompression bombs are rejected
+	p = make([]byte, 2*maxLZ4DecodedSize)
+	_, err = zstdDecode(enc.EncodeAll(p, nil))
+	assert.NotNil(t, err)
+}
+
+func TestSkipIncompressible(t *testing.T) {
+	random := make([]byte, 4096)
+	_, err := rand.Read(random)
+	assert.Nil(t, err)
+	assert.True(t, isIncompressible(random))
+	assert.True(t, !isIncompressible(make([]byte, 4096)))
+	assert.True(t, !isIncompressible([]byte(compressible)))
+
+	c := &CompressingCodec{CompressionType: CompressionType_ZSTD,
+		SkipIncompressible: true}
+	ProdCodec(c, t)
+	enc, err := c.EncodeBytes(random, nil)
+	assert.Nil(t, err)
+	var cd CompressedData
+	_, err = cd.UnmarshalMsg(enc)
+	assert.Nil(t, err)
+	assert.Equal(t, cd.CompressionType, CompressionType_PLAIN)
+}
+
 func TestNopCodecChain(t *testing.T) {
 	c := &CodecChain{}
 	ProdCodec(c, t)
@@ -94,7 +256,28 @@ func TestCodecChain(t *testing.T) {
 	enc, err := c.EncodeBytes(p, nil)
 	assert.Nil(t, err)
 	assert.True(t, len(enc) < len(compressible))
-	assert.Equal(t, len(enc), 54) // bit less than the original ~100
+	assert.Equal(t, len(enc), 55) // bit less than the original ~100
+}
+
+func TestFallbackCodec(t *testing.T) {
+	c1 := EncryptingCodec{}.Init([]byte("foo"), []byte("salt"), 64)
+	c2 := &CompressingCodec{}
+	c := &FallbackCodec{Codec: CodecChain{}.Init(c1, c2), Fallback: c2}
+	ProdCodec(c, t)
+
+	// Data encoded with the fallback codec should be readable
+	p := []byte(compressible)
+	enc, err := c2.EncodeBytes(p, nil)
+	assert.Nil(t, err)
+	dec, err := c.DecodeBytes(enc, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, p, dec)
+
+	// But new data should be encoded with the main codec
+	enc, err = c.EncodeBytes(p, nil)
+	assert.Nil(t, err)
+	_, err = c1.DecodeBytes(enc, nil)
+	assert.Nil(t, err)
 }
 
 func BenchmarkCodec(b *testing.B) {
@@ -155,9 +338,18 @@ func BenchmarkCodec(b *testing.B) {
 	cd := &CompressingCodec{}
 	c1 := &CompressingCodec{CompressionType: CompressionType_SNAPPY}
 	c2 := &CompressingCodec{CompressionType: CompressionType_ZLIB}
+	c3 := &CompressingCodec{CompressionType: CompressionType_ZSTD}
+	c4 := &CompressingCodec{CompressionType: CompressionType_LZ4}
+	c5 := &CompressingCodec{CompressionType: CompressionType_ZSTD,
+		SkipIncompressible: true}
+	cx := EncryptingCodec{Cipher: CipherType_XCHACHA20_POLY1305}.Init([]byte("foo"), []byte("salt"), 64)
 	cc := CodecChain{}.Init(ce, cd)
 	add(ce, "AES256")
+	add(cx, "XChaCha20")
 	add(c1, "Snappy")
 	add(c2, "Zlib")
+	add(c3, "Zstd")
+	add(c4, "LZ4")
+	add(c5, "Zstd+Skip")
 	add(cc, "AES+Default")
 }
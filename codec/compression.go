@@ -0,0 +1,180 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Thu Mar 29 09:12:40 2018 mstenber
+ * Last modified: Thu Mar 29 10:31:18 2018 mstenber
+ * Edit time:     64 min
+ *
+ */
+
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+var ErrUnknownCompression = errors.New("Unknown compression type")
+var ErrInvalidLength = errors.New("Invalid uncompressed length")
+
+var compressionNames = map[string]CompressionType{
+	"plain":  CompressionType_PLAIN,
+	"snappy": CompressionType_SNAPPY,
+	"zlib":   CompressionType_ZLIB,
+	"zstd":   CompressionType_ZSTD,
+	"lz4":    CompressionType_LZ4,
+}
+
+// CompressionNames returns the names of supported compression types.
+func CompressionNames() []string {
+	keys := make([]string, 0, len(compressionNames))
+	for k, _ := range compressionNames {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// CompressionTypeByName returns the CompressionType matching the
+// name (see CompressionNames).
+func CompressionTypeByName(name string) (CompressionType, error) {
+	t, ok := compressionNames[name]
+	if !ok {
+		return CompressionType_UNSET, ErrUnknownCompression
+	}
+	return t, nil
+}
+
+const (
+	// Number of samples taken and their size
+	entropySamples    = 4
+	entropySampleSize = 256
+
+	// Bits per byte above which data is considered
+	// incompressible. Uniformly random sample of 1024 bytes has
+	// estimated entropy of ~7.8 bits/byte.
+	entropyThreshold = 7.5
+)
+
+// isIncompressible estimates Shannon entropy of (a sample of) the
+// data. The data is deemed incompressible if it looks random enough.
+func isIncompressible(data []byte) bool {
+	var counts [256]int
+	n := 0
+	count := func(b []byte) {
+		for _, v := range b {
+			counts[v]++
+		}
+		n += len(b)
+	}
+	if len(data) <= entropySamples*entropySampleSize {
+		count(data)
+	} else {
+		step := (len(data) - entropySampleSize) / (entropySamples - 1)
+		for i := 0; i < entropySamples; i++ {
+			ofs := i * step
+			count(data[ofs : ofs+entropySampleSize])
+		}
+	}
+	if n == 0 {
+		return false
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy > entropyThreshold
+}
+
+func newZstdEncoder(level int) *zstd.Encoder {
+	opts := []zstd.EOption{}
+	if level != 0 {
+		opts = append(opts,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		log.Panic(err)
+	}
+	return enc
+}
+
+// Decoder is shared; it does not care about level, and DecodeAll may
+// be called concurrently.
+var zstdDecoder *zstd.Decoder
+var zstdDecoderOnce sync.Once
+
+func zstdDecode(data []byte) ([]byte, error) {
+	zstdDecoderOnce.Do(func() {
+		var err error
+		zstdDecoder, err = zstd.NewReader(nil,
+			zstd.WithDecoderMaxMemory(maxLZ4DecodedSize))
+		if err != nil {
+			log.Panic(err)
+		}
+	})
+	return zstdDecoder.DecodeAll(data, nil)
+}
+
+// lz4HashTables are reused between lz4Encode calls, as they are
+// ~512kb each.
+var lz4HashTables = sync.Pool{
+	New: func() interface{} {
+		return new([1 << 16]int)
+	},
+}
+
+// lz4Encode returns uvarint length of data + LZ4 block of it, or nil
+// if the data could not be compressed.
+func lz4Encode(data []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+lz4.CompressBlockBound(len(data)))
+	ofs := binary.PutUvarint(buf, uint64(len(data)))
+	ht := lz4HashTables.Get().(*[1 << 16]int)
+	defer lz4HashTables.Put(ht)
+	// The table has to be clean
+	*ht = [1 << 16]int{}
+	n, err := lz4.CompressBlock(data, buf[ofs:], ht[:])
+	if err != nil || n == 0 {
+		return nil
+	}
+	return buf[:ofs+n]
+}
+
+// maxLZ4DecodedSize is the largest length lz4Decode (and zstdDecode)
+// accepts. Blocks are much smaller (file data is stored in 64kb
+// extents), but tree nodes and name blocks may be larger; this is
+// just a sanity limit for the length that comes from the (untrusted)
+// data.
+const maxLZ4DecodedSize = 16 << 20
+
+// lz4MaxRatio is the maximum ratio of decompressed and compressed
+// size; in LZ4, every 255 bytes of match length cost at least a byte.
+const lz4MaxRatio = 255
+
+func lz4Decode(data []byte) ([]byte, error) {
+	l, ofs := binary.Uvarint(data)
+	if ofs <= 0 || l > maxLZ4DecodedSize ||
+		l > uint64(len(data)-ofs)*lz4MaxRatio+binary.MaxVarintLen64 {
+		return nil, ErrInvalidLength
+	}
+	ret := make([]byte, l)
+	n, err := lz4.UncompressBlock(data[ofs:], ret)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) != l {
+		return nil, ErrInvalidLength
+	}
+	return ret, nil
+}
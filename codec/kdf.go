@@ -0,0 +1,96 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Tue Mar 27 09:20:14 2018 mstenber
+ * Last modified: Tue Mar 27 10:48:30 2018 mstenber
+ * Edit time:     55 min
+ *
+ */
+
+package codec
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const saltSize = 16
+
+var ErrUnknownKDF = errors.New("Unknown key derivation function")
+
+var kdfNames = map[string]KDFType{
+	"pbkdf2":   KDFType_PBKDF2,
+	"argon2id": KDFType_ARGON2ID,
+	"scrypt":   KDFType_SCRYPT,
+}
+
+// KDFNames returns the names of supported key derivation functions.
+func KDFNames() []string {
+	keys := make([]string, 0, len(kdfNames))
+	for k, _ := range kdfNames {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// KDFTypeByName returns the KDFType matching the name (see
+// KDFNames).
+func KDFTypeByName(name string) (KDFType, error) {
+	t, ok := kdfNames[name]
+	if !ok {
+		return KDFType_UNSET, ErrUnknownKDF
+	}
+	return t, nil
+}
+
+// NewKDFParameters produces parameters for the given key derivation
+// function, with random salt and the default costs.
+func NewKDFParameters(t KDFType) (*KDFParameters, error) {
+	self := &KDFParameters{Type: t, Salt: make([]byte, saltSize)}
+	switch t {
+	case KDFType_PBKDF2:
+		self.Iterations = 100000
+	case KDFType_ARGON2ID:
+		self.Iterations = 1
+		self.Memory = 64 * 1024
+		self.Parallelism = 4
+	case KDFType_SCRYPT:
+		self.Iterations = 1 << 15
+		self.Memory = 8
+		self.Parallelism = 1
+	default:
+		return nil, ErrUnknownKDF
+	}
+	if _, err := rand.Read(self.Salt); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// Key derives a KeySize long key from the password.
+func (self *KDFParameters) Key(password []byte) ([]byte, error) {
+	switch self.Type {
+	case KDFType_PBKDF2:
+		return pbkdf2.Key(password, self.Salt, int(self.Iterations),
+			KeySize, sha256.New), nil
+	case KDFType_ARGON2ID:
+		return argon2.IDKey(password, self.Salt, self.Iterations,
+			self.Memory, self.Parallelism, KeySize), nil
+	case KDFType_SCRYPT:
+		return scrypt.Key(password, self.Salt, int(self.Iterations),
+			int(self.Memory), int(self.Parallelism), KeySize)
+	}
+	return nil, ErrUnknownKDF
+}
+
+func (self *KDFParameters) String() string {
+	return fmt.Sprintf("kdf{t:%v,i:%v,m:%v,p:%v}", self.Type, self.Iterations, self.Memory, self.Parallelism)
+}
@@ -0,0 +1,67 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Mon Mar 26 10:12:41 2018 mstenber
+ * Last modified: Mon Mar 26 11:02:17 2018 mstenber
+ * Edit time:     35 min
+ *
+ */
+
+package codec
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// KeySize is the size of keys used by EncryptingCodec (256 bits).
+const KeySize = 32
+
+// wrapAdditionalData is used to ensure wrapped keys cannot be
+// confused with other encrypted data.
+var wrapAdditionalData = []byte("tfhfs-datakey")
+
+// PasswordKey derives a key from password using PBKDF2-SHA256.
+func PasswordKey(password, salt []byte, iter int) []byte {
+	return pbkdf2.Key(password, salt, iter, KeySize, sha256.New)
+}
+
+// BlockIdKeyPurpose is used to derive the key for keyed block ids
+// from the data key.
+const BlockIdKeyPurpose = "tfhfs-blockid"
+
+// DeriveKey derives a subkey for the given purpose from the key,
+// using HMAC-SHA256.
+func DeriveKey(key []byte, purpose string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(purpose))
+	return m.Sum(nil)
+}
+
+// NewDataKey returns fresh random key suitable for
+// EncryptingCodec.InitWithKey.
+func NewDataKey() (key []byte, err error) {
+	key = make([]byte, KeySize)
+	_, err = rand.Read(key)
+	return
+}
+
+// WrapKey encrypts the (data) key using the key encryption key
+// kek. The result is what should be persisted; the data key itself
+// never should be.
+func WrapKey(key, kek []byte) ([]byte, error) {
+	c := EncryptingCodec{}.InitWithKey(kek)
+	return c.EncodeBytes(key, wrapAdditionalData)
+}
+
+// UnwrapKey is the inverse of WrapKey. Error is returned if kek is
+// not the one that was used to wrap the key (e.g. wrong password).
+func UnwrapKey(wrapped, kek []byte) ([]byte, error) {
+	c := EncryptingCodec{}.InitWithKey(kek)
+	return c.DecodeBytes(wrapped, wrapAdditionalData)
+}
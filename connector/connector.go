@@ -25,6 +25,13 @@ import (
 
 type Connection struct {
 	Family, Address, RootName, OtherRootName string
+
+	// MetadataOnly is set if the end is a partial replica; only
+	// the data of blocks that refer to other blocks is copied to
+	// it, and the rest (e.g. file extents) are stored with
+	// BS_MISSING status and fetched on demand from its replica
+	// peer.
+	MetadataOnly bool
 }
 
 // Connector glues together two tfhfs servers ('left' and 'right').
@@ -91,7 +98,7 @@ func (self *Connector) Sync(from *Connection, to *Connection) (ops int, err erro
 
 	// Nothing to be done
 	if fid != tid {
-		subops, err := self.copyBlockTo(fclient, tclient, fid.Id, to.OtherRootName)
+		subops, err := self.copyBlockTo(fclient, tclient, fid.Id, to.OtherRootName, to.MetadataOnly)
 		if err != nil {
 			return 0, err
 		}
@@ -122,7 +129,7 @@ func (self *Connector) Sync(from *Connection, to *Connection) (ops int, err erro
 	return
 }
 
-func (self *Connector) copyBlockTo(fclient, tclient pb.Fs, bid, inName string) (ops int, err error) {
+func (self *Connector) copyBlockTo(fclient, tclient pb.Fs, bid, inName string, metadataOnly bool) (ops int, err error) {
 	mlog.Printf2("connector/connector", "copyBlockTo %x @%s", bid, inName)
 	bg := context.Background()
 
@@ -134,25 +141,29 @@ func (self *Connector) copyBlockTo(fclient, tclient pb.Fs, bid, inName string) (
 	}
 	if b.Id == "" {
 		ops++
-		fb, err2 := fclient.GetBlockById(bg, &pb.GetBlockRequest{Id: bid, WantData: true})
+		fb, err2 := fclient.GetBlockById(bg, &pb.GetBlockRequest{Id: bid, WantData: true, SkipLeafData: metadataOnly})
 		if err2 != nil {
 			return 0, err2
 		}
+		status := storage.BS_WEAK
+		if fb.Leaf {
+			status = storage.BS_MISSING
+		}
 
 		ops++
-		b, err = tclient.StoreBlock(bg, &pb.StoreRequest{Name: inName, Block: &pb.Block{Id: bid, Data: fb.Data, Status: int32(storage.BS_WEAK)}})
+		b, err = tclient.StoreBlock(bg, &pb.StoreRequest{Name: inName, Block: &pb.Block{Id: bid, Data: fb.Data, Status: int32(status)}})
 		if err != nil {
 			return
 		}
 
 	}
 
-	subops, err := self.upgradeBlock(fclient, tclient, bid, inName, b)
+	subops, err := self.upgradeBlock(fclient, tclient, bid, inName, b, metadataOnly)
 	ops += subops
 	return
 }
 
-func (self *Connector) upgradeBlock(fclient, tclient pb.Fs, bid, inName string, b *pb.Block) (ops int, err error) {
+func (self *Connector) upgradeBlock(fclient, tclient pb.Fs, bid, inName string, b *pb.Block, metadataOnly bool) (ops int, err error) {
 	bg := context.Background()
 	for {
 		if b.MissingIds != nil {
@@ -161,7 +172,7 @@ func (self *Connector) upgradeBlock(fclient, tclient pb.Fs, bid, inName string,
 			for _, mbid := range b.MissingIds {
 				mbid := mbid
 				wg.Go(func() {
-					subops, err2 := self.copyBlockTo(fclient, tclient, mbid, inName)
+					subops, err2 := self.copyBlockTo(fclient, tclient, mbid, inName, metadataOnly)
 					defer lock.Locked()()
 					ops += subops
 					if err2 != nil {
@@ -14,12 +14,14 @@ package connector_test
 import (
 	"bytes"
 	"log"
+	"net/http"
 	"os"
 	"testing"
 
 	"github.com/fingon/go-tfhfs/connector"
 	"github.com/fingon/go-tfhfs/fs"
 	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/pb"
 	"github.com/fingon/go-tfhfs/server"
 	"github.com/fingon/go-tfhfs/storage"
 	"github.com/fingon/go-tfhfs/storage/factory"
@@ -132,3 +134,54 @@ func TestConnector(t *testing.T) {
 	assert.True(t, o5 > o1)
 
 }
+
+func TestConnectorMetadataOnly(t *testing.T) {
+	t.Parallel()
+	family := "tcp"
+	a1 := "127.0.0.1:12347"
+	s1 := newSystem("rootLeft", family, a1)
+	u1 := fs.NewFSUser(s1.fs)
+	defer s1.Close()
+
+	a2 := "127.0.0.1:12348"
+	s2 := newSystem("rootRight", family, a2)
+	u2 := fs.NewFSUser(s2.fs)
+	defer s2.Close()
+
+	// Right is partial replica
+	c := connector.Connector{Left: connector.Connection{Family: family,
+		Address:  a1,
+		RootName: "rootLeft", OtherRootName: "rightAtLeft"},
+		Right: connector.Connection{Family: family,
+			Address:  a2,
+			RootName: "rootRight", OtherRootName: "leftAtRight",
+			MetadataOnly: true}}
+
+	content := bytes.Repeat([]byte("BIG"), 123456)
+	f, err := u1.OpenFile("/big", uint32(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), 0600)
+	assert.Nil(t, err)
+	f.Write(content)
+	f.Close()
+	_, err = c.Run()
+	assert.Nil(t, err)
+
+	read := func() ([]byte, error) {
+		f, err := u2.OpenFile("/big", uint32(os.O_RDONLY), 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		b := make([]byte, len(content))
+		n, err := f.Read(b)
+		return b[:n], err
+	}
+
+	// File is there, but its data is not
+	_, err = read()
+	assert.True(t, err != nil)
+
+	s2.st.ReplicaPeer = pb.NewFsProtobufClient("http://"+a1, &http.Client{})
+	b, err := read()
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), string(content))
+}
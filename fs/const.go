@@ -20,3 +20,7 @@ const entryValidity = 5
 const EmbeddedSize = 1024
 const dataExtentSize = 65536
 const dataHeaderMaximumSize = 100
+
+// createSpace is the free space required to create an inode (rough
+// estimate of the tree nodes it rewrites)
+const createSpace = 4096
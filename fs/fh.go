@@ -15,6 +15,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
+	"sync/atomic"
 
 	"github.com/fingon/go-tfhfs/ibtree/hugger"
 	"github.com/fingon/go-tfhfs/mlog"
@@ -35,6 +36,10 @@ type inodeFH struct {
 	// last key in directory at pos (if any)
 	lastKey *BlockKey
 
+	// writeStatus is the failure (fuse.Status) of asynchronous
+	// part of an earlier write, if any
+	writeStatus int32
+
 	// statistics for unit tests (these cost some memory but so what)
 	readNextInodeBruteForceCount int
 }
@@ -163,23 +168,25 @@ func (self *inodeFH) readInTransaction(tr *hugger.Transaction, buf []byte, offse
 	if size <= EmbeddedSize {
 		b = meta.Data
 	} else {
-		k := NewBlockKeyOffset(self.inode.ino, offset)
+		var bl *storage.StorageBlock
+		bl, code = self.fetchExtent(tr, offset)
+		if !code.Ok() {
+			return
+		}
 		e := offset / dataExtentSize
 		offset -= e * dataExtentSize
 		end -= e * dataExtentSize
 		if end > dataExtentSize {
 			end = dataExtentSize
 		}
-		bidp := tr.IB().Get(k.IB())
-		if bidp == nil {
-			mlog.Printf2("fs/fh", "Key %x not found at all", k)
-		} else {
-			bl := self.Fs().storage.GetBlockById(*bidp)
-			if bl == nil {
-				mlog.Panicf("Block %x not found at all", *bidp)
-			}
+		if bl != nil {
 			defer bl.Close()
 			b = bl.Data()
+			if len(b) == 0 {
+				mlog.Printf2("fs/fh", "No data in extent %x", bl.Id())
+				code = fuse.EIO
+				return
+			}
 			if b[0] != byte(BDT_EXTENT) {
 				log.Panicf("Wrong extent type in read (%x != %x) - block content: %x", b[0], BDT_EXTENT, b)
 			}
@@ -258,7 +265,7 @@ func (self *inodeFH) Read(buf []byte, offset uint64) (rr fuse.ReadResult, code f
 
 }
 
-func (self *inodeFH) writeInTransaction(meta *InodeMeta, tr *hugger.Transaction, buf, odata, obuf, wbuf []byte, bofs int, offset, end uint64) {
+func (self *inodeFH) writeInTransaction(meta *InodeMeta, tr *hugger.Transaction, buf, odata, obuf, wbuf []byte, bofs int, offset, end uint64) (code fuse.Status) {
 	if bofs > 0 {
 		// Clear the bytes (in case we're reusing buffer)
 		for i := 0; i < bofs; i++ {
@@ -270,7 +277,8 @@ func (self *inodeFH) writeInTransaction(meta *InodeMeta, tr *hugger.Transaction,
 			}
 			copy(wbuf, odata)
 		} else {
-			r, code := self.readInTransaction(tr, wbuf[:bofs], offset)
+			var r int
+			r, code = self.readInTransaction(tr, wbuf[:bofs], offset)
 			if !code.Ok() {
 				return
 			}
@@ -291,7 +299,8 @@ func (self *inodeFH) writeInTransaction(meta *InodeMeta, tr *hugger.Transaction,
 	}
 	if blockend > end {
 		extra := blockend - end
-		r, code := self.readInTransaction(tr, wbuf[:extra], end)
+		var r int
+		r, code = self.readInTransaction(tr, wbuf[:extra], end)
 		if !code.Ok() {
 			return
 		}
@@ -325,9 +334,25 @@ func (self *inodeFH) writeInTransaction(meta *InodeMeta, tr *hugger.Transaction,
 		// mlog.Printf2("fs/fh", " %x", buf)
 		tr.IB().Set(k.IB(), bid)
 	}
+	return fuse.OK
+}
+
+// setWriteStatus records failure of asynchronous part of write.
+func (self *inodeFH) setWriteStatus(code fuse.Status) {
+	atomic.StoreInt32(&self.writeStatus, int32(code))
+}
 
+// WriteStatus returns (and clears) the failure of asynchronous part
+// of an earlier write, if any.
+func (self *inodeFH) WriteStatus() fuse.Status {
+	return fuse.Status(atomic.SwapInt32(&self.writeStatus, int32(fuse.OK)))
 }
+
 func (self *inodeFH) Write(buf []byte, offset uint64) (written uint32, code fuse.Status) {
+	code = self.WriteStatus()
+	if !code.Ok() {
+		return
+	}
 	wwritten := len(buf)
 	for int(written) < wwritten {
 		w, code := self.write(buf[written:], offset+uint64(written))
@@ -365,6 +390,19 @@ func (self *inodeFH) write(buf []byte, offset uint64) (written uint32, code fuse
 		return
 	}
 
+	// Partial writes need the rest of the extent; it is kept open
+	// until it has been rewritten so it cannot be evicted
+	var bl *storage.StorageBlock
+	if meta.StSize > EmbeddedSize {
+		bl, code = self.fetchExtent(tr, offset)
+		if !code.Ok() {
+			unlock()
+			unlockmeta()
+			tr.Close()
+			return
+		}
+	}
+
 	done = false
 	var odata []byte
 	if meta.StSize <= EmbeddedSize && e == 0 {
@@ -397,7 +435,17 @@ func (self *inodeFH) write(buf []byte, offset uint64) (written uint32, code fuse
 
 	mlog.Printf2("fs/fh", " wrote %v", written)
 	if meta.StSize <= EmbeddedSize && end <= EmbeddedSize {
-		self.writeInTransaction(meta, tr, buf, odata, obuf, wbuf, bofs, offset, end)
+		code = self.writeInTransaction(meta, tr, buf, odata, obuf, wbuf, bofs, offset, end)
+		if !code.Ok() {
+			self.Fs().writeBuffers.Put(obuf)
+			if bl != nil {
+				bl.Close()
+			}
+			unlock()
+			unlockmeta()
+			tr.Close()
+			return 0, code
+		}
 		done = true
 	}
 
@@ -414,6 +462,9 @@ func (self *inodeFH) write(buf []byte, offset uint64) (written uint32, code fuse
 		locked.UpdateOwner()
 		defer unlock()
 		defer self.Fs().writeBuffers.Put(obuf)
+		if bl != nil {
+			defer bl.Close()
+		}
 
 		// If file data is part of meta, we have to commit it
 		// before metadata is unlocked; if not, last write
@@ -437,7 +488,15 @@ func (self *inodeFH) write(buf []byte, offset uint64) (written uint32, code fuse
 		// We inherit the block-lock, and release only when we're done
 
 		tr := self.Fs().GetTransaction()
-		self.writeInTransaction(meta, tr, buf, odata, obuf, wbuf, bofs, offset, end)
+		code := self.writeInTransaction(meta, tr, buf, odata, obuf, wbuf, bofs, offset, end)
+		if !code.Ok() {
+			// Write has been already acknowledged; report
+			// the failure on next Write or Fsync
+			mlog.Printf2("fs/fh", " write of data block %v failed: %v", e, code)
+			self.setWriteStatus(code)
+			tr.Close()
+			return
+		}
 		tr.CommitUntilSucceeds()
 		mlog.Printf2("fs/fh", " updated data block %v", e)
 	})
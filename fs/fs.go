@@ -46,16 +46,22 @@ type Fs struct {
 	storage       *storage.Storage
 	writeLimiter  util.ParallelLimiter
 	writeBuffers  util.ByteSliceAtomicList
+	opStatistics  opStatistics
+
+	// readOnly filesystems (snapshots) never change their root
+	readOnly     bool
+	snapshotLock util.MutexLocked
+
+	// evictor (if started) keeps partial replica within its budget
+	evictor evictor
 }
 
 func (self *Fs) Close() {
 
 	mlog.Printf2("fs/fs", "fs.Close")
 
-	// this will kill the underlying goroutine and ensure it has flushed
-	ch := make(chan struct{})
-	self.closing <- ch
-	<-ch
+	self.stopEvictor()
+	self.stop()
 
 	// then we can close storage (which will close backend)
 	self.storage.Close()
@@ -63,9 +69,18 @@ func (self *Fs) Close() {
 	mlog.Printf2("fs/fs", " great success at closing Fs")
 }
 
+// stop kills the underlying goroutine and ensures it has flushed.
+func (self *Fs) stop() {
+	ch := make(chan struct{})
+	self.closing <- ch
+	<-ch
+}
+
 func (self *Fs) Flush() {
 	mlog.Printf2("fs/fs", "fs.Flush started")
-	self.Hugger.Flush()
+	if !self.readOnly {
+		self.Hugger.Flush()
+	}
 	self.storage.Flush()
 	mlog.Printf2("fs/fs", " done with fs.Flush")
 }
@@ -112,8 +127,24 @@ func iterateNodeReferences(nd *ibtree.NodeData, cb storage.BlockReferenceCallbac
 	}
 }
 
+// IterateBlockReferences calls cb for every block referred to by
+// the (plaintext) data of block. It does not need a Fs, and is
+// therefore usable also offline (e.g. by Recodec).
+func IterateBlockReferences(id string, data []byte, cb storage.BlockReferenceCallback) {
+	nd := BytesToNodeData(data)
+	if nd != nil {
+		iterateNodeReferences(nd, cb)
+	}
+}
+
 func NewFs(st *storage.Storage, RootName string, cacheSize int) *Fs {
-	fs := &Fs{storage: st}
+	return newFs(st, RootName, cacheSize, false)
+}
+
+// newFs returns new Fs; if it is readOnly, and the root does not
+// exist, nil is returned.
+func newFs(st *storage.Storage, RootName string, cacheSize int, readOnly bool) *Fs {
+	fs := &Fs{storage: st, readOnly: readOnly}
 	fs.RootName = RootName
 	fs.Hugger.Storage = st
 	fs.Hugger.IterateReferencesCallback = iterateNodeReferences
@@ -131,6 +162,9 @@ func NewFs(st *storage.Storage, RootName string, cacheSize int) *Fs {
 		fs.iterateReferencesCallback(id, data, cb)
 	}
 	if fs.RootIsNew() {
+		if readOnly {
+			return nil
+		}
 		// getInode succeeds always; Get does not
 		defer fs.inodeLock.Locked()()
 		root := fs.getInode(fuse.FUSE_ROOT_ID)
@@ -82,3 +82,20 @@ type InodeMeta struct {
 // Eventually can stick fs-data in here
 // notably: stuff for statfs?
 //}
+
+// Snapshot is named read-only copy of the filesystem root (see
+// Fs.CreateSnapshot).
+type Snapshot struct {
+	Name string `zid:"0"`
+
+	// RootId is the id of the root block of the snapshot
+	RootId string `zid:"1"`
+
+	// Time is the creation time of the snapshot (in Unix
+	// nanoseconds)
+	Time int64 `zid:"2"`
+}
+
+type SnapshotList struct {
+	Snapshots []Snapshot `zid:"0"`
+}
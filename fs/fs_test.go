@@ -4,20 +4,23 @@
  * Copyright (c) 2017 Markus Stenberg
  *
  * Created:       Thu Dec 28 14:31:48 2017 mstenber
- * Last modified: Tue Mar 13 12:40:05 2018 mstenber
- * Edit time:     44 min
+ * Last modified: Thu Apr 12 11:52:26 2018 mstenber
+ * Edit time:     52 min
  *
  */
 
 package fs
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"testing"
 
+	"github.com/fingon/go-tfhfs/pb"
 	"github.com/fingon/go-tfhfs/storage"
 	"github.com/fingon/go-tfhfs/storage/factory"
 	"github.com/stvp/assert"
@@ -149,3 +152,258 @@ func BenchmarkBadgerFs(b *testing.B) {
 	})
 
 }
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	RootName := "toor"
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, RootName, 0)
+	defer fs.closeWithoutTransactions()
+
+	u := NewFSUser(fs)
+	assert.Nil(t, u.Mkdir("/a", 0777))
+	assert.Nil(t, fs.CreateSnapshot("s1"))
+	assert.Equal(t, fs.CreateSnapshot("s1"), ErrSnapshotExists)
+	assert.Nil(t, u.Mkdir("/b", 0777))
+	snapshots := fs.Snapshots()
+	assert.Equal(t, len(snapshots), 1)
+	assert.Equal(t, snapshots[0].Name, "s1")
+
+	sfs, err := NewSnapshotFs(st, RootName, "s1", 0)
+	assert.Nil(t, err)
+	su := NewFSUser(sfs)
+	_, err = su.Stat("/a")
+	assert.Nil(t, err)
+	_, err = su.Stat("/b")
+	assert.NotNil(t, err)
+	assert.NotNil(t, su.Mkdir("/c", 0777))
+	assert.NotNil(t, su.Remove("/a"))
+	assert.Equal(t, sfs.CreateSnapshot("s2"), ErrReadOnly)
+	sfs.stop()
+
+	// Snapshot is not affected by changes to the root
+	assert.Nil(t, u.Remove("/a"))
+	fs.Flush()
+	sfs, err = NewSnapshotFs(st, RootName, "s1", 0)
+	assert.Nil(t, err)
+	_, err = NewFSUser(sfs).Stat("/a")
+	assert.Nil(t, err)
+	sfs.stop()
+
+	assert.Nil(t, fs.DeleteSnapshot("s1"))
+	assert.Equal(t, fs.DeleteSnapshot("s1"), ErrNoSnapshot)
+	assert.Equal(t, len(fs.Snapshots()), 0)
+	_, err = NewSnapshotFs(st, RootName, "s1", 0)
+	assert.Equal(t, err, ErrNoSnapshot)
+}
+
+func TestSendReceive(t *testing.T) {
+	t.Parallel()
+
+	RootName := "toor"
+	st := storage.Storage{Backend: factory.New("inmemory", "")}.Init()
+	fs := NewFs(st, RootName, 0)
+	defer fs.closeWithoutTransactions()
+
+	u := NewFSUser(fs)
+	f, err := u.OpenFile("/a", uint32(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), 0666)
+	assert.Nil(t, err)
+	data := make([]byte, 200000)
+	rand.Read(data)
+	_, err = f.Write(data)
+	assert.Nil(t, err)
+	f.Close()
+	assert.Nil(t, fs.CreateSnapshot("s1"))
+	assert.Nil(t, u.Mkdir("/b", 0777))
+	assert.Nil(t, fs.CreateSnapshot("s2"))
+
+	s1 := SnapshotRootName(RootName, "s1")
+	s2 := SnapshotRootName(RootName, "s2")
+	var full, incr bytes.Buffer
+	assert.Nil(t, fs.Send(&full, s1, "", nil))
+	assert.Nil(t, fs.Send(&incr, s2, s1, nil))
+	assert.True(t, incr.Len() < full.Len()/10)
+
+	st2 := storage.Storage{Backend: factory.New("inmemory", "")}.Init()
+	st2.IterateReferencesCallback = IterateBlockReferences
+
+	// Incremental stream needs the base
+	_, err = st2.ReceiveStream(bytes.NewReader(incr.Bytes()), "")
+	assert.NotNil(t, err)
+
+	// Truncated stream does not set the name
+	_, err = st2.ReceiveStream(bytes.NewReader(full.Bytes()[:full.Len()-10]), "")
+	assert.Equal(t, err, storage.ErrIncompleteStream)
+	assert.Equal(t, st2.GetBlockIdByName(s1), "")
+
+	_, err = st2.ReceiveStream(&full, "")
+	assert.Nil(t, err)
+	_, err = st2.ReceiveStream(&incr, "")
+	assert.Nil(t, err)
+
+	sfs, err := NewSnapshotFs(st2, RootName, "s2", 0)
+	assert.Nil(t, err)
+	defer sfs.Close()
+	su := NewFSUser(sfs)
+	_, err = su.Stat("/b")
+	assert.Nil(t, err)
+	f, err = su.OpenFile("/a", uint32(os.O_RDONLY), 0)
+	assert.Nil(t, err)
+	rdata := make([]byte, 0, len(data))
+	for len(rdata) < len(data) {
+		n, err := f.Read(rdata[len(rdata):cap(rdata)])
+		assert.Nil(t, err)
+		assert.True(t, n > 0)
+		rdata = rdata[:len(rdata)+n]
+	}
+	assert.True(t, bytes.Equal(rdata, data))
+	f.Close()
+}
+
+func TestSendMissing(t *testing.T) {
+	t.Parallel()
+
+	RootName := "toor"
+	st := storage.Storage{Backend: factory.New("inmemory", "")}.Init()
+	fs := NewFs(st, RootName, 0)
+	defer fs.closeWithoutTransactions()
+
+	u := NewFSUser(fs)
+	f, err := u.OpenFile("/a", uint32(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), 0666)
+	assert.Nil(t, err)
+	data := make([]byte, 200000)
+	rand.Read(data)
+	_, err = f.Write(data)
+	assert.Nil(t, err)
+	f.Close()
+	assert.Nil(t, fs.CreateSnapshot("s1"))
+	fs.Flush()
+
+	// Without replica peer, evicted extents cannot be sent
+	assert.True(t, fs.EvictColdExtents(0) > 0)
+	var stream bytes.Buffer
+	err = fs.Send(&stream, SnapshotRootName(RootName, "s1"), "", nil)
+	assert.NotNil(t, err)
+}
+
+func TestSendReceiveNewStore(t *testing.T) {
+	t.Parallel()
+
+	RootName := "toor"
+	dir, _ := ioutil.TempDir("", "sendnew")
+	defer os.RemoveAll(dir)
+	config := func(name, backend, password string) factory.CryptoStorageConfiguration {
+		beconf := storage.BackendConfiguration{Directory: fmt.Sprintf("%s/%s", dir, name)}
+		return factory.CryptoStorageConfiguration{BackendConfiguration: beconf,
+			BackendName: backend, Password: password}
+	}
+
+	// Backend which encodes the blocks itself sends as well
+	sconfig := config("send", "tree", "pw")
+	fs := NewFs(factory.NewCryptoStorage(sconfig), RootName, 0)
+	u := NewFSUser(fs)
+	assert.Nil(t, u.Mkdir("/a", 0777))
+	assert.Nil(t, fs.CreateSnapshot("s1"))
+	header, err := sconfig.EncodedHeader()
+	assert.Nil(t, err)
+	assert.True(t, header != nil)
+	s1 := SnapshotRootName(RootName, "s1")
+	var stream bytes.Buffer
+	assert.Nil(t, fs.Send(&stream, s1, "", header))
+	fs.closeWithoutTransactions()
+
+	sr, err := storage.NewStreamReader(bytes.NewReader(stream.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, config("wrong", "bolt", "x").ImportHeader(sr.Header.StoreHeader), factory.ErrWrongPassword)
+
+	// New storage gets the data key of the sender from the stream
+	rconfig := config("receive", "bolt", "pw")
+	assert.Nil(t, rconfig.ImportHeader(sr.Header.StoreHeader))
+	assert.Equal(t, rconfig.ImportHeader(sr.Header.StoreHeader), factory.ErrNotNewStore)
+	st := factory.NewCryptoStorage(rconfig)
+	st.IterateReferencesCallback = IterateBlockReferences
+	_, err = st.Receive(sr, "")
+	assert.Nil(t, err)
+
+	sfs, err := NewSnapshotFs(st, RootName, "s1", 0)
+	assert.Nil(t, err)
+	defer sfs.Close()
+	_, err = NewFSUser(sfs).Stat("/a")
+	assert.Nil(t, err)
+}
+
+type replicaPeer struct {
+	pb.Fs
+	data map[string][]byte
+}
+
+func (self *replicaPeer) GetBlockById(ctx context.Context, req *pb.GetBlockRequest) (*pb.Block, error) {
+	data, ok := self.data[req.Id]
+	if !ok {
+		return &pb.Block{}, nil
+	}
+	return &pb.Block{Id: req.Id, Data: string(data)}, nil
+}
+
+func TestReplica(t *testing.T) {
+	t.Parallel()
+
+	st := storage.Storage{Backend: factory.New("inmemory", "")}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+
+	u := NewFSUser(fs)
+	write := func(name string) []byte {
+		f, err := u.OpenFile(name, uint32(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), 0666)
+		assert.Nil(t, err)
+		data := make([]byte, 200000)
+		rand.Read(data)
+		_, err = f.Write(data)
+		assert.Nil(t, err)
+		f.Close()
+		return data
+	}
+	read := func(name string, data []byte) error {
+		f, err := u.OpenFile(name, uint32(os.O_RDONLY), 0)
+		assert.Nil(t, err)
+		defer f.Close()
+		rdata := make([]byte, 0, len(data))
+		for len(rdata) < len(data) {
+			n, err := f.Read(rdata[len(rdata):cap(rdata)])
+			if err != nil {
+				return err
+			}
+			rdata = rdata[:len(rdata)+n]
+		}
+		assert.True(t, bytes.Equal(rdata, data))
+		return nil
+	}
+	adata := write("/a")
+	bdata := write("/b")
+	assert.Nil(t, u.SetXAttr("/b", PinXAttr, []byte("1")))
+	fs.Flush()
+
+	// The peer has everything
+	peer := &replicaPeer{data: make(map[string][]byte)}
+	st.Backend.IterateBlocks(func(b *storage.Block) {
+		peer.data[b.Id] = st.Backend.GetBlockData(b)
+	})
+
+	assert.True(t, fs.EvictColdExtents(0) > 0)
+	assert.Equal(t, fs.EvictColdExtents(0), 0)
+
+	// Evicted data needs the peer; pinned data is still there
+	assert.NotNil(t, read("/a", adata))
+	assert.Nil(t, read("/b", bdata))
+	st.ReplicaPeer = peer
+	assert.Nil(t, read("/a", adata))
+
+	// Pinning fetches the data
+	assert.True(t, fs.EvictColdExtents(0) > 0)
+	assert.Nil(t, u.SetXAttr("/a", PinXAttr, []byte("1")))
+	st.ReplicaPeer = nil
+	assert.Nil(t, read("/a", adata))
+	assert.Equal(t, fs.EvictColdExtents(0), 0)
+}
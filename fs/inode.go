@@ -276,6 +276,9 @@ func (self *inode) SetXAttr(attr string, data []byte) (code fuse.Status) {
 		mlog.Printf2("fs/inode", "SetXAttr %s - setting %x", attr, k)
 		tr.IB().Set(k.IB(), string(data))
 	})
+	if attr == PinXAttr {
+		return self.fetchExtents()
+	}
 	return fuse.OK
 }
 
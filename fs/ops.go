@@ -49,15 +49,14 @@ func (self *fsOps) SetDebug(dbg bool) {
 }
 
 func (self *fsOps) StatFs(input *InHeader, out *StatfsOut) Status {
+	defer self.fs.opStatistics.track("StatFs")()
 	bsize := uint64(blockSize)
 	out.Bsize = uint32(bsize)
 	out.Frsize = uint32(bsize)
-	avail := self.fs.storage.Backend.GetBytesAvailable() / bsize
+	avail := self.fs.storage.BytesAvailable() / bsize
 	out.Bfree = avail
 	out.Bavail = avail
-	used := self.fs.storage.Backend.GetBytesUsed() / bsize
-	total := used + avail
-	out.Blocks = total
+	out.Blocks = self.fs.storage.BytesTotal() / bsize
 	return OK
 }
 
@@ -125,6 +124,7 @@ func (self *fsOps) lookup(parent *inode, name string, ctx *Context) (child *inod
 }
 
 func (self *fsOps) Lookup(input *InHeader, name string, out *EntryOut) (code Status) {
+	defer self.fs.opStatistics.track("Lookup")()
 	parent := self.fs.GetInode(input.NodeId)
 	defer parent.Release()
 
@@ -142,10 +142,12 @@ func (self *fsOps) Lookup(input *InHeader, name string, out *EntryOut) (code Sta
 }
 
 func (self *fsOps) Forget(nodeID, nlookup uint64) {
+	defer self.fs.opStatistics.track("Forget")()
 	self.fs.GetInode(nodeID).Forget(nlookup)
 }
 
 func (self *fsOps) GetAttr(input *GetAttrIn, out *AttrOut) (code Status) {
+	defer self.fs.opStatistics.track("GetAttr")()
 	inode := self.fs.GetInode(input.NodeId)
 	if inode == nil {
 		return ENOENT
@@ -161,6 +163,10 @@ func (self *fsOps) GetAttr(input *GetAttrIn, out *AttrOut) (code Status) {
 }
 
 func (self *fsOps) SetAttr(input *SetAttrIn, out *AttrOut) (code Status) {
+	defer self.fs.opStatistics.track("SetAttr")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	mlog.Printf2("fs/ops", "SetAttr")
 	inode := self.fs.GetInode(input.NodeId)
 	if inode == nil {
@@ -294,14 +300,17 @@ func (self *fsOps) SetAttr(input *SetAttrIn, out *AttrOut) (code Status) {
 }
 
 func (self *fsOps) Release(input *ReleaseIn) {
+	defer self.fs.opStatistics.track("Release")()
 	self.fs.GetFileByFh(input.Fh).Release()
 }
 
 func (self *fsOps) ReleaseDir(input *ReleaseIn) {
+	defer self.fs.opStatistics.track("ReleaseDir")()
 	self.fs.GetFileByFh(input.Fh).Release()
 }
 
 func (self *fsOps) OpenDir(input *OpenIn, out *OpenOut) (code Status) {
+	defer self.fs.opStatistics.track("OpenDir")()
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
@@ -319,6 +328,7 @@ func (self *fsOps) OpenDir(input *OpenIn, out *OpenOut) (code Status) {
 }
 
 func (self *fsOps) Open(input *OpenIn, out *OpenOut) (code Status) {
+	defer self.fs.opStatistics.track("Open")()
 	inode := self.fs.GetInode(input.NodeId)
 	mlog.Printf2("fs/ops", "ops.Open %v", input.NodeId)
 	defer inode.Release()
@@ -335,6 +345,14 @@ func (self *fsOps) Open(input *OpenIn, out *OpenOut) (code Status) {
 		return
 	}
 
+	if self.fs.readOnly {
+		if mode&W_OK != 0 || input.Flags&uint32(os.O_TRUNC) != 0 {
+			return EROFS
+		}
+		out.Fh = inode.GetFile(input.Flags).fh
+		return OK
+	}
+
 	self.fs.Update(func(tr *hugger.Transaction) {
 		meta := inode.Meta()
 		// No ATime for now
@@ -353,6 +371,7 @@ func (self *fsOps) Open(input *OpenIn, out *OpenOut) (code Status) {
 }
 
 func (self *fsOps) ReadDir(input *ReadIn, l *DirEntryList) Status {
+	defer self.fs.opStatistics.track("ReadDir")()
 	dir := self.fs.GetFileByFh(input.Fh)
 	dir.SetPos(input.Offset)
 	for dir.ReadDirEntry(l) {
@@ -361,6 +380,7 @@ func (self *fsOps) ReadDir(input *ReadIn, l *DirEntryList) Status {
 }
 
 func (self *fsOps) ReadDirPlus(input *ReadIn, l *DirEntryList) Status {
+	defer self.fs.opStatistics.track("ReadDirPlus")()
 	dir := self.fs.GetFileByFh(input.Fh)
 	dir.SetPos(input.Offset)
 	for dir.ReadDirPlus(input, l) {
@@ -369,6 +389,7 @@ func (self *fsOps) ReadDirPlus(input *ReadIn, l *DirEntryList) Status {
 }
 
 func (self *fsOps) Readlink(input *InHeader) (out []byte, code Status) {
+	defer self.fs.opStatistics.track("Readlink")()
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
@@ -426,6 +447,13 @@ func (self *fsOps) create(input *InHeader, name string, meta *InodeMeta, allowRe
 }
 
 func (self *fsOps) Mkdir(input *MkdirIn, name string, out *EntryOut) (code Status) {
+	defer self.fs.opStatistics.track("Mkdir")()
+	if self.fs.readOnly {
+		return EROFS
+	}
+	if !self.fs.storage.HasSpace(createSpace) {
+		return Status(syscall.ENOSPC)
+	}
 	var meta InodeMeta
 	meta.SetMkdirIn(input)
 	child, code := self.create(&input.InHeader, name, &meta, false)
@@ -517,6 +545,10 @@ func (self *fsOps) unlink(input *InHeader, name string, isdir *bool) (code Statu
 }
 
 func (self *fsOps) Unlink(input *InHeader, name string) (code Status) {
+	defer self.fs.opStatistics.track("Unlink")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	mlog.Printf2("fs/ops", "ops.Unlink %s", name)
 	b := false
 	bp := &b
@@ -527,6 +559,10 @@ func (self *fsOps) Unlink(input *InHeader, name string) (code Status) {
 }
 
 func (self *fsOps) Rmdir(input *InHeader, name string) (code Status) {
+	defer self.fs.opStatistics.track("Rmdir")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	mlog.Printf2("fs/ops", "ops.Rmdir %s", name)
 	b := true
 	if name == ".." {
@@ -536,6 +572,7 @@ func (self *fsOps) Rmdir(input *InHeader, name string) (code Status) {
 }
 
 func (self *fsOps) GetXAttrSize(input *InHeader, attr string) (size int, code Status) {
+	defer self.fs.opStatistics.track("GetXAttrSize")()
 	b, code := self.GetXAttrData(input, attr)
 	if !code.Ok() {
 		return
@@ -544,6 +581,7 @@ func (self *fsOps) GetXAttrSize(input *InHeader, attr string) (size int, code St
 }
 
 func (self *fsOps) GetXAttrData(input *InHeader, attr string) (data []byte, code Status) {
+	defer self.fs.opStatistics.track("GetXAttrData")()
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
@@ -556,6 +594,10 @@ func (self *fsOps) GetXAttrData(input *InHeader, attr string) (data []byte, code
 }
 
 func (self *fsOps) SetXAttr(input *SetXAttrIn, attr string, data []byte) (code Status) {
+	defer self.fs.opStatistics.track("SetXAttr")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
@@ -568,6 +610,7 @@ func (self *fsOps) SetXAttr(input *SetXAttrIn, attr string, data []byte) (code S
 }
 
 func (self *fsOps) ListXAttr(input *InHeader) (data []byte, code Status) {
+	defer self.fs.opStatistics.track("ListXAttr")()
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
@@ -590,6 +633,10 @@ func (self *fsOps) ListXAttr(input *InHeader) (data []byte, code Status) {
 }
 
 func (self *fsOps) RemoveXAttr(input *InHeader, attr string) (code Status) {
+	defer self.fs.opStatistics.track("RemoveXAttr")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
@@ -601,6 +648,10 @@ func (self *fsOps) RemoveXAttr(input *InHeader, attr string) (code Status) {
 }
 
 func (self *fsOps) Rename(input *RenameIn, oldName string, newName string) (code Status) {
+	defer self.fs.opStatistics.track("Rename")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	mlog.Printf2("fs/ops", "Rename")
 
 	if input.NodeId == input.Newdir && oldName == newName {
@@ -699,6 +750,10 @@ func (self *fsOps) linkInInode(inode, child *inode, name string, override bool,
 }
 
 func (self *fsOps) Link(input *LinkIn, name string, out *EntryOut) (code Status) {
+	defer self.fs.opStatistics.track("Link")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	mlog.Printf2("fs/ops", "Link")
 	inode := self.fs.GetInode(input.NodeId)
 	if inode == nil {
@@ -724,6 +779,7 @@ func (self *fsOps) Link(input *LinkIn, name string, out *EntryOut) (code Status)
 }
 
 func (self *fsOps) Access(input *AccessIn) (code Status) {
+	defer self.fs.opStatistics.track("Access")()
 	if useKernelPermissions {
 		return ENOSYS
 	}
@@ -733,6 +789,7 @@ func (self *fsOps) Access(input *AccessIn) (code Status) {
 }
 
 func (self *fsOps) Read(input *ReadIn, buf []byte) (ReadResult, Status) {
+	defer self.fs.opStatistics.track("Read")()
 	// Check perm?
 	// NOTE: This has to return len(data), less if EOF, or
 	// error. (unlike e.g. C API)
@@ -741,14 +798,28 @@ func (self *fsOps) Read(input *ReadIn, buf []byte) (ReadResult, Status) {
 }
 
 func (self *fsOps) Write(input *WriteIn, data []byte) (written uint32, code Status) {
+	defer self.fs.opStatistics.track("Write")()
+	if self.fs.readOnly {
+		return 0, EROFS
+	}
 	// Check perm?
 	// NOTE: This has to return len(data) or error. (unlike e.g. C API)
+	if !self.fs.storage.HasSpace(len(data)) {
+		return 0, Status(syscall.ENOSPC)
+	}
 	file := self.fs.GetFileByFh(input.Fh)
 	return file.Write(data, input.Offset)
 }
 
 func (self *fsOps) Create(input *CreateIn, name string, out *CreateOut) (code Status) {
+	defer self.fs.opStatistics.track("Create")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	mlog.Printf2("fs/ops", "ops.Create %s", name)
+	if !self.fs.storage.HasSpace(createSpace) {
+		return Status(syscall.ENOSPC)
+	}
 	// first create file
 	var meta InodeMeta
 	meta.SetCreateIn(input)
@@ -772,6 +843,10 @@ func (self *fsOps) Create(input *CreateIn, name string, out *CreateOut) (code St
 }
 
 func (self *fsOps) Mknod(input *MknodIn, name string, out *EntryOut) (code Status) {
+	defer self.fs.opStatistics.track("Mknod")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	var meta InodeMeta
 	meta.SetMknodIn(input)
 	child, code := self.create(&input.InHeader, name, &meta, false)
@@ -784,6 +859,10 @@ func (self *fsOps) Mknod(input *MknodIn, name string, out *EntryOut) (code Statu
 }
 
 func (self *fsOps) Symlink(input *InHeader, pointedTo string, linkName string, out *EntryOut) (code Status) {
+	defer self.fs.opStatistics.track("Symlink")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	meta := InodeMeta{InodeMetaData: InodeMetaData{StUid: input.Uid,
 		StGid:  input.Gid,
 		StMode: S_IFLNK | 0777,
@@ -800,36 +879,59 @@ func (self *fsOps) Symlink(input *InHeader, pointedTo string, linkName string, o
 }
 
 func (self *fsOps) Fsync(input *FsyncIn) (code Status) {
+	defer self.fs.opStatistics.track("Fsync")()
+	if self.fs.readOnly {
+		return OK
+	}
 	// After this call, everything up to this point has been
 	// committed to disk. Expensive, and potentially time
 	// consuming, but life is.
 	self.fs.WithoutParallelWrites(
 		func() {
 		})
-	// Then, we ensure that the storage has actually flushed
-	// things (this is somewhat expensive, should think if this is
-	// really sane way to handle this)
-	self.fs.storage.Flush()
+	// The current root has to be in the storage
+	self.fs.Hugger.Flush()
+	// Then, we ensure that the storage has actually persisted
+	// things; if there is intent log, syncing it is enough.
+	// Otherwise full flush is needed (this is somewhat
+	// expensive, should think if this is really sane way to
+	// handle this)
+	if !self.fs.storage.SyncIntentLog() {
+		self.fs.storage.Flush()
+		if self.fs.storage.IsOutOfSpace() {
+			return Status(syscall.ENOSPC)
+		}
+	}
+	if file := self.fs.GetFileByFh(input.Fh); file != nil {
+		return file.WriteStatus()
+	}
 	return OK
 }
 
 func (self *fsOps) FsyncDir(input *FsyncIn) (code Status) {
+	defer self.fs.opStatistics.track("FsyncDir")()
 	self.Fsync(nil)
 	return OK
 }
 
 func (self *fsOps) Flush(input *FlushIn) Status {
+	defer self.fs.opStatistics.track("Flush")()
 	// TBD - needed only if we implement locking support someday
 	return ENOSYS
 }
 
 func (self *fsOps) Flock(input *FlockIn, flags int) Status {
+	defer self.fs.opStatistics.track("Flock")()
 	// TBD - not sure if locking across this is really realistic
 	// as we assume synchronization is going to occur only rarely
 	return ENOSYS
 }
 
 func (self *fsOps) Fallocate(in *FallocateIn) (code Status) {
+	defer self.fs.opStatistics.track("Fallocate")()
+	if self.fs.readOnly {
+		return EROFS
+	}
 	// TBD - we have rather loose definition of space :p
 	return ENOSYS
 }
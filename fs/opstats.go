@@ -0,0 +1,64 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Thu Apr  5 10:45:02 2018 mstenber
+ * Last modified: Thu Apr  5 11:20:17 2018 mstenber
+ * Edit time:     21 min
+ *
+ */
+
+package fs
+
+import (
+	"time"
+
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// Latency buckets of FUSE operations (in nanoseconds); 10us .. 10s
+var opLatencyBounds = []int64{1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10}
+
+// opStatistics tracks the number and latency of FUSE operations.
+type opStatistics struct {
+	lock util.MutexLocked
+	ops  map[string]*util.Histogram
+}
+
+func (self *opStatistics) get(op string) *util.Histogram {
+	defer self.lock.Locked()()
+	if self.ops == nil {
+		self.ops = make(map[string]*util.Histogram)
+	}
+	h, ok := self.ops[op]
+	if !ok {
+		h = util.NewHistogram(opLatencyBounds...)
+		self.ops[op] = h
+	}
+	return h
+}
+
+// track should be called at the start of an operation, and the
+// returned function at the end of it.
+func (self *opStatistics) track(op string) func() {
+	h := self.get(op)
+	start := time.Now()
+	return func() {
+		h.Observe(int64(time.Since(start)))
+	}
+}
+
+// IterateOpStatistics calls cb with the latency (in nanoseconds)
+// histogram of every FUSE operation seen so far.
+func (self *Fs) IterateOpStatistics(cb func(op string, h *util.Histogram)) {
+	ops := make(map[string]*util.Histogram)
+	self.opStatistics.lock.Lock()
+	for k, v := range self.opStatistics.ops {
+		ops[k] = v
+	}
+	self.opStatistics.lock.Unlock()
+	for k, v := range ops {
+		cb(k, v)
+	}
+}
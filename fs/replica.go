@@ -0,0 +1,213 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Wed Apr 18 12:40:03 2018 mstenber
+ * Last modified: Wed Apr 18 15:12:27 2018 mstenber
+ * Edit time:     95 min
+ *
+ */
+
+package fs
+
+import (
+	"sort"
+	"time"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Partial replicas keep all of the metadata, but only some of the
+// file extents; the rest have BS_MISSING status in the storage, and
+// are fetched from storage.ReplicaPeer when they are accessed. The
+// evictor turns the least recently read extents back to BS_MISSING
+// whenever the storage uses more than its budget.
+
+// PinXAttr is the extended attribute that pins a file to the
+// replica; its missing extents are fetched when the attribute is
+// set, and they are never evicted.
+const PinXAttr = "user.tfhfs.pin"
+
+// evictInterval is how often the evictor checks the budget
+const evictInterval = time.Minute
+
+type evictor struct {
+	budget     uint64
+	quit, done chan struct{}
+
+	// access contains the time each extent was last read
+	access     map[string]time.Time
+	accessLock util.MutexLocked
+}
+
+// StartEvictor starts the background evictor, which keeps the bytes
+// used by the storage below budget.
+func (self *Fs) StartEvictor(budget uint64) {
+	ev := &self.evictor
+	ev.budget = budget
+	ev.access = make(map[string]time.Time)
+	ev.quit = make(chan struct{})
+	ev.done = make(chan struct{})
+	go func() { // ok, singleton per fs
+		defer close(ev.done)
+		ticker := time.NewTicker(evictInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ev.quit:
+				return
+			case <-ticker.C:
+				self.EvictColdExtents(ev.budget)
+			}
+		}
+	}()
+}
+
+func (self *Fs) stopEvictor() {
+	ev := &self.evictor
+	if ev.quit == nil {
+		return
+	}
+	close(ev.quit)
+	<-ev.done
+}
+
+// touchExtent notes that the extent was read.
+func (self *Fs) touchExtent(id string) {
+	ev := &self.evictor
+	defer ev.accessLock.Locked()()
+	if ev.access != nil {
+		ev.access[id] = time.Now()
+	}
+}
+
+// EvictColdExtents evicts (see storage.EvictBlock) extents of files
+// that are not pinned, least recently read first, until the storage
+// uses at most budget bytes. The return value is the number of
+// extents evicted.
+func (self *Fs) EvictColdExtents(budget uint64) (n int) {
+	used := self.storage.BytesUsed()
+	if used <= budget {
+		return
+	}
+	mlog.Printf2("fs/replica", "fs.EvictColdExtents %d > %d", used, budget)
+	excess := used - budget
+
+	// Keys of an inode are in subtype order, so its pin
+	// (BST_XATTR) is seen before its extents
+	pinned := make(map[string]bool)
+	extents := make(map[string]bool)
+	var pinnedIno uint64
+	tr := self.GetTransaction()
+	k := ibtree.Key("")
+	for {
+		kp := tr.IB().NextKey(k)
+		if kp == nil {
+			break
+		}
+		k = *kp
+		bk := BlockKey(k)
+		switch bk.SubType() {
+		case BST_XATTR:
+			if bk.SubTypeData() == PinXAttr {
+				pinnedIno = bk.Ino()
+			}
+		case BST_FILE_OFFSET2EXTENT:
+			id := *tr.IB().Get(k)
+			if bk.Ino() == pinnedIno {
+				pinned[id] = true
+			} else {
+				extents[id] = true
+			}
+		}
+	}
+	tr.Close()
+
+	type coldExtent struct {
+		id     string
+		access time.Time
+	}
+	ev := &self.evictor
+	cold := make([]coldExtent, 0, len(extents))
+	ev.accessLock.Lock()
+	for id, _ := range extents {
+		if !pinned[id] {
+			cold = append(cold, coldExtent{id, ev.access[id]})
+		}
+	}
+	ev.accessLock.Unlock()
+	sort.Slice(cold, func(i, j int) bool {
+		return cold[i].access.Before(cold[j].access)
+	})
+
+	var freed uint64
+	for _, e := range cold {
+		if freed >= excess {
+			break
+		}
+		if size := self.storage.EvictBlock(e.id); size > 0 {
+			freed += uint64(size)
+			n++
+		}
+	}
+	mlog.Printf2("fs/replica", " evicted %d extents (%d bytes)", n, freed)
+	return
+}
+
+// fetchExtent ensures the extent at offset (if any) is available
+// locally. The extent block is returned open, so that the evictor
+// leaves it alone until the caller closes it.
+func (self *inodeFH) fetchExtent(tr *hugger.Transaction, offset uint64) (bl *storage.StorageBlock, code fuse.Status) {
+	code = fuse.OK
+	k := NewBlockKeyOffset(self.inode.ino, offset)
+	bidp := tr.IB().Get(k.IB())
+	if bidp == nil {
+		mlog.Printf2("fs/replica", "Key %x not found at all", k)
+		return
+	}
+	self.Fs().touchExtent(*bidp)
+	st := self.Fs().storage
+	bl = st.GetBlockById(*bidp)
+	if bl == nil {
+		mlog.Panicf("Block %x not found at all", *bidp)
+	}
+	if bl.Status() == storage.BS_MISSING {
+		if !st.FetchBlock(*bidp) || bl.Status() == storage.BS_MISSING {
+			mlog.Printf2("fs/replica", "extent %x not available", *bidp)
+			bl.Close()
+			return nil, fuse.EIO
+		}
+	}
+	return
+}
+
+// fetchExtents fetches all missing extents of the inode.
+func (self *inode) fetchExtents() fuse.Status {
+	ids := make([]string, 0)
+	tr := self.Fs().GetTransaction()
+	IterateInoSubTypeKeys(tr.IB(), self.ino, BST_FILE_OFFSET2EXTENT,
+		func(key BlockKey) bool {
+			ids = append(ids, *tr.IB().Get(key.IB()))
+			return true
+		})
+	tr.Close()
+	st := self.Fs().storage
+	for _, id := range ids {
+		bl := st.GetBlockById(id)
+		if bl == nil {
+			continue
+		}
+		missing := bl.Status() == storage.BS_MISSING
+		bl.Close()
+		if missing && !st.FetchBlock(id) {
+			return fuse.EIO
+		}
+	}
+	return fuse.OK
+}
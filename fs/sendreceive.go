@@ -0,0 +1,89 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Thu Apr 12 10:31:07 2018 mstenber
+ * Last modified: Thu Apr 12 11:34:51 2018 mstenber
+ * Edit time:     52 min
+ *
+ */
+
+package fs
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+)
+
+// Send writes stream (see storage.NewStreamWriter) of the blocks
+// reachable from the named root to w. If base is given, the blocks
+// reachable from it are omitted, and the receiver has to have it
+// already. storeHeader (if any) is passed in the stream header
+// to the receiver (see storage.StreamHeader).
+func (self *Fs) Send(w io.Writer, name, base string, storeHeader []byte) error {
+	mlog.Printf2("fs/sendreceive", "fs.Send %s base %s", name, base)
+	self.Flush()
+	root, rootId, ok := self.LoadNodeByName(name)
+	if !ok {
+		return fmt.Errorf("no root named %s", name)
+	}
+	header := storage.StreamHeader{Name: name, RootId: rootId,
+		StoreHeader: storeHeader}
+	baseRoot := self.NewRootNode()
+	if base != "" {
+		baseRoot, header.BaseId, ok = self.LoadNodeByName(base)
+		if !ok {
+			return fmt.Errorf("no root named %s", base)
+		}
+	}
+	sw, err := self.storage.NewStreamWriter(w, header)
+	if err != nil {
+		return err
+	}
+
+	// Subtrees that are in base are not visited at all (nodes with
+	// same id have same subtree), so the walk only covers the
+	// changed part of the tree. The blocks the changed leaves
+	// refer to go first, as the nodes refer to them, and then
+	// the nodes, children first.
+	sent := make(map[string]bool)
+	ids := make([]string, 0)
+	nodeIds := make([]string, 0)
+	if rootId != header.BaseId {
+		nodeIds = append(nodeIds, rootId)
+	}
+	root.IterateDeltaNodes(baseRoot, func(old, new *ibtree.NodeDataChild) {
+		if new == nil {
+			return
+		}
+		nd := &ibtree.NodeData{Leafy: true,
+			Children: []*ibtree.NodeDataChild{new}}
+		iterateNodeReferences(nd, func(id string) {
+			if !sent[id] {
+				sent[id] = true
+				ids = append(ids, id)
+			}
+		})
+	}, func(c *ibtree.NodeDataChild) {
+		nodeIds = append(nodeIds, c.Value)
+	})
+	for i := len(nodeIds) - 1; i >= 0; i-- {
+		id := nodeIds[i]
+		if !sent[id] {
+			sent[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		err = sw.WriteBlock(id)
+		if err != nil {
+			return err
+		}
+	}
+	return sw.Close()
+}
@@ -0,0 +1,143 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Wed Apr 11 09:20:13 2018 mstenber
+ * Last modified: Wed Apr 11 11:47:30 2018 mstenber
+ * Edit time:     87 min
+ *
+ */
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+)
+
+// Snapshots are just names pointing at (immutable) root blocks, so
+// they are cheap. The list of snapshots of a root (with their
+// timestamps) is kept in a separate block, which is updated
+// atomically together with the snapshot names.
+
+var ErrSnapshotExists = errors.New("snapshot already exists")
+var ErrNoSnapshot = errors.New("no such snapshot")
+var ErrReadOnly = errors.New("read-only filesystem")
+
+// SnapshotRootName returns the storage name of the root of the
+// snapshot of the named root.
+func SnapshotRootName(rootName, snapshot string) string {
+	return fmt.Sprintf("%s.snapshot.%s", rootName, snapshot)
+}
+
+func (self *Fs) snapshotListName() string {
+	return fmt.Sprintf("%s.snapshots", self.RootName)
+}
+
+// Snapshots returns the snapshots of the filesystem, oldest first.
+func (self *Fs) Snapshots() []Snapshot {
+	defer self.snapshotLock.Locked()()
+	return self.snapshotList().Snapshots
+}
+
+// snapshotList returns the current list; snapshotLock MUST be held.
+func (self *Fs) snapshotList() *SnapshotList {
+	var sl SnapshotList
+	id := self.storage.GetBlockIdByName(self.snapshotListName())
+	if id == "" {
+		return &sl
+	}
+	b := self.storage.GetBlockById(id)
+	if b == nil {
+		log.Panicf("snapshot list block %x missing", id)
+	}
+	defer b.Close()
+	_, err := sl.UnmarshalMsg(b.Data())
+	if err != nil {
+		log.Panic(err)
+	}
+	return &sl
+}
+
+// setSnapshotList stores the list, and changes the given names
+// atomically with it; snapshotLock MUST be held.
+func (self *Fs) setSnapshotList(sl *SnapshotList, names map[string]string) {
+	names[self.snapshotListName()] = ""
+	if len(sl.Snapshots) > 0 {
+		data, err := sl.MarshalMsg(nil)
+		if err != nil {
+			log.Panic(err)
+		}
+		// The list does not refer to the roots (the names
+		// do), so it is weak
+		b := self.storage.ReferOrStoreBlockBytes0(storage.BS_WEAK, data, nil)
+		defer b.Close()
+		names[self.snapshotListName()] = b.Id()
+	}
+	self.storage.SetNamesToBlockIds(names)
+}
+
+// CreateSnapshot pins the current root of the filesystem under the
+// snapshot name.
+func (self *Fs) CreateSnapshot(name string) error {
+	mlog.Printf2("fs/snapshot", "fs.CreateSnapshot %s", name)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	defer self.snapshotLock.Locked()()
+	sl := self.snapshotList()
+	for _, s := range sl.Snapshots {
+		if s.Name == name {
+			return ErrSnapshotExists
+		}
+	}
+	var block *storage.StorageBlock
+	self.WithoutParallelWrites(func() {
+		block = self.RootBlock()
+	})
+	if block == nil {
+		return errors.New("no root block")
+	}
+	defer block.Close()
+	sl.Snapshots = append(sl.Snapshots, Snapshot{Name: name,
+		RootId: block.Id(), Time: time.Now().UnixNano()})
+	self.setSnapshotList(sl, map[string]string{
+		SnapshotRootName(self.RootName, name): block.Id()})
+	return nil
+}
+
+// DeleteSnapshot removes the snapshot; the blocks only it refers to
+// are freed.
+func (self *Fs) DeleteSnapshot(name string) error {
+	mlog.Printf2("fs/snapshot", "fs.DeleteSnapshot %s", name)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	defer self.snapshotLock.Locked()()
+	sl := self.snapshotList()
+	for i, s := range sl.Snapshots {
+		if s.Name == name {
+			sl.Snapshots = append(sl.Snapshots[:i], sl.Snapshots[i+1:]...)
+			self.setSnapshotList(sl, map[string]string{
+				SnapshotRootName(self.RootName, name): ""})
+			return nil
+		}
+	}
+	return ErrNoSnapshot
+}
+
+// NewSnapshotFs returns read-only filesystem of the named snapshot of
+// the root; mutating operations on it fail with EROFS.
+func NewSnapshotFs(st *storage.Storage, RootName, snapshot string, cacheSize int) (*Fs, error) {
+	fs := newFs(st, SnapshotRootName(RootName, snapshot), cacheSize, true)
+	if fs == nil {
+		return nil, ErrNoSnapshot
+	}
+	return fs, nil
+}
@@ -0,0 +1,226 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Tue Apr  3 09:30:12 2018 mstenber
+ * Last modified: Tue Apr  3 13:02:45 2018 mstenber
+ * Edit time:     151 min
+ *
+ */
+
+// fsck checks the consistency of a storage backend offline.
+//
+// Starting from the names, the block reference graph is walked,
+// and the reference counts calculated based on it are compared
+// against what the backend has stored. Optionally the reference
+// counts are also repaired, and unreachable blocks removed.
+package fsck
+
+import (
+	"fmt"
+
+	"github.com/fingon/go-tfhfs/codec"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+)
+
+type ProblemType int
+
+const (
+	// Block is referred to, but it does not exist
+	P_DANGLING ProblemType = iota
+
+	// Block data cannot be decoded
+	P_UNDECODABLE
+
+	// Block exists, but it is not reachable from any name
+	P_LEAKED
+
+	// Stored reference count does not match the calculated one
+	P_REFCOUNT
+
+	NUM_P
+)
+
+var problemTypeNames = [NUM_P]string{"dangling", "undecodable", "leaked", "refcount"}
+
+func (self ProblemType) String() string {
+	return problemTypeNames[self]
+}
+
+type Problem struct {
+	Type ProblemType
+	Id   string
+
+	// RefCount is the stored reference count, and
+	// ExpectedRefCount the one calculated by walking the
+	// references.
+	RefCount, ExpectedRefCount int32
+
+	// Repaired is set if the problem was fixed.
+	Repaired bool
+}
+
+func (self Problem) String() string {
+	s := fmt.Sprintf("%v %x rc:%d expected:%d", self.Type, self.Id,
+		self.RefCount, self.ExpectedRefCount)
+	if self.Repaired {
+		s = s + " (repaired)"
+	}
+	return s
+}
+
+type Fsck struct {
+	// Backend to check. Blocks are fetched directly from it
+	// (without Storage in between), so it MUST NOT be in use
+	// elsewhere.
+	Backend storage.Backend
+
+	// Codec is used to decode block data (if the backend does
+	// not handle codec itself).
+	Codec codec.Codec
+
+	// IterateReferencesCallback is used to find block references
+	// inside (decoded) block data.
+	IterateReferencesCallback storage.BlockIterateReferencesCallback
+
+	// Names are the roots of the reference graph. Anything not
+	// reachable from them is considered leaked. If not set, every
+	// name in the backend is used.
+	Names []string
+
+	// Repair the problems that can be repaired: fix the
+	// reference counts and remove leaked blocks.
+	Repair bool
+
+	// Results
+	Blocks   int
+	Problems []Problem
+
+	// Missing is the number of blocks with BS_MISSING status
+	// (e.g. evicted from a partial replica). They are not
+	// problems as such, as long as the reference counts add up.
+	Missing int
+}
+
+func (self *Fsck) addProblem(pt ProblemType, b *storage.Block, id string, expected int32) *Problem {
+	p := Problem{Type: pt, Id: id, ExpectedRefCount: expected}
+	if b != nil {
+		p.RefCount = b.RefCount
+	}
+	mlog.Printf2("fsck/fsck", " problem %v", p)
+	self.Problems = append(self.Problems, p)
+	return &self.Problems[len(self.Problems)-1]
+}
+
+// Run performs the check (and repair, if requested). It returns
+// the number of problems found.
+func (self *Fsck) Run() int {
+	mlog.Printf2("fsck/fsck", "fsck.Run %v", self.Names)
+	self.Blocks = 0
+	self.Problems = nil
+	self.Missing = 0
+
+	blocks := make(map[string]*storage.Block)
+	self.Backend.IterateBlocks(func(b *storage.Block) {
+		// Blocks without status are backend-internal (e.g.
+		// storage/tree name map)
+		if b.Status == storage.BS_UNSET {
+			return
+		}
+		blocks[b.Id] = b
+	})
+	self.Blocks = len(blocks)
+
+	expected := make(map[string]int32)
+	todo := make([]string, 0)
+	refer := func(id string) {
+		expected[id]++
+		todo = append(todo, id)
+	}
+	if self.Names == nil {
+		self.Backend.IterateNames(func(name, id string) {
+			refer(id)
+		})
+	}
+	for _, name := range self.Names {
+		id := self.Backend.GetBlockIdByName(name)
+		if id != "" {
+			refer(id)
+		}
+	}
+	visited := make(map[string]bool)
+	for len(todo) > 0 {
+		id := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		b := blocks[id]
+		if b == nil {
+			self.addProblem(P_DANGLING, nil, id, 0)
+			continue
+		}
+		if b.Status >= storage.BS_WANT_NORMAL {
+			// Does not hold references to its children
+			continue
+		}
+		if b.Status == storage.BS_MISSING {
+			// Should be a leaf (see Storage.EvictBlock), but
+			// we cannot know for sure
+			continue
+		}
+		data := self.Backend.GetBlockData(b)
+		if data == nil {
+			self.addProblem(P_UNDECODABLE, b, id, 0)
+			continue
+		}
+		if self.Codec != nil {
+			var err error
+			data, err = self.Codec.DecodeBytes(data, []byte(id))
+			if err != nil {
+				self.addProblem(P_UNDECODABLE, b, id, 0)
+				continue
+			}
+		}
+		self.IterateReferencesCallback(id, data, refer)
+	}
+
+	// Possible children of missing blocks cannot be accounted
+	// for, so in their presence repair may only increase
+	// reference counts.
+	for _, b := range blocks {
+		if b.Status == storage.BS_MISSING {
+			self.Missing++
+		}
+	}
+	missing := self.Missing > 0
+	for id, b := range blocks {
+		exp := expected[id]
+		if exp == 0 {
+			p := self.addProblem(P_LEAKED, b, id, exp)
+			if self.Repair && !missing {
+				self.Backend.DeleteBlock(b)
+				p.Repaired = true
+			}
+			continue
+		}
+		if exp == b.RefCount {
+			continue
+		}
+		p := self.addProblem(P_REFCOUNT, b, id, exp)
+		if self.Repair && (!missing || exp > b.RefCount) {
+			b.Stored = &storage.BlockMetadata{RefCount: b.RefCount,
+				Status: b.Status}
+			b.RefCount = exp
+			self.Backend.UpdateBlock(b)
+			p.Repaired = true
+		}
+	}
+	if self.Repair {
+		self.Backend.Flush()
+	}
+	return len(self.Problems)
+}
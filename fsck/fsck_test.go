@@ -0,0 +1,147 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Tue Apr  3 13:35:12 2018 mstenber
+ * Last modified: Tue Apr  3 14:02:40 2018 mstenber
+ * Edit time:     27 min
+ *
+ */
+
+package fsck_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/fsck"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+func iterateReferences(id string, data []byte, cb storage.BlockReferenceCallback) {
+	for _, subid := range strings.Split(string(data), " ") {
+		if subid != "" {
+			cb(subid)
+		}
+	}
+}
+
+func countProblems(f *fsck.Fsck) (counts [fsck.NUM_P]int) {
+	for _, p := range f.Problems {
+		counts[p.Type]++
+	}
+	return
+}
+
+func TestFsck(t *testing.T) {
+	be := factory.New("inmemory", "")
+	defer be.Close()
+	world := []struct {
+		key, value string
+		rc         int32
+	}{
+		{"root", "a b", 1},
+		{"a", "c dangling", 3}, // should be 1
+		{"b", "c", 1},
+		{"c", " ", 2},
+		{"leak", "c", 1},
+	}
+	for _, v := range world {
+		b := &storage.Block{Id: v.key,
+			BlockMetadata: storage.BlockMetadata{RefCount: v.rc,
+				Status: storage.BS_NORMAL}}
+		data := []byte(v.value)
+		b.Data.Set(&data)
+		be.StoreBlock(b)
+	}
+	be.SetNameToBlockId("name", "root")
+
+	f := &fsck.Fsck{Backend: be, IterateReferencesCallback: iterateReferences,
+		Names: []string{"name"}}
+	assert.Equal(t, f.Run(), 3)
+	assert.Equal(t, f.Blocks, 5)
+	counts := countProblems(f)
+	assert.Equal(t, counts[fsck.P_DANGLING], 1)
+	assert.Equal(t, counts[fsck.P_LEAKED], 1)
+	assert.Equal(t, counts[fsck.P_REFCOUNT], 1)
+	for _, p := range f.Problems {
+		assert.True(t, !p.Repaired)
+	}
+
+	f.Repair = true
+	assert.Equal(t, f.Run(), 3)
+	for _, p := range f.Problems {
+		assert.Equal(t, p.Repaired, p.Type != fsck.P_DANGLING)
+	}
+	assert.Nil(t, be.GetBlockById("leak"))
+	assert.Equal(t, int(be.GetBlockById("a").RefCount), 1)
+
+	// Only the dangling reference remains
+	f.Repair = false
+	assert.Equal(t, f.Run(), 1)
+	assert.Equal(t, f.Problems[0].Type, fsck.P_DANGLING)
+	assert.Equal(t, f.Problems[0].Id, "dangling")
+}
+
+func TestFsckAllNames(t *testing.T) {
+	be := factory.New("inmemory", "")
+	defer be.Close()
+	for _, id := range []string{"root", "snapshot"} {
+		b := &storage.Block{Id: id,
+			BlockMetadata: storage.BlockMetadata{RefCount: 1,
+				Status: storage.BS_NORMAL}}
+		data := []byte(" ")
+		b.Data.Set(&data)
+		be.StoreBlock(b)
+	}
+	be.SetNamesToBlockIds(map[string]string{"root": "root",
+		"root.snapshot.s": "snapshot"})
+
+	// Without names, every name is walked and nothing leaks
+	f := &fsck.Fsck{Backend: be, IterateReferencesCallback: iterateReferences,
+		Repair: true}
+	assert.Equal(t, f.Run(), 0)
+	assert.True(t, be.GetBlockById("snapshot") != nil)
+}
+
+func TestFsckMissing(t *testing.T) {
+	be := factory.New("inmemory", "")
+	defer be.Close()
+	world := []struct {
+		key, value string
+		status     storage.BlockStatus
+	}{
+		{"root", "a", storage.BS_NORMAL},
+		{"a", "", storage.BS_MISSING},
+		{"leak", " ", storage.BS_NORMAL},
+	}
+	for _, v := range world {
+		b := &storage.Block{Id: v.key,
+			BlockMetadata: storage.BlockMetadata{RefCount: 1,
+				Status: v.status}}
+		data := []byte(v.value)
+		b.Data.Set(&data)
+		be.StoreBlock(b)
+	}
+	be.SetNameToBlockId("name", "root")
+
+	// Missing (evicted) leaf is not a problem
+	f := &fsck.Fsck{Backend: be, IterateReferencesCallback: iterateReferences,
+		Names: []string{"name"}, Repair: true}
+	assert.Equal(t, f.Run(), 1)
+	assert.Equal(t, f.Missing, 1)
+	assert.Equal(t, f.Problems[0].Type, fsck.P_LEAKED)
+
+	// .. but it may refer to the leaked block, so it is kept
+	assert.True(t, !f.Problems[0].Repaired)
+	assert.True(t, be.GetBlockById("leak") != nil)
+
+	b := be.GetBlockById("leak")
+	be.DeleteBlock(b)
+	f.Repair = false
+	assert.Equal(t, f.Run(), 0)
+	assert.Equal(t, f.Missing, 1)
+}
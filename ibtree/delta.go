@@ -15,6 +15,10 @@ import "github.com/fingon/go-tfhfs/mlog"
 
 type DeltaCallback func(old, new *NodeDataChild)
 
+// DeltaNodeCallback is called with the child (pointing at a node)
+// of the local tree that is descended into.
+type DeltaNodeCallback func(c *NodeDataChild)
+
 // IterateDelta produces callback for every difference in the leaves
 // local tree as opposed to 'other'.
 //
@@ -22,6 +26,14 @@ type DeltaCallback func(old, new *NodeDataChild)
 // Still, this is pretty expensive operation and should be done only
 // in background.
 func (self *Node) IterateDelta(original *Node, deltacb DeltaCallback) {
+	self.IterateDeltaNodes(original, deltacb, nil)
+}
+
+// IterateDeltaNodes is IterateDelta that also calls nodecb (if set)
+// for every node of the local tree (below the root) that is visited,
+// parents before children. The subtrees that are not visited are
+// shared with 'original'.
+func (self *Node) IterateDeltaNodes(original *Node, deltacb DeltaCallback, nodecb DeltaNodeCallback) {
 	var st, st0 Stack
 	st0.nodes[0] = original
 	st.nodes[0] = self
@@ -77,6 +89,9 @@ func (self *Node) IterateDelta(original *Node, deltacb DeltaCallback) {
 			if !cst.node().Leafy {
 				// Go deeper
 				mlog.Printf2("ibtree/delta", " recursing")
+				if cst == &st && nodecb != nil {
+					nodecb(c)
+				}
 				cst.pushCurrentIndex()
 				continue
 			}
@@ -100,6 +115,9 @@ func (self *Node) IterateDelta(original *Node, deltacb DeltaCallback) {
 			}
 			if push {
 				mlog.Printf2("ibtree/delta", " going deeper in self")
+				if nodecb != nil {
+					nodecb(c)
+				}
 				st.pushCurrentIndex()
 			}
 			continue
@@ -107,6 +107,7 @@ func (self *Transaction) commit(retryUntilSucceeds, recursed bool) bool {
 			defer self.hugger.transactionRetryLock.Locked()()
 			mlog.Printf2("ibtree/hugger/htransaction", " retrying")
 		}
+		self.hugger.retries.Add(1)
 
 		mlog.Printf2("ibtree/hugger/htransaction", " root has changed under us; doing delta")
 		tr := newTransaction(self.hugger, true)
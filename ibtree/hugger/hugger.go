@@ -73,6 +73,23 @@ type Hugger struct {
 	blocks    map[string]*storage.StorageBlock // map of allocations
 	blockLock util.MutexLocked                 // covers blocks
 
+	cacheHits, cacheMisses, retries util.AtomicInt
+}
+
+// Statistics describes the cumulative counters of a Hugger.
+type Statistics struct {
+	// Node data cache hits and misses
+	CacheHits, CacheMisses int64
+
+	// Number of times a transaction had to be retried (or
+	// merged) as the root changed underneath it
+	Retries int64
+}
+
+func (self *Hugger) Statistics() Statistics {
+	return Statistics{CacheHits: self.cacheHits.Get(),
+		CacheMisses: self.cacheMisses.Get(),
+		Retries:     self.retries.Get()}
 }
 
 func (self *Hugger) String() string {
@@ -130,6 +147,7 @@ func (self *Hugger) Update2(cb func(tr *Transaction) bool) bool {
 			first = false
 		}
 		mlog.Printf2("ibtree/hugger/hugger", " retrying fs.Update")
+		self.retries.Add(1)
 	}
 }
 
@@ -164,8 +182,14 @@ func (self *Hugger) LoadNode(id ibtree.BlockId) *ibtree.NodeData {
 }
 
 func (self *Hugger) Flush() {
+	self.FlushWithNames()
+}
+
+// FlushWithNames flushes, and points also the given names to the
+// (new) root; they are changed atomically with RootName.
+func (self *Hugger) FlushWithNames(names ...string) {
 	defer self.lock.Locked()()
-	mlog.Printf2("ibtree/hugger/hugger", "%v.Flush", self)
+	mlog.Printf2("ibtree/hugger/hugger", "%v.Flush %v", self, names)
 	self.flushing = true
 	for len(self.transactions) > 0 {
 		mlog.Printf2("ibtree/hugger/hugger", "%s.Flush waiting %d transactions", self, len(self.transactions))
@@ -203,7 +227,7 @@ func (self *Hugger) Flush() {
 		self.root.Set(r)
 		self.oldRoot.Set(r)
 
-		self.Storage.SetNameToBlockId(self.RootName, string(bid))
+		self.setNamesToBlockId(names, string(bid))
 
 		// If we had 'old root', remove its reference (even if
 		// it was same, CommitTo added one ref to it)
@@ -213,6 +237,9 @@ func (self *Hugger) Flush() {
 		}
 	} else {
 		mlog.Printf2("ibtree/hugger/hugger", " Flush has nothing to do")
+		if len(names) > 0 && r.block != nil {
+			self.setNamesToBlockId(names, r.block.Id())
+		}
 		defer self.blockLock.Locked()()
 	}
 	if len(self.blocks) > 0 {
@@ -229,9 +256,23 @@ func (self *Hugger) Flush() {
 	self.flushed.Broadcast()
 }
 
+func (self *Hugger) setNamesToBlockId(names []string, bid string) {
+	m := map[string]string{self.RootName: bid}
+	for _, name := range names {
+		m[name] = bid
+	}
+	self.Storage.SetNamesToBlockIds(m)
+}
+
 func (self *Hugger) GetCachedNodeData(id ibtree.BlockId) (*ibtree.NodeData, bool) {
 	defer self.nodeDataCacheLock.Locked()()
-	return self.nodeDataCache.Get(id)
+	nd, found := self.nodeDataCache.Get(id)
+	if found {
+		self.cacheHits.Add(1)
+	} else {
+		self.cacheMisses.Add(1)
+	}
+	return nd, found
 }
 
 func (self *Hugger) SetCachedNodeData(id ibtree.BlockId, nd *ibtree.NodeData) {
@@ -262,6 +303,9 @@ func (self *Hugger) RootBlock() *storage.StorageBlock {
 }
 
 func (self *Hugger) RootIsNew() bool {
+	// Whatever was left in the intent log has to be in the
+	// storage before the root is loaded
+	self.Storage.ReplayIntentLog()
 	node, bid, ok := self.LoadNodeByName(self.RootName)
 	root := &treeRoot{node: node}
 	if ok {
@@ -316,6 +360,19 @@ func (self *Hugger) SaveNode(nd *ibtree.NodeData) ibtree.BlockId {
 // nd and deps are optional, but may speed up processing (or not).
 func (self *Hugger) GetStorageBlock(st storage.BlockStatus, b []byte, nd *ibtree.NodeData, deps *util.StringList) *storage.StorageBlock {
 	bl := self.Storage.ReferOrStoreBlockBytes0(st, b, deps)
+	return self.addStorageBlock(bl, nd)
+}
+
+// GetStorageBlockWithId is like GetStorageBlock, but the block id
+// is given (and already verified to match the data) instead of
+// calculated by the storage; e.g. blocks from peers with different
+// hash keep their ids.
+func (self *Hugger) GetStorageBlockWithId(id string, st storage.BlockStatus, b []byte, deps *util.StringList) *storage.StorageBlock {
+	bl := self.Storage.ReferOrStoreBlock0(id, st, b, deps)
+	return self.addStorageBlock(bl, nil)
+}
+
+func (self *Hugger) addStorageBlock(bl *storage.StorageBlock, nd *ibtree.NodeData) *storage.StorageBlock {
 	bid := string(bl.Id())
 	mlog.Printf2("ibtree/hugger/hugger", "%v.GetStorageBlock => %x", self, bid)
 	if nd != nil {
@@ -82,6 +82,8 @@ mount1 () {
     mkdir -p $mountdir
     rm -rf $storagedir
     mkdir -p $storagedir
+    # stores that are synchronized have to share the data key
+    [ -n "${HEADER:-}" ] && cp $HEADER $storagedir/ || true
     echocmd ./tfhfs $* `echo $ARGS`  $mountdir $storagedir >& $logname &
     waitmount $mountdir
 }
@@ -90,7 +92,7 @@ make tfhfs tfhfs-connector
 ADDRESS=localhost:12345
 ADDRESS2=localhost:12346
 MLOG=$MLOG mount1 $MOUNTDIR $STORAGEDIR ,log -address $ADDRESS
-MLOG=$MLOG mount1 $MOUNTDIR2 $STORAGEDIR2 ,log1 -address $ADDRESS2
+HEADER=$STORAGEDIR/tfhfs.header MLOG=$MLOG mount1 $MOUNTDIR2 $STORAGEDIR2 ,log1 -address $ADDRESS2
 ORIGDIR=`pwd`
 cd $MOUNTDIR
 mkdir dir
@@ -0,0 +1,165 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Thu Apr  5 11:22:40 2018 mstenber
+ * Last modified: Thu Apr  5 12:31:08 2018 mstenber
+ * Edit time:     62 min
+ *
+ */
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+const MetricsPath = "/metrics"
+
+// storageCounters describe the storage.C_* counters
+var storageCounters = [storage.NUM_C]struct{ name, help string }{
+	{"tfhfs_storage_reads_total", "Blocks read from the backend"},
+	{"tfhfs_storage_read_bytes_total", "Bytes read from the backend"},
+	{"tfhfs_storage_writes_total", "Blocks written to the backend"},
+	{"tfhfs_storage_write_bytes_total", "Bytes written to the backend"},
+	{"tfhfs_storage_deletes_total", "Blocks deleted from the backend"},
+}
+
+// metricsWriter produces Prometheus text exposition format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (self *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(self.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (self *metricsWriter) value(name, labels string, value interface{}) {
+	if labels != "" {
+		labels = fmt.Sprintf("{%s}", labels)
+	}
+	fmt.Fprintf(self.w, "%s%s %v\n", name, labels, value)
+}
+
+// histogram writes histogram h; its values are multiplied by scale
+// (e.g. to convert nanoseconds to seconds).
+func (self *metricsWriter) histogram(name, labels string, h *util.Histogram, scale float64) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	buckets, count, sum := h.Get()
+	for i, bound := range h.Bounds {
+		le := fmt.Sprintf("%s%sle=\"%v\"", labels, sep, float64(bound)*scale)
+		self.value(name+"_bucket", le, buckets[i])
+	}
+	self.value(name+"_bucket", fmt.Sprintf("%s%sle=\"+Inf\"", labels, sep), count)
+	self.value(name+"_sum", labels, float64(sum)*scale)
+	self.value(name+"_count", labels, count)
+}
+
+// ServeMetrics provides the cumulative statistics of the storage,
+// the trees and the filesystem in Prometheus text format.
+func (self *Server) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	defer mw.w.Flush()
+
+	counters := self.Storage.Counters()
+	for i, c := range storageCounters {
+		mw.header(c.name, "counter", c.help)
+		mw.value(c.name, "", counters[i])
+	}
+
+	jobs := self.Storage.JobCounts()
+	names := make([]string, 0, len(jobs))
+	for k, _ := range jobs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	mw.header("tfhfs_storage_jobs_total", "counter", "Storage jobs run by type")
+	for _, k := range names {
+		mw.value("tfhfs_storage_jobs_total", fmt.Sprintf("type=\"%s\"", k), jobs[k])
+	}
+
+	hits, misses := self.Storage.ReadCacheStatistics()
+	mw.header("tfhfs_storage_read_cache_hits_total", "counter", "Block data read cache hits")
+	mw.value("tfhfs_storage_read_cache_hits_total", "", hits)
+	mw.header("tfhfs_storage_read_cache_misses_total", "counter", "Block data read cache misses")
+	mw.value("tfhfs_storage_read_cache_misses_total", "", misses)
+
+	sst := self.Storage.ScrubStatistics()
+	mw.header("tfhfs_scrub_blocks_total", "counter", "Blocks checked by the scrubber")
+	mw.value("tfhfs_scrub_blocks_total", "", sst.Blocks)
+	mw.header("tfhfs_scrub_corrupt_total", "counter", "Corrupt blocks found by the scrubber")
+	mw.value("tfhfs_scrub_corrupt_total", "", sst.Corrupt)
+	mw.header("tfhfs_scrub_repaired_total", "counter", "Corrupt blocks re-fetched from peer")
+	mw.value("tfhfs_scrub_repaired_total", "", sst.Repaired)
+
+	be := self.Storage.Backend
+	mw.header("tfhfs_backend_bytes_used", "gauge", "Bytes used by the storage backend")
+	mw.value("tfhfs_backend_bytes_used", "", be.GetBytesUsed())
+	tiers := self.Storage.TierBytesUsed()
+	if tiers != nil {
+		mw.header("tfhfs_backend_tier_bytes_used", "gauge", "Bytes used by each tier of the storage backend")
+		tierNames := make([]string, 0, len(tiers))
+		for k, _ := range tiers {
+			tierNames = append(tierNames, k)
+		}
+		sort.Strings(tierNames)
+		for _, k := range tierNames {
+			mw.value("tfhfs_backend_tier_bytes_used", fmt.Sprintf("tier=\"%s\"", k), tiers[k])
+		}
+	}
+	mw.header("tfhfs_backend_bytes_available", "gauge", "Bytes available to the storage backend")
+	mw.value("tfhfs_backend_bytes_available", "", be.GetBytesAvailable())
+	mw.header("tfhfs_storage_pending_bytes", "gauge", "Bytes of block data not yet written to the backend")
+	mw.value("tfhfs_storage_pending_bytes", "", self.Storage.PendingBytes())
+	mw.header("tfhfs_storage_quota_bytes", "gauge", "Maximum number of bytes the storage may use (0 = unlimited)")
+	mw.value("tfhfs_storage_quota_bytes", "", self.Storage.Quota)
+
+	huggers := map[string]hugger.Statistics{"server": self.Hugger.Statistics()}
+	if self.Fs != nil {
+		huggers["fs"] = self.Fs.Hugger.Statistics()
+	}
+	for _, m := range []struct {
+		name, help string
+		get        func(st hugger.Statistics) int64
+	}{
+		{"tfhfs_hugger_cache_hits_total", "Tree node cache hits",
+			func(st hugger.Statistics) int64 { return st.CacheHits }},
+		{"tfhfs_hugger_cache_misses_total", "Tree node cache misses",
+			func(st hugger.Statistics) int64 { return st.CacheMisses }},
+		{"tfhfs_hugger_transaction_retries_total", "Tree transactions retried due to concurrent changes",
+			func(st hugger.Statistics) int64 { return st.Retries }},
+	} {
+		mw.header(m.name, "counter", m.help)
+		for tree, st := range huggers {
+			mw.value(m.name, fmt.Sprintf("tree=\"%s\"", tree), m.get(st))
+		}
+	}
+	if self.Fs == nil {
+		return
+	}
+
+	ops := make(map[string]*util.Histogram)
+	names = make([]string, 0)
+	self.Fs.IterateOpStatistics(func(op string, h *util.Histogram) {
+		ops[op] = h
+		names = append(names, op)
+	})
+	sort.Strings(names)
+	mw.header("tfhfs_fuse_op_duration_seconds", "histogram", "Latency of FUSE operations")
+	for _, op := range names {
+		mw.histogram("tfhfs_fuse_op_duration_seconds",
+			fmt.Sprintf("op=\"%s\"", op), ops[op], 1e-9)
+	}
+}
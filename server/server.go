@@ -24,6 +24,7 @@ import (
 	"github.com/fingon/go-tfhfs/mlog"
 	. "github.com/fingon/go-tfhfs/pb"
 	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/util"
 )
 
 const rootName = "sync"
@@ -37,6 +38,11 @@ type Server struct {
 	Family, Address string
 	Fs              *fs.Fs
 	Storage         *storage.Storage
+
+	// Volume (if any) is the backend served to remote backends
+	// (see volume.go)
+	Volume     storage.Backend
+	volumeLock util.MutexLocked
 }
 
 func (self Server) Init() *Server {
@@ -47,6 +53,7 @@ func (self Server) Init() *Server {
 	twirpHandler := NewFsServer(&self, nil)
 	mlog.Printf2("server/server", "Starting server at %s", self.Address)
 	mux.Handle(FsPathPrefix, twirpHandler)
+	mux.Handle(MetricsPath, http.HandlerFunc(self.ServeMetrics))
 	// Sigh. I wish there was some 'register to mux' API..
 	mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
 	mux.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
@@ -96,13 +103,29 @@ func (self *Server) GetBlockIdByName(ctx context.Context, name *BlockName) (*Blo
 	return &BlockId{Id: id}, nil
 }
 
-func (self *Server) getBlock(id string, wantData, wantMissing bool) (*Block, error) {
+func (self *Server) getBlock(req *GetBlockRequest) (*Block, error) {
+	id := req.Id
 	b := self.Storage.GetBlockById(id)
 	if b == nil {
 		return &Block{}, nil
 	}
 	defer b.Close()
-	res := &Block{Id: id, Status: int32(b.Status())}
+	wantData := req.WantData
+	leaf := false
+	if wantData && req.SkipLeafData {
+		// Evicted (BS_MISSING) blocks are leaves too, so they
+		// do not need to be fetched for this
+		leaf = true
+		b.IterateReferences(func(id string) {
+			leaf = false
+		})
+		wantData = !leaf
+	}
+	if wantData && b.Status() == storage.BS_MISSING && !self.Storage.FetchBlock(id) {
+		// We do not have it either
+		return &Block{}, nil
+	}
+	res := &Block{Id: id, Status: int32(b.Status()), Leaf: leaf}
 	if wantData {
 		data := b.Data()
 		// TBD: Should there be separate API to get
@@ -115,7 +138,7 @@ func (self *Server) getBlock(id string, wantData, wantMissing bool) (*Block, err
 		}
 		res.Data = string(encodedData)
 	}
-	if wantMissing && b.Status() == storage.BS_WEAK {
+	if req.WantMissing && b.Status() == storage.BS_WEAK {
 		missing := make([]string, 0)
 		b.IterateReferences(func(id string) {
 			b2 := self.Storage.GetBlockById(id)
@@ -132,7 +155,7 @@ func (self *Server) getBlock(id string, wantData, wantMissing bool) (*Block, err
 
 func (self *Server) GetBlockById(ctx context.Context, req *GetBlockRequest) (*Block, error) {
 	mlog.Printf2("server/server", "s.GetBlockById %x", req.Id)
-	return self.getBlock(req.Id, req.WantData, req.WantMissing)
+	return self.getBlock(req)
 }
 
 func (self *Server) MergeBlockNameTo(ctx context.Context, req *MergeRequest) (*MergeResult, error) {
@@ -149,9 +172,8 @@ func (self *Server) MergeBlockNameTo(ctx context.Context, req *MergeRequest) (*M
 	self.Fs.Update(func(tr *hugger.Transaction) {
 		fs.MergeTo3(tr, b0, b, false)
 	})
-	block := self.Fs.RootBlock()
-	defer block.Close()
-	self.Storage.SetNameToBlockId(n0, block.Id())
+	// The merge base moves together with the merged root
+	self.Fs.FlushWithNames(n0)
 	return &MergeResult{Ok: true}, nil
 }
 
@@ -165,32 +187,42 @@ func (self *Server) SetNameToBlockId(ctx context.Context, req *SetNameRequest) (
 func (self *Server) StoreBlock(ctx context.Context, req *StoreRequest) (*Block, error) {
 	bid := req.Block.Id
 	mlog.Printf2("server/server", "s.StoreBlock %x", bid)
-	encodedData := []byte(req.Block.Data)
-	data, err := self.Storage.Codec.DecodeBytes(encodedData, []byte(bid))
-	if err != nil {
-		return nil, err
+	st := storage.BlockStatus(req.Block.Status)
+	// Leaf blocks synced metadata-only to partial replicas (see
+	// connector) have BS_MISSING status and no data; their data
+	// is fetched from the replica peer when it is needed
+	data := []byte{}
+	if st != storage.BS_MISSING {
+		encodedData := []byte(req.Block.Data)
+		var err error
+		data, err = self.Storage.Codec.DecodeBytes(encodedData, []byte(bid))
+		if err != nil {
+			return nil, err
+		}
+		// Ids are (possibly keyed) hashes of the data; peer
+		// has to use the same key as we do, but hash is
+		// determined by the id, so the block is stored with
+		// the id it was sent with
+		if !self.Storage.VerifyBlockId(bid, data) {
+			return nil, ErrWrongId
+		}
 	}
 	self.Update(func(tr *hugger.Transaction) {
-		st := storage.BlockStatus(req.Block.Status)
-		bl := self.GetStorageBlock(st, data, nil, nil)
-		if bl.Id() != bid {
-			err = ErrWrongId
-			return
-		}
+		bl := self.GetStorageBlockWithId(bid, st, data, nil)
 		k := fs.NewBlockKeyNameBlock(req.Name, bl.Id()).IB()
 		tr.IB().Set(k, bl.Id())
-		bid = bl.Id()
 	})
-	if err != nil {
-		return nil, err
-	}
-	return self.getBlock(bid, false, true)
+	return self.getBlock(&GetBlockRequest{Id: bid, WantMissing: true})
 }
 
 func (self *Server) UpgradeBlockNonWeak(ctx context.Context, bid *BlockId) (*Block, error) {
 	b := self.Storage.GetBlockById(bid.Id)
 	if b != nil {
-		b.SetStatus(storage.BS_NORMAL)
+		// Blocks without data stay that way
+		if b.Status() != storage.BS_MISSING {
+			b.SetStatus(storage.BS_NORMAL)
+		}
+		b.Close()
 	}
-	return self.getBlock(bid.Id, false, true)
+	return self.getBlock(&GetBlockRequest{Id: bid.Id, WantMissing: true})
 }
@@ -0,0 +1,51 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Fri Apr 20 10:12:40 2018 mstenber
+ * Last modified: Fri Apr 20 10:31:02 2018 mstenber
+ * Edit time:     18 min
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/fingon/go-tfhfs/pb"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/inmemory"
+	"github.com/stvp/assert"
+)
+
+func TestStoreBlockHash(t *testing.T) {
+	t.Parallel()
+
+	st := storage.Storage{Backend: inmemory.NewInMemoryBackend(),
+		Hash: storage.HashType_SHA256}.Init()
+	defer st.Close()
+	s := Server{Storage: st, Address: "127.0.0.1:0"}.Init()
+	defer s.Close()
+
+	// Peer uses different hash; the block keeps its id
+	data := []byte("data")
+	id := storage.HashType_BLAKE3.BlockId(nil, data)
+	b, err := s.StoreBlock(context.Background(), &StoreRequest{Name: "n",
+		Block: &Block{Id: id, Status: int32(storage.BS_NORMAL),
+			Data: string(data)}})
+	assert.Nil(t, err)
+	assert.Equal(t, b.Id, id)
+	sb := st.GetBlockById(id)
+	assert.True(t, sb != nil)
+	assert.Equal(t, string(sb.Data()), "data")
+	sb.Close()
+
+	// Wrong id is rejected
+	_, err = s.StoreBlock(context.Background(), &StoreRequest{Name: "n",
+		Block: &Block{Id: id, Status: int32(storage.BS_NORMAL),
+			Data: "other"}})
+	assert.Equal(t, err, ErrWrongId)
+}
@@ -0,0 +1,249 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Tue Apr 17 09:12:40 2018 mstenber
+ * Last modified: Tue Apr 17 11:21:08 2018 mstenber
+ * Edit time:     74 min
+ *
+ */
+
+package server
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	. "github.com/fingon/go-tfhfs/pb"
+	"github.com/fingon/go-tfhfs/storage"
+)
+
+// The volume operations let remote backends (storage/remote) of
+// other tfhfs instances keep all of their blocks and names in the
+// Volume backend of the server. The block data is stored as-is;
+// it is encoded (and encrypted) by the client, and the server never
+// sees the plaintext.
+
+var ErrNoVolume = errors.New("No volume served")
+var ErrNoVolumeBlock = errors.New("No such volume block")
+
+func (self *Server) volume() (storage.Backend, error) {
+	if self.Volume == nil {
+		return nil, ErrNoVolume
+	}
+	return self.Volume, nil
+}
+
+func volumeBlock(b *storage.Block, wantData bool) *VolumeBlock {
+	res := &VolumeBlock{Id: b.Id, RefCount: b.RefCount,
+		Status: int32(b.Status)}
+	if wantData {
+		res.Data = string(b.GetData())
+	}
+	return res
+}
+
+func (self *Server) GetVolumeBlock(ctx context.Context, req *GetBlockRequest) (*VolumeBlock, error) {
+	mlog.Printf2("server/volume", "s.GetVolumeBlock %x", req.Id)
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	b := be.GetBlockById(req.Id)
+	if b == nil {
+		return &VolumeBlock{}, nil
+	}
+	return volumeBlock(b, req.WantData), nil
+}
+
+func (self *Server) StoreVolumeBlock(ctx context.Context, req *VolumeBlock) (*VolumeResult, error) {
+	mlog.Printf2("server/volume", "s.StoreVolumeBlock %x", req.Id)
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	defer self.volumeLock.Locked()()
+	if be.GetBlockById(req.Id) != nil {
+		// Retried request; block ids are derived from the data
+		return &VolumeResult{}, nil
+	}
+	b := &storage.Block{Id: req.Id,
+		BlockMetadata: storage.BlockMetadata{RefCount: req.RefCount,
+			Status: storage.BlockStatus(req.Status)}}
+	data := []byte(req.Data)
+	b.Data.Set(&data)
+	be.StoreBlock(b)
+	return &VolumeResult{}, nil
+}
+
+func (self *Server) UpdateVolumeBlock(ctx context.Context, req *VolumeBlock) (*VolumeResult, error) {
+	mlog.Printf2("server/volume", "s.UpdateVolumeBlock %x", req.Id)
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	defer self.volumeLock.Locked()()
+	b := be.GetBlockById(req.Id)
+	if b == nil {
+		return nil, ErrNoVolumeBlock
+	}
+	b.RefCount = req.RefCount
+	b.Status = storage.BlockStatus(req.Status)
+	be.UpdateBlock(b)
+	return &VolumeResult{}, nil
+}
+
+func (self *Server) ReplaceVolumeBlock(ctx context.Context, req *VolumeBlock) (*VolumeResult, error) {
+	mlog.Printf2("server/volume", "s.ReplaceVolumeBlock %x", req.Id)
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	defer self.volumeLock.Locked()()
+	if be.GetBlockById(req.Id) == nil {
+		return nil, ErrNoVolumeBlock
+	}
+	b := &storage.Block{Id: req.Id,
+		BlockMetadata: storage.BlockMetadata{RefCount: req.RefCount,
+			Status: storage.BlockStatus(req.Status)}}
+	data := []byte(req.Data)
+	b.Data.Set(&data)
+	be.ReplaceBlock(b)
+	return &VolumeResult{}, nil
+}
+
+func (self *Server) DeleteVolumeBlock(ctx context.Context, req *BlockId) (*VolumeResult, error) {
+	mlog.Printf2("server/volume", "s.DeleteVolumeBlock %x", req.Id)
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	defer self.volumeLock.Locked()()
+	b := be.GetBlockById(req.Id)
+	if b != nil {
+		be.DeleteBlock(b)
+	}
+	return &VolumeResult{}, nil
+}
+
+// maxIterateLimit is the maximum number of blocks returned by
+// IterateVolumeBlocks at once.
+const maxIterateLimit = 1000
+
+// blockHeap keeps the blocks with the greatest id on top.
+type blockHeap []*storage.Block
+
+func (h blockHeap) Len() int            { return len(h) }
+func (h blockHeap) Less(i, j int) bool  { return h[i].Id > h[j].Id }
+func (h blockHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *blockHeap) Push(x interface{}) { *h = append(*h, x.(*storage.Block)) }
+func (h *blockHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// IterateVolumeBlocks returns the blocks with id greater than
+// req.StartId, in the order of id, at most req.Limit (or
+// maxIterateLimit) of them. Backends cannot iterate from a key, so
+// every call goes through all blocks, but only the ones returned are
+// kept in memory.
+func (self *Server) IterateVolumeBlocks(ctx context.Context, req *IterateRequest) (*VolumeBlocks, error) {
+	mlog.Printf2("server/volume", "s.IterateVolumeBlocks %v %v from %x", req.All, req.Status, req.StartId)
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	limit := int(req.Limit)
+	if limit <= 0 || limit > maxIterateLimit {
+		limit = maxIterateLimit
+	}
+	// One extra block is kept to know if there are more
+	h := &blockHeap{}
+	cb := func(b *storage.Block) {
+		if b.Id <= req.StartId {
+			return
+		}
+		if h.Len() <= limit {
+			heap.Push(h, b)
+		} else if b.Id < (*h)[0].Id {
+			(*h)[0] = b
+			heap.Fix(h, 0)
+		}
+	}
+	if req.All {
+		be.IterateBlocks(cb)
+	} else {
+		be.IterateBlocksWithStatus(storage.BlockStatus(req.Status), cb)
+	}
+	blocks := []*storage.Block(*h)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Id < blocks[j].Id
+	})
+	res := &VolumeBlocks{}
+	if len(blocks) > limit {
+		res.More = true
+		blocks = blocks[:limit]
+	}
+	for _, b := range blocks {
+		res.Blocks = append(res.Blocks, volumeBlock(b, false))
+	}
+	return res, nil
+}
+
+func (self *Server) GetVolumeBlockIdByName(ctx context.Context, req *BlockName) (*BlockId, error) {
+	mlog.Printf2("server/volume", "s.GetVolumeBlockIdByName %s", req.Name)
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	return &BlockId{Id: be.GetBlockIdByName(req.Name)}, nil
+}
+
+func (self *Server) GetVolumeNames(ctx context.Context, req *VolumeRequest) (*VolumeNames, error) {
+	mlog.Printf2("server/volume", "s.GetVolumeNames")
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	be.IterateNames(func(name, block_id string) {
+		names[name] = block_id
+	})
+	return &VolumeNames{Names: names}, nil
+}
+
+func (self *Server) SetVolumeNames(ctx context.Context, req *SetNamesRequest) (*VolumeResult, error) {
+	mlog.Printf2("server/volume", "s.SetVolumeNames %v", req.Names)
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	be.SetNamesToBlockIds(req.Names)
+	return &VolumeResult{}, nil
+}
+
+func (self *Server) FlushVolume(ctx context.Context, req *VolumeRequest) (*VolumeResult, error) {
+	mlog.Printf2("server/volume", "s.FlushVolume")
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	be.Flush()
+	return &VolumeResult{}, nil
+}
+
+func (self *Server) GetVolumeUsage(ctx context.Context, req *VolumeRequest) (*VolumeUsage, error) {
+	be, err := self.volume()
+	if err != nil {
+		return nil, err
+	}
+	return &VolumeUsage{BytesAvailable: be.GetBytesAvailable(),
+		BytesUsed: be.GetBytesUsed()}, nil
+}
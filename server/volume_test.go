@@ -0,0 +1,127 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Tue Apr 17 13:50:12 2018 mstenber
+ * Last modified: Tue Apr 17 14:22:40 2018 mstenber
+ * Edit time:     25 min
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/codec"
+	. "github.com/fingon/go-tfhfs/pb"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/backendtest"
+	"github.com/fingon/go-tfhfs/storage/inmemory"
+	"github.com/fingon/go-tfhfs/storage/remote"
+	"github.com/stvp/assert"
+)
+
+func TestVolume(t *testing.T) {
+	t.Parallel()
+
+	vol := inmemory.NewInMemoryBackend()
+	ts := httptest.NewServer(NewFsServer(&Server{Volume: vol}, nil))
+	defer ts.Close()
+
+	be := remote.NewRemoteBackend(NewFsProtobufClient(ts.URL, &http.Client{}))
+	c := codec.EncryptingCodec{}.Init([]byte("foo"), []byte("salt"), 64)
+	be.Init(storage.BackendConfiguration{Codec: c})
+	assert.True(t, be.Supports(storage.CodecFeature))
+
+	b := &storage.Block{Id: "id1",
+		BlockMetadata: storage.BlockMetadata{RefCount: 1,
+			Status: storage.BS_NORMAL}}
+	data := []byte("secret-data")
+	b.Data.Set(&data)
+	be.StoreBlock(b)
+	be.SetNameToBlockId("name", "id1")
+
+	// The server has only the ciphertext
+	vb := vol.GetBlockById("id1")
+	assert.True(t, vb != nil)
+	assert.False(t, strings.Contains(string(vb.GetData()), "secret"))
+
+	b = be.GetBlockById("id1")
+	assert.True(t, b != nil)
+	assert.Equal(t, string(b.GetData()), "secret-data")
+	assert.Equal(t, be.GetBlockIdByName("name"), "id1")
+
+	b.RefCount = 2
+	b.Status = storage.BS_WEAK
+	be.UpdateBlock(b)
+	assert.Equal(t, vol.GetBlockById("id1").RefCount, int32(2))
+	count := 0
+	be.IterateBlocksWithStatus(storage.BS_WEAK, func(b *storage.Block) {
+		assert.Equal(t, b.Id, "id1")
+		count++
+	})
+	assert.Equal(t, count, 1)
+
+	be.DeleteBlock(b)
+	be.Flush()
+	assert.True(t, be.GetBlockById("id1") == nil)
+	assert.True(t, vol.GetBlockById("id1") == nil)
+}
+
+func TestIterateVolumeBlocks(t *testing.T) {
+	t.Parallel()
+
+	vol := inmemory.NewInMemoryBackend()
+	s := &Server{Volume: vol}
+	for i := 4; i >= 0; i-- {
+		b := &storage.Block{Id: fmt.Sprintf("id%d", i),
+			BlockMetadata: storage.BlockMetadata{RefCount: 1,
+				Status: storage.BS_NORMAL}}
+		data := []byte("data")
+		b.Data.Set(&data)
+		vol.StoreBlock(b)
+	}
+
+	// Blocks come in pages, in order of id
+	req := &IterateRequest{All: true, Limit: 2}
+	ids := []string{}
+	for {
+		res, err := s.IterateVolumeBlocks(context.Background(), req)
+		assert.Nil(t, err)
+		assert.True(t, len(res.Blocks) <= 2)
+		for _, vb := range res.Blocks {
+			ids = append(ids, vb.Id)
+		}
+		if !res.More {
+			break
+		}
+		req.StartId = res.Blocks[len(res.Blocks)-1].Id
+	}
+	assert.Equal(t, ids, []string{"id0", "id1", "id2", "id3", "id4"})
+}
+
+func TestVolumeBackend(t *testing.T) {
+	t.Parallel()
+
+	servers := []*httptest.Server{}
+	defer func() {
+		for _, ts := range servers {
+			ts.Close()
+		}
+	}()
+	backendtest.Suite{New: func(dir string) storage.Backend {
+		vol := inmemory.NewInMemoryBackend()
+		ts := httptest.NewServer(NewFsServer(&Server{Volume: vol}, nil))
+		servers = append(servers, ts)
+		be := remote.NewRemoteBackend(NewFsProtobufClient(ts.URL, &http.Client{}))
+		be.Init(storage.BackendConfiguration{Directory: dir})
+		return be
+	}, Volatile: true}.Run(t)
+}
@@ -4,8 +4,8 @@
  * Copyright (c) 2018 Markus Stenberg
  *
  * Created:       Fri Jan  5 11:14:11 2018 mstenber
- * Last modified: Wed Mar 21 12:20:55 2018 mstenber
- * Edit time:     14 min
+ * Last modified: Fri Apr 13 16:20:31 2018 mstenber
+ * Edit time:     17 min
  *
  */
 
@@ -38,6 +38,33 @@ type BackendConfiguration struct {
 
 	// Unsafe mode (if possible) ; non-sync writes mostly
 	Unsafe bool
+
+	// Quota (if set) is the maximum number of bytes the store
+	// may use. It is enforced by Storage (see Storage.Quota).
+	Quota uint64
+
+	// TierColdAge is how long blocks of tiered backend stay in
+	// the fast tier after they have been last read (default 24
+	// hours). If TierPromote is set, blocks read from the slow
+	// tier are moved back to the fast one.
+	TierColdAge time.Duration
+	TierPromote bool
+
+	// S3URL is the object store of the s3 backend, either
+	// http(s)://HOST[:PORT]/BUCKET or file:///DIRECTORY.
+	S3URL string
+
+	// S3Credentials (if set) is file which contains the access
+	// key and the secret key of the object store, separated by
+	// whitespace. Without it, they are taken from the
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+	// variables. (They are not in S3URL, as command line
+	// arguments are visible to other users.)
+	S3Credentials string
+
+	// RemoteCacheSize is the number of bytes of block data the
+	// remote backend caches locally (default 64MB).
+	RemoteCacheSize int
 }
 
 // BlockBackend is subset of the storage Backend which deals with raw
@@ -57,6 +84,25 @@ type BlockBackend interface {
 
 	// UpdateBlock updates block metadata in  It MUST exist.
 	UpdateBlock(b *Block) int
+
+	// ReplaceBlock replaces the data (and metadata) of block. It
+	// MUST exist. The replacement is atomic; even if the process
+	// dies while at it, either the old or the new version of the
+	// block remains.
+	ReplaceBlock(b *Block)
+
+	// IterateBlocks calls cb for every block in the backend (in
+	// no particular order). The callback MUST NOT modify the
+	// backend.
+	IterateBlocks(cb func(b *Block))
+
+	// IterateBlocksWithStatus calls cb for every block in the
+	// backend with the given status (in no particular order).
+	// Backends index blocks by status, so this is cheap even if
+	// there are few such blocks. Blocks with BS_UNSET status are
+	// backend-internal and are not indexed. The callback MUST NOT
+	// modify the backend.
+	IterateBlocksWithStatus(status BlockStatus, cb func(b *Block))
 }
 
 // NameBackend is subset of storage Backend which deals with names.
@@ -65,8 +111,18 @@ type NameBackend interface {
 	// GetBlockIdByName returns block id mapped to particular name.
 	GetBlockIdByName(name string) string
 
+	// IterateNames calls cb for every name and the block id it
+	// maps to (in no particular order). The callback MUST NOT
+	// modify the backend.
+	IterateNames(cb func(name, block_id string))
+
 	// SetBlockIdName sets the logical name to map to particular block id.
 	SetNameToBlockId(name, block_id string)
+
+	// SetNamesToBlockIds sets all of the given names (empty block
+	// id removes the name) atomically; even if the process dies
+	// while at it, either all or none of them change.
+	SetNamesToBlockIds(names map[string]string)
 }
 
 type BackendFeature int
@@ -110,3 +166,14 @@ type Backend interface {
 	BlockBackend
 	NameBackend
 }
+
+// TieredBackend is implemented by backends that store data in
+// multiple tiers.
+type TieredBackend interface {
+	// GetTierBytesUsed returns number of bytes used by each tier.
+	GetTierBytesUsed() map[string]uint64
+
+	// PeekBlockData returns the data of the block without
+	// updating its read time or moving it between the tiers.
+	PeekBlockData(b *Block) []byte
+}
@@ -0,0 +1,493 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Thu Apr 19 09:10:44 2018 mstenber
+ * Last modified: Thu Apr 19 13:02:18 2018 mstenber
+ * Edit time:     141 min
+ *
+ */
+
+// backendtest package provides conformance test suite for
+// storage.Backend implementations. Any backend can be checked with
+// single call, e.g.
+//
+//	backendtest.Suite{New: func(dir string) storage.Backend {
+//	        return factory.New("badger", dir)
+//	}}.Run(t)
+package backendtest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/stvp/assert"
+)
+
+// Suite describes the backend to be tested. Like with storage.Storage,
+// the test blocks' data is determined by their id.
+type Suite struct {
+	// New returns initialized backend that keeps its data in
+	// the (possibly empty) directory.
+	New func(dir string) storage.Backend
+
+	// Volatile backends (e.g. inmemory) do not keep anything
+	// after Close; the persistence and crash tests are skipped
+	// for them.
+	Volatile bool
+}
+
+// Run runs the whole suite as subtests of t.
+func (self Suite) Run(t *testing.T) {
+	t.Run("Blocks", self.testBlocks)
+	t.Run("Metadata", self.testMetadata)
+	t.Run("Names", self.testNames)
+	t.Run("Replace", self.testReplace)
+	if self.Volatile {
+		return
+	}
+	t.Run("Reopen", self.testReopen)
+	t.Run("Crash", self.testCrash)
+}
+
+// withBackend calls cb with fresh backend (in new directory).
+func (self Suite) withBackend(t *testing.T, cb func(dir string, be storage.Backend)) {
+	dir, err := ioutil.TempDir("", "backendtest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	be := self.New(dir)
+	cb(dir, be)
+}
+
+// model is the state the backend should be in.
+type model struct {
+	blocks map[string]*storage.Block
+	names  map[string]string
+
+	// gone contains ids that have been deleted
+	gone map[string]bool
+}
+
+func newModel() *model {
+	return &model{blocks: make(map[string]*storage.Block),
+		names: make(map[string]string),
+		gone:  make(map[string]bool)}
+}
+
+func (self *model) copy() *model {
+	m := newModel()
+	for id, b := range self.blocks {
+		nb := *b
+		m.blocks[id] = &nb
+	}
+	for k, v := range self.names {
+		m.names[k] = v
+	}
+	for id, _ := range self.gone {
+		m.gone[id] = true
+	}
+	return m
+}
+
+// blockSizes are the sizes of the test blocks
+var blockSizes = []int{0, 1, 1000, 4096, 200000}
+
+func blockId(i int) string {
+	return fmt.Sprintf("block-%04d", i)
+}
+
+// blockData returns the data of the block i. As with real block ids,
+// the id determines the data.
+func blockData(i int) []byte {
+	data := make([]byte, blockSizes[i%len(blockSizes)])
+	rand.New(rand.NewSource(int64(i))).Read(data)
+	return data
+}
+
+func (self *model) store(be storage.Backend, i int, refCount int32, status storage.BlockStatus) {
+	id := blockId(i)
+	data := blockData(i)
+	b := &storage.Block{Id: id,
+		BlockMetadata: storage.BlockMetadata{RefCount: refCount,
+			Status: status}}
+	b.Data.Set(&data)
+	be.StoreBlock(b)
+	self.blocks[id] = b
+	delete(self.gone, id)
+}
+
+func (self *model) update(be storage.Backend, i int, refCount int32, status storage.BlockStatus) {
+	b := self.blocks[blockId(i)]
+	stored := b.BlockMetadata
+	b.Stored = &stored
+	b.RefCount = refCount
+	b.Status = status
+	be.UpdateBlock(b)
+	b.Stored = nil
+}
+
+// replace replaces the block with one with the given data (e.g.
+// none, for evicted blocks).
+func (self *model) replace(be storage.Backend, i int, refCount int32, status storage.BlockStatus, data []byte) {
+	id := blockId(i)
+	b := &storage.Block{Id: id,
+		BlockMetadata: storage.BlockMetadata{RefCount: refCount,
+			Status: status}}
+	b.Data.Set(&data)
+	be.ReplaceBlock(b)
+	self.blocks[id] = b
+}
+
+func (self *model) delete(be storage.Backend, i int) {
+	id := blockId(i)
+	be.DeleteBlock(be.GetBlockById(id))
+	delete(self.blocks, id)
+	self.gone[id] = true
+}
+
+func (self *model) setNames(be storage.Backend, names map[string]string) {
+	be.SetNamesToBlockIds(names)
+	for k, v := range names {
+		self.names[k] = v
+	}
+}
+
+// check ensures the backend matches the model.
+func (self *model) check(t *testing.T, be storage.Backend) {
+	for id, b := range self.blocks {
+		b2 := be.GetBlockById(id)
+		assert.True(t, b2 != nil, "missing block ", id)
+		if b2 == nil {
+			continue
+		}
+		assert.Equal(t, b2.RefCount, b.RefCount, "refcount of ", id)
+		assert.Equal(t, b2.Status, b.Status, "status of ", id)
+		assert.Equal(t, string(b2.GetData()), string(*b.Data.Get()),
+			"data of ", id)
+	}
+	for id, _ := range self.gone {
+		assert.True(t, be.GetBlockById(id) == nil, "deleted block ", id)
+	}
+
+	// Blocks without status are backend-internal
+	seen := 0
+	be.IterateBlocks(func(b *storage.Block) {
+		if b.Status == storage.BS_UNSET {
+			return
+		}
+		_, ok := self.blocks[b.Id]
+		assert.True(t, ok, "unknown block ", b.Id)
+		seen++
+	})
+	assert.Equal(t, seen, len(self.blocks))
+	for _, status := range []storage.BlockStatus{storage.BS_NORMAL,
+		storage.BS_MISSING, storage.BS_WEAK} {
+		seen := 0
+		be.IterateBlocksWithStatus(status, func(b *storage.Block) {
+			assert.Equal(t, b.Status, status)
+			ob, ok := self.blocks[b.Id]
+			assert.True(t, ok && ob.Status == status,
+				"wrong status index for ", b.Id)
+			seen++
+		})
+		expected := 0
+		for _, b := range self.blocks {
+			if b.Status == status {
+				expected++
+			}
+		}
+		assert.Equal(t, seen, expected, "blocks with status ", status)
+	}
+
+	names := make(map[string]string)
+	for k, v := range self.names {
+		assert.Equal(t, be.GetBlockIdByName(k), v, "name ", k)
+		if v != "" {
+			names[k] = v
+		}
+	}
+	be.IterateNames(func(name, id string) {
+		assert.Equal(t, names[name], id, "iterated name ", name)
+		delete(names, name)
+	})
+	assert.Equal(t, len(names), 0, "names not iterated: ", names)
+}
+
+// matches is like check, but it only tells whether the backend
+// matches the model (without status indexes).
+func (self *model) matches(be storage.Backend) bool {
+	for id, b := range self.blocks {
+		b2 := be.GetBlockById(id)
+		if b2 == nil || b2.RefCount != b.RefCount || b2.Status != b.Status ||
+			string(b2.GetData()) != string(*b.Data.Get()) {
+			return false
+		}
+	}
+	for id, _ := range self.gone {
+		if be.GetBlockById(id) != nil {
+			return false
+		}
+	}
+	ok := true
+	seen := 0
+	be.IterateBlocks(func(b *storage.Block) {
+		if b.Status == storage.BS_UNSET {
+			return
+		}
+		if _, found := self.blocks[b.Id]; !found {
+			ok = false
+		}
+		seen++
+	})
+	if !ok || seen != len(self.blocks) {
+		return false
+	}
+	names := make(map[string]string)
+	for k, v := range self.names {
+		if be.GetBlockIdByName(k) != v {
+			return false
+		}
+		if v != "" {
+			names[k] = v
+		}
+	}
+	be.IterateNames(func(name, id string) {
+		if names[name] != id {
+			ok = false
+		}
+		delete(names, name)
+	})
+	return ok && len(names) == 0
+}
+
+func (self Suite) testBlocks(t *testing.T) {
+	self.withBackend(t, func(dir string, be storage.Backend) {
+		defer be.Close()
+		m := newModel()
+		m.check(t, be)
+		assert.True(t, be.GetBlockById(blockId(0)) == nil)
+		for i := 0; i < 10; i++ {
+			m.store(be, i, int32(i+1), storage.BS_NORMAL)
+		}
+		m.store(be, 10, 1, storage.BS_NORMAL)
+		m.check(t, be)
+		for i := 0; i < 10; i += 2 {
+			m.delete(be, i)
+		}
+		m.check(t, be)
+
+		// Deleted block can be stored again
+		m.store(be, 0, 1, storage.BS_WEAK)
+		m.check(t, be)
+	})
+}
+
+func (self Suite) testMetadata(t *testing.T) {
+	self.withBackend(t, func(dir string, be storage.Backend) {
+		defer be.Close()
+		m := newModel()
+		m.store(be, 0, 1, storage.BS_NORMAL)
+		m.store(be, 1, 1, storage.BS_NORMAL)
+		for _, st := range []storage.BlockStatus{storage.BS_WEAK,
+			storage.BS_MISSING, storage.BS_NORMAL} {
+			m.update(be, 0, 42, st)
+			m.check(t, be)
+		}
+		m.update(be, 0, 1, storage.BS_NORMAL)
+		m.check(t, be)
+		m.delete(be, 0)
+		m.check(t, be)
+	})
+}
+
+func (self Suite) testNames(t *testing.T) {
+	self.withBackend(t, func(dir string, be storage.Backend) {
+		defer be.Close()
+		m := newModel()
+		assert.Equal(t, be.GetBlockIdByName("name"), "")
+		m.store(be, 0, 1, storage.BS_NORMAL)
+		be.SetNameToBlockId("name", blockId(0))
+		m.names["name"] = blockId(0)
+		m.check(t, be)
+		m.setNames(be, map[string]string{"name": "", "a": blockId(0),
+			"b": blockId(0)})
+		m.check(t, be)
+		m.setNames(be, map[string]string{"a": blockId(1), "b": ""})
+		m.check(t, be)
+		be.SetNameToBlockId("a", "")
+		m.names["a"] = ""
+		m.check(t, be)
+	})
+}
+
+func (self Suite) testReplace(t *testing.T) {
+	self.withBackend(t, func(dir string, be storage.Backend) {
+		m := newModel()
+		for i := 0; i < 5; i++ {
+			m.store(be, i, 1, storage.BS_NORMAL)
+		}
+		// Same data (e.g. recodec or repair)
+		m.replace(be, 1, 1, storage.BS_NORMAL, blockData(1))
+		m.check(t, be)
+		// Evict and restore
+		m.replace(be, 2, 2, storage.BS_MISSING, []byte{})
+		m.check(t, be)
+		m.replace(be, 3, 1, storage.BS_MISSING, []byte{})
+		m.replace(be, 3, 1, storage.BS_NORMAL, blockData(3))
+		m.check(t, be)
+		be.Close()
+		if self.Volatile {
+			return
+		}
+		be = self.New(dir)
+		m.check(t, be)
+		be.Close()
+	})
+}
+
+func (self Suite) testReopen(t *testing.T) {
+	self.withBackend(t, func(dir string, be storage.Backend) {
+		m := newModel()
+		for i := 0; i < 5; i++ {
+			m.store(be, i, 1, storage.BS_NORMAL)
+		}
+		m.update(be, 1, 2, storage.BS_WEAK)
+		m.update(be, 2, 3, storage.BS_MISSING)
+		m.delete(be, 3)
+		m.setNames(be, map[string]string{"a": blockId(0),
+			"b": blockId(1)})
+		be.Close()
+
+		for i := 0; i < 2; i++ {
+			be = self.New(dir)
+			m.check(t, be)
+			be.Close()
+		}
+
+		// Changes after reopen stick too
+		be = self.New(dir)
+		m.delete(be, 0)
+		m.setNames(be, map[string]string{"a": ""})
+		be.Close()
+		be = self.New(dir)
+		m.check(t, be)
+		be.Close()
+	})
+}
+
+// testCrash simulates crash after each step, both before and right
+// after the Flush; the state at that point is copied elsewhere (as
+// the backend is still open). The copy made before the Flush has to
+// open to either the state before or after the step (never a mix of
+// them), and the one made after it to the state after the step.
+func (self Suite) testCrash(t *testing.T) {
+	self.withBackend(t, func(dir string, be storage.Backend) {
+		m := newModel()
+		steps := []func(){
+			func() {
+				m.store(be, 0, 1, storage.BS_NORMAL)
+				m.store(be, 1, 2, storage.BS_WEAK)
+				m.setNames(be, map[string]string{"a": blockId(0)})
+			},
+			func() {
+				m.update(be, 0, 3, storage.BS_WEAK)
+				m.store(be, 2, 1, storage.BS_NORMAL)
+			},
+			func() {
+				m.delete(be, 1)
+				m.setNames(be, map[string]string{"a": "",
+					"b": blockId(2)})
+			},
+			func() {
+				m.update(be, 0, 1, storage.BS_NORMAL)
+				m.delete(be, 2)
+				m.store(be, 3, 1, storage.BS_NORMAL)
+				m.setNames(be, map[string]string{"b": blockId(3)})
+			},
+		}
+		models := make([]*model, len(steps))
+		for i, step := range steps {
+			step()
+			copyDirectory(t, dir, crashDirectory(dir, i, false))
+			be.Flush()
+			copyDirectory(t, dir, crashDirectory(dir, i, true))
+			models[i] = m.copy()
+		}
+		be.Close()
+		defer func() {
+			for i, _ := range steps {
+				os.RemoveAll(crashDirectory(dir, i, false))
+				os.RemoveAll(crashDirectory(dir, i, true))
+			}
+		}()
+		prev := newModel()
+		for i, m := range models {
+			mlog.Printf2("storage/backendtest/backendtest", "crash before flush of step %d", i)
+			be := self.New(crashDirectory(dir, i, false))
+			assert.True(t, prev.matches(be) || m.matches(be),
+				"mixed state before flush of step ", i)
+			be.Close()
+
+			mlog.Printf2("storage/backendtest/backendtest", "crash after step %d", i)
+			be = self.New(crashDirectory(dir, i, true))
+			m.check(t, be)
+			be.Close()
+			prev = m
+		}
+	})
+}
+
+func crashDirectory(dir string, i int, flushed bool) string {
+	if !flushed {
+		return fmt.Sprintf("%s.crash%d-noflush", dir, i)
+	}
+	return fmt.Sprintf("%s.crash%d", dir, i)
+}
+
+// copyDirectory copies the directory (and the files in it) as-is.
+func copyDirectory(t *testing.T, src, dst string) {
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+	assert.Nil(t, err)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
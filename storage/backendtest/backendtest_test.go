@@ -0,0 +1,32 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Thu Apr 19 13:05:02 2018 mstenber
+ * Last modified: Thu Apr 19 13:20:41 2018 mstenber
+ * Edit time:     8 min
+ *
+ */
+
+package backendtest_test
+
+import (
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/backendtest"
+	"github.com/fingon/go-tfhfs/storage/factory"
+)
+
+func TestBackends(t *testing.T) {
+	for _, k := range append(factory.List(), "mirror:badger,tree", "erasure:2,1", "tiered:badger,file") {
+		k := k
+		t.Run(k, func(t *testing.T) {
+			t.Parallel()
+			backendtest.Suite{New: func(dir string) storage.Backend {
+				return factory.New(k, dir)
+			}, Volatile: k == "inmemory"}.Run(t)
+		})
+	}
+}
@@ -24,6 +24,8 @@ import (
 // - key prefix 1 + block id -> metadata
 // - key prefix 2 + block id -> data (essentially immutable)
 // - key prefix 3 + name -> block id
+// - key prefix 4 + status + block id -> nothing (status index)
+// - key statusIndexKey -> nothing (status index is up to date)
 type badgerBackend struct {
 	storage.DirectoryBackendBase
 	db *badger.DB
@@ -31,6 +33,8 @@ type badgerBackend struct {
 
 var _ storage.Backend = &badgerBackend{}
 
+var statusIndexKey = []byte("0status")
+
 // Init makes the instance actually useful
 
 func NewBadgerBackend() storage.Backend {
@@ -60,6 +64,65 @@ func (self *badgerBackend) Init(config storage.BackendConfiguration) {
 		log.Panic("badger.Open", err)
 	}
 	self.db = db
+	_, err = self.getKKValue(statusIndexKey, nil)
+	if err == badger.ErrKeyNotFound {
+		self.indexStatuses()
+	} else if err != nil {
+		log.Panic("get error:", err)
+	}
+}
+
+// indexStatuses populates the status index of storage that was
+// created without one.
+func (self *badgerBackend) indexStatuses() {
+	mlog.Printf2("storage/badger/badger", "bad.indexStatuses")
+	self.IterateBlocks(func(b *storage.Block) {
+		if b.Status == storage.BS_UNSET {
+			return
+		}
+		if err := self.set(statusKey(b.Id, b.Status), nil); err != nil {
+			log.Panic("set", err)
+		}
+	})
+	self.setKKValue(statusIndexKey, nil, nil)
+}
+
+func statusKey(id string, status storage.BlockStatus) []byte {
+	return append([]byte{'4', byte(status)}, []byte(id)...)
+}
+
+// setStatus updates the status index within the transaction, which
+// also updates the metadata; BS_UNSET is used for blocks that do not
+// exist.
+func setStatus(txn *badger.Txn, id string, status storage.BlockStatus) error {
+	old := storage.BS_UNSET
+	i, err := txn.Get(append([]byte("1"), []byte(id)...))
+	if err == nil {
+		bv, err := i.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		var meta storage.BlockMetadata
+		_, err = meta.UnmarshalMsg(bv)
+		if err != nil {
+			return err
+		}
+		old = meta.Status
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	if old == status {
+		return nil
+	}
+	if old != storage.BS_UNSET {
+		if err := txn.Delete(statusKey(id, old)); err != nil {
+			return err
+		}
+	}
+	if status != storage.BS_UNSET {
+		return txn.Set(statusKey(id, status), nil)
+	}
+	return nil
 }
 
 func (self *badgerBackend) Flush() {
@@ -87,17 +150,18 @@ func (self *badgerBackend) Close() {
 
 func (self *badgerBackend) DeleteBlock(b *storage.Block) {
 	mlog.Printf2("storage/badger/badger", "bad.DeleteBlock %x", b.Id)
-	self.db.Update(func(txn *badger.Txn) error {
-		k := append([]byte("1"), []byte(b.Id)...)
-		if err := self.delete(k); err != nil {
-			log.Panic("txn.Delete", err)
+	err := self.update(func(txn *badger.Txn) error {
+		if err := setStatus(txn, b.Id, storage.BS_UNSET); err != nil {
+			return err
 		}
-		k = append([]byte("2"), []byte(b.Id)...)
-		if err := self.delete(k); err != nil {
-			log.Panic("txn.Delete 2", err)
+		if err := txn.Delete(append([]byte("1"), []byte(b.Id)...)); err != nil {
+			return err
 		}
-		return nil
+		return txn.Delete(append([]byte("2"), []byte(b.Id)...))
 	})
+	if err != nil {
+		log.Panic("txn.Delete", err)
+	}
 }
 
 func (self *badgerBackend) getKKValue(prefix, suffix []byte) (v []byte, err error) {
@@ -134,6 +198,59 @@ func (self *badgerBackend) GetBlockById(id string) *storage.Block {
 	return b
 }
 
+func (self *badgerBackend) IterateBlocks(cb func(b *storage.Block)) {
+	blocks := make([]*storage.Block, 0)
+	prefix := []byte("1")
+	err := self.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			id := string(item.Key()[len(prefix):])
+			bv, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			b := &storage.Block{Id: id, Backend: self}
+			_, err = b.BlockMetadata.UnmarshalMsg(bv)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, b)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic("iterate error:", err)
+	}
+	for _, b := range blocks {
+		cb(b)
+	}
+}
+
+func (self *badgerBackend) IterateBlocksWithStatus(status storage.BlockStatus, cb func(b *storage.Block)) {
+	ids := make([]string, 0)
+	prefix := statusKey("", status)
+	self.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			ids = append(ids, string(it.Item().Key()[len(prefix):]))
+		}
+		return nil
+	})
+	for _, id := range ids {
+		// The index may be stale if the block was changed
+		// after the ids were gathered
+		b := self.GetBlockById(id)
+		if b != nil && b.Status == status {
+			cb(b)
+		}
+	}
+}
+
 func (self *badgerBackend) GetBlockIdByName(name string) string {
 	bv, err := self.getKKValue([]byte("3"), []byte(name))
 	if err == badger.ErrKeyNotFound {
@@ -145,6 +262,32 @@ func (self *badgerBackend) GetBlockIdByName(name string) string {
 	return string(bv)
 }
 
+func (self *badgerBackend) IterateNames(cb func(name, block_id string)) {
+	names := make(map[string]string)
+	prefix := []byte("3")
+	err := self.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			bv, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if len(bv) > 0 {
+				names[string(item.Key()[len(prefix):])] = string(bv)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic("iterate error:", err)
+	}
+	for k, v := range names {
+		cb(k, v)
+	}
+}
+
 func (self *badgerBackend) setKKValue(prefix, suffix, value []byte) {
 	k := append(prefix, suffix...)
 	if err := self.set(k, value); err != nil {
@@ -152,14 +295,16 @@ func (self *badgerBackend) setKKValue(prefix, suffix, value []byte) {
 	}
 }
 
-func (self *badgerBackend) delete(k []byte) error {
-	return self.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete(k)
+func (self *badgerBackend) update(fn func(txn *badger.Txn) error) error {
+	err := self.RetryWrite(func() error {
+		return self.db.Update(fn)
 	})
+	storage.PanicIfNoSpace(err)
+	return err
 }
 
 func (self *badgerBackend) set(k, v []byte) error {
-	return self.db.Update(func(txn *badger.Txn) error {
+	return self.update(func(txn *badger.Txn) error {
 		return txn.Set(k, v)
 	})
 }
@@ -169,24 +314,61 @@ func (self *badgerBackend) SetNameToBlockId(name, block_id string) {
 	self.setKKValue([]byte("3"), []byte(name), []byte(block_id))
 }
 
+func (self *badgerBackend) SetNamesToBlockIds(names map[string]string) {
+	mlog.Printf2("storage/badger/badger", "bad.SetNamesToBlockIds %d names", len(names))
+	err := self.update(func(txn *badger.Txn) error {
+		for k, v := range names {
+			err := txn.Set(append([]byte("3"), k...), []byte(v))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic("set", err)
+	}
+}
+
 func (self *badgerBackend) StoreBlock(b *storage.Block) {
-	data := *b.Data.Get()
-	mlog.Printf2("storage/badger/badger", "bad.StoreBlock %x (%d b)", b.Id, len(data))
-	self.updateBlock(b)
-	self.setKKValue([]byte("2"), []byte(b.Id), data)
+	data := b.Data.Get()
+	mlog.Printf2("storage/badger/badger", "bad.StoreBlock %x (%d b)", b.Id, len(*data))
+	self.updateBlock(b, data)
 }
 
-func (self *badgerBackend) updateBlock(b *storage.Block) {
+// updateBlock writes the metadata (and the data, if given) of the
+// block, and updates the status index, in one transaction.
+func (self *badgerBackend) updateBlock(b *storage.Block, data *[]byte) {
 	buf, err := b.BlockMetadata.MarshalMsg(nil)
 	if err != nil {
 		log.Panic(err)
 	}
-	self.setKKValue([]byte("1"), []byte(b.Id), buf)
+	err = self.update(func(txn *badger.Txn) error {
+		if err := setStatus(txn, b.Id, b.Status); err != nil {
+			return err
+		}
+		if err := txn.Set(append([]byte("1"), []byte(b.Id)...), buf); err != nil {
+			return err
+		}
+		if data == nil {
+			return nil
+		}
+		return txn.Set(append([]byte("2"), []byte(b.Id)...), *data)
+	})
+	if err != nil {
+		log.Panic("set", err)
+	}
+}
+
+func (self *badgerBackend) ReplaceBlock(b *storage.Block) {
+	data := b.Data.Get()
+	mlog.Printf2("storage/badger/badger", "bad.ReplaceBlock %x (%d b)", b.Id, len(*data))
+	self.updateBlock(b, data)
 }
 
 func (self *badgerBackend) UpdateBlock(b *storage.Block) int {
 	mlog.Printf2("storage/badger/badger", "bad.UpdateBlock %x", b.Id)
-	self.updateBlock(b)
+	self.updateBlock(b, nil)
 	return 1
 }
 
@@ -0,0 +1,51 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Sat Apr 21 10:02:15 2018 mstenber
+ * Last modified: Sat Apr 21 10:14:40 2018 mstenber
+ * Edit time:     12 min
+ *
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/stvp/assert"
+)
+
+func TestStaleStatusIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "badger")
+	defer os.RemoveAll(dir)
+	be := NewBadgerBackend().(*badgerBackend)
+	be.Init(storage.BackendConfiguration{Directory: dir})
+	defer be.Close()
+
+	b := &storage.Block{Id: "id",
+		BlockMetadata: storage.BlockMetadata{RefCount: 1,
+			Status: storage.BS_NORMAL}}
+	data := []byte("data")
+	b.Data.Set(&data)
+	be.StoreBlock(b)
+
+	// Index entry that does not match the metadata is ignored
+	assert.Nil(t, be.set(statusKey("id", storage.BS_WEAK), nil))
+	count := func(status storage.BlockStatus) (n int) {
+		be.IterateBlocksWithStatus(status, func(b *storage.Block) {
+			n++
+		})
+		return
+	}
+	assert.Equal(t, count(storage.BS_WEAK), 0)
+	assert.Equal(t, count(storage.BS_NORMAL), 1)
+
+	be.DeleteBlock(be.GetBlockById("id"))
+	assert.Equal(t, count(storage.BS_NORMAL), 0)
+	assert.True(t, be.GetBlockData(b) == nil)
+}
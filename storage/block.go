@@ -64,6 +64,10 @@ type Block struct {
 
 	// TBD: would flags be better?
 	haveDiskRefs, haveStorageRefs bool
+
+	// pendingSize is the number of bytes of data not yet stored
+	// in the backend (counted in Storage pendingBytes)
+	pendingSize int
 }
 
 func (self *Block) copy() *Block {
@@ -83,11 +87,9 @@ func (self *Block) GetData() []byte {
 			b := self.Backend.GetBlockData(self)
 			self.Data.Set(&b)
 		} else {
-			mlog.Printf2("storage/block", "%v.GetData - calling s.be.GetBlockData", self)
-			data := self.storage.Backend.GetBlockData(self)
+			mlog.Printf2("storage/block", "%v.GetData - calling s.getBlockData", self)
+			data := self.storage.getBlockData(self)
 			self.Data.Set(&data)
-			self.storage.counters[C_READ].AddInt(1)
-			self.storage.counters[C_READBYTES].AddInt(len(data))
 		}
 	}
 	return *self.Data.Get()
@@ -110,6 +112,9 @@ func (self *Block) flush() int {
 	if self.Stored == nil {
 		log.Panicf("self.Stored not set?!?")
 	}
+	if self.RefCount < 0 {
+		log.Panicf("RefCount below 0 for %x", self.Id)
+	}
 	ops := 0
 	hadRefs := self.Backend != nil && self.Stored.RefCount != 0
 	if self.RefCount == 0 {
@@ -129,6 +134,7 @@ func (self *Block) flush() int {
 		self.storage.counters[C_WRITEBYTES].AddInt(len(data))
 		self.storage.Backend.StoreBlock(self)
 		self.Backend = self.storage.Backend
+		self.clearPending()
 		ops++
 	} else {
 		ops += self.storage.Backend.UpdateBlock(self)
@@ -145,7 +151,7 @@ func (self *Block) flush() int {
 		}
 	}
 	self.Stored = nil
-	delete(self.storage.dirtyBlocks, self)
+	delete(self.shard().dirtyBlocks, self)
 
 	self.addStorageRefCount(-1)
 	return ops
@@ -158,9 +164,9 @@ func (self *Block) addRefCount(count int32) {
 	mlog.Printf2("storage/block", "%v.addRefCount %v", self, count)
 	self.markDirty()
 	self.RefCount += count
-	if self.RefCount < 0 {
-		log.Panicf("RefCount below 0 for %x", self.Id)
-	}
+	// As operations on different blocks are run in parallel, the
+	// reference counts may be transiently below zero; they are
+	// checked when flushing.
 	if self.RefCount == 0 {
 		// Ensure we have at least in-memory references to dependencies
 		self.shouldHaveStorageDependencies(true)
@@ -170,23 +176,28 @@ func (self *Block) addRefCount(count int32) {
 func (self *Block) addStorageRefCount(v int32) {
 	mlog.Printf2("storage/block", "%v.addStorageRefCount %v", self, v)
 	self.storageRefCount += v
+	sh := self.shard()
 	switch rc := self.storageRefCount; {
-	case rc < 0:
-		log.Panic("Negative reference count", rc)
-	case rc == 0:
-		self.storage.dirtyStorageRefBlocks[self] = true
+	case rc <= 0:
+		// (may be transiently negative, see addRefCount)
+		sh.dirtyStorageRefBlocks[self] = true
 	default:
 		if (self.RefCount == 0) != self.haveStorageRefs {
-			self.storage.dirtyStorageRefBlocks[self] = true
+			sh.dirtyStorageRefBlocks[self] = true
 		}
 	}
 }
 
 func (self *Block) flushStorageRef() int {
-	delete(self.storage.dirtyStorageRefBlocks, self)
+	sh := self.shard()
+	delete(sh.dirtyStorageRefBlocks, self)
+	if self.storageRefCount < 0 {
+		log.Panic("Negative reference count", self.storageRefCount)
+	}
 	if self.storageRefCount == 0 {
 		self.shouldHaveStorageDependencies(false)
-		delete(self.storage.blocks, self.Id)
+		self.clearPending()
+		delete(sh.blocks, self.Id)
 		return 1
 	}
 	if self.shouldHaveStorageDependencies(self.RefCount == 0) {
@@ -195,6 +206,13 @@ func (self *Block) flushStorageRef() int {
 	return 0
 }
 
+func (self *Block) clearPending() {
+	if self.pendingSize > 0 {
+		self.storage.pendingBytes.AddInt(-self.pendingSize)
+		self.pendingSize = 0
+	}
+}
+
 func (self *Block) addExternalStorageRefCount(v int32) int32 {
 	mlog.Printf2("storage/block", "%v.addExternalStorageRefCount %v", self, v)
 	nv := atomic.AddInt32(&self.externalStorageRefCount, v)
@@ -213,7 +231,7 @@ func (self *Block) markDirty() {
 	self.addStorageRefCount(1)
 	self.Stored = &BlockMetadata{Status: self.Status,
 		RefCount: self.RefCount}
-	self.storage.dirtyBlocks[self] = true
+	self.shard().dirtyBlocks[self] = true
 }
 
 func (self *Block) setStatus(st BlockStatus) bool {
@@ -221,35 +239,11 @@ func (self *Block) setStatus(st BlockStatus) bool {
 		return true
 	}
 	mlog.Printf2("storage/block", "%v.setStatus = %v", self, st)
-	// Check if the status transition is actually POSSIBLE first
+	// The caller has ensured that the status transition is
+	// actually POSSIBLE (dependencies exist, if we need them)
 	shouldHaveDeps := st < BS_WANT_NORMAL
 	hadDeps := self.Status < BS_WANT_NORMAL
 	changingDeps := shouldHaveDeps != hadDeps
-	if changingDeps && shouldHaveDeps {
-		refs := make([]*Block, 0)
-		cleanrefs := func() {
-			for _, b := range refs {
-				b.addStorageRefCount(0)
-			}
-		}
-		defer cleanrefs()
-		possible := true
-		self.iterateReferences(func(id string) {
-			if !possible {
-				return
-			}
-			b := self.storage.getBlockById(id)
-			if b == nil {
-				possible = false
-				return
-			}
-			refs = append(refs, b)
-		})
-
-		if !possible {
-			return false
-		}
-	}
 
 	self.markDirty()
 	if changingDeps {
@@ -283,25 +277,26 @@ func (self *Block) setDependencies(add, storage bool, st BlockStatus) {
 		return
 	}
 	self.iterateReferences(func(id string) {
-		b := self.storage.getBlockById(id)
-		if b == nil {
-			log.Panicf("Block %x awol in updateBlockDataDependencies", id)
-		}
-		if storage {
-			if add {
-				b.addStorageRefCount(1)
-			} else {
-				b.addStorageRefCount(-1)
+		self.later(id, func(b *Block) {
+			if b == nil {
+				log.Panicf("Block %x awol in updateBlockDataDependencies", id)
 			}
+			if storage {
+				if add {
+					b.addStorageRefCount(1)
+				} else {
+					b.addStorageRefCount(-1)
+				}
 
-		} else {
-			if add {
-				b.addRefCount(1)
 			} else {
-				b.addRefCount(-1)
-			}
+				if add {
+					b.addRefCount(1)
+				} else {
+					b.addRefCount(-1)
+				}
 
-		}
+			}
+		})
 	})
 }
 
@@ -332,9 +327,13 @@ func (self *Block) iterateReferences(cb func(id string)) {
 	}
 	if self.deps == nil {
 		self.deps = &util.StringList{}
-		self.storage.IterateReferencesCallback(self.Id, self.GetData(), func(id string) {
-			self.deps.PushFront(id)
-		})
+		// Evicted blocks (see EvictBlock) have no references,
+		// and their data is not here anyway
+		if self.Status != BS_MISSING {
+			self.storage.IterateReferencesCallback(self.Id, self.GetData(), func(id string) {
+				self.deps.PushFront(id)
+			})
+		}
 	}
 	self.deps.Iterate(cb)
 }
@@ -347,10 +346,12 @@ func (self *Block) shouldHaveDiskDependencies(value bool) bool {
 	return self.updateDependencies(value, false, nil)
 }
 
-// getBlockById returns Block (if any) that matches id.
+// getBlockById returns Block (if any) that matches id. The lock of
+// the shard of the id MUST be held.
 func (self *Storage) getBlockById(id string) *Block {
 	mlog.Printf2("storage/block", "st.getBlockById %x", id)
-	b, ok := self.blocks[id]
+	sh := self.shardFor(id)
+	b, ok := sh.blocks[id]
 	if !ok {
 		b = self.Backend.GetBlockById(id)
 		if b == nil {
@@ -363,7 +364,7 @@ func (self *Storage) getBlockById(id string) *Block {
 		b.haveDiskRefs = true
 		b.haveStorageRefs = false
 		b.Stored = nil
-		self.blocks[id] = b
+		sh.blocks[id] = b
 	}
 	return b
 }
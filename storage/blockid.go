@@ -0,0 +1,112 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Mon Apr  2 10:12:06 2018 mstenber
+ * Last modified: Mon Apr  2 11:40:52 2018 mstenber
+ * Edit time:     64 min
+ *
+ */
+
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"errors"
+	"hash"
+
+	"github.com/minio/sha256-simd"
+	"lukechampine.com/blake3"
+)
+
+// HashType describes how block ids are calculated from block
+// data. Block ids are tagged with the type of the hash (first byte),
+// except for legacy ones which are plain SHA256 hashes.
+type HashType byte
+
+const (
+	// Legacy untagged SHA256
+	HashType_UNSET HashType = iota
+
+	HashType_SHA256
+
+	HashType_SHA512_256
+
+	HashType_BLAKE3
+
+	numHashTypes
+)
+
+// Length of the (untagged) hashes; all of the supported ones are
+// 256 bits long.
+const hashSize = 32
+
+var ErrUnknownHash = errors.New("Unknown hash")
+
+var hashNames = map[string]HashType{
+	"sha256":     HashType_SHA256,
+	"sha512-256": HashType_SHA512_256,
+	"blake3":     HashType_BLAKE3,
+}
+
+// HashNames returns the names of supported hashes.
+func HashNames() []string {
+	keys := make([]string, 0, len(hashNames))
+	for k, _ := range hashNames {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// HashTypeByName returns the HashType matching the name (see
+// HashNames).
+func HashTypeByName(name string) (HashType, error) {
+	t, ok := hashNames[name]
+	if !ok {
+		return HashType_UNSET, ErrUnknownHash
+	}
+	return t, nil
+}
+
+func (self HashType) new() hash.Hash {
+	switch self {
+	case HashType_SHA512_256:
+		return sha512.New512_256()
+	case HashType_BLAKE3:
+		return blake3.New(hashSize, nil)
+	}
+	return sha256.New()
+}
+
+// BlockId returns the id of the data. If key is set, HMAC with the
+// hash is used instead of the plain hash.
+func (self HashType) BlockId(key, data []byte) string {
+	var h hash.Hash
+	if key != nil {
+		h = hmac.New(self.new, key)
+	} else {
+		h = self.new()
+	}
+	b := make([]byte, 0, hashSize+1)
+	if self != HashType_UNSET {
+		b = append(b, byte(self))
+	}
+	h.Write(data)
+	return string(h.Sum(b))
+}
+
+// BlockIdHashType returns the hash type used to calculate the id.
+func BlockIdHashType(id string) (HashType, error) {
+	switch len(id) {
+	case hashSize:
+		return HashType_UNSET, nil
+	case hashSize + 1:
+		ht := HashType(id[0])
+		if ht != HashType_UNSET && ht < numHashTypes {
+			return ht, nil
+		}
+	}
+	return HashType_UNSET, ErrUnknownHash
+}
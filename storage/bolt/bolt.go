@@ -12,6 +12,7 @@
 package bolt
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 
@@ -24,12 +25,14 @@ import (
 var metadataKey = []byte("key")
 var dataKey = []byte("data")
 var nameKey = []byte("name")
+var statusKey = []byte("status")
 
 // boltBackend provides on-disk storage.
 //
 // - key prefix 1 + block id -> metadata
 // - key prefix 2 + block id -> data (essentially immutable)
 // - key prefix 3 + name -> block id
+// - status bucket: status + block id -> nothing (status index)
 type boltBackend struct {
 	storage.DirectoryBackendBase
 
@@ -65,13 +68,68 @@ func (self *boltBackend) Init(config storage.BackendConfiguration) {
 		if err != nil {
 			log.Panic(err)
 		}
-		return nil
+		if tx.Bucket(statusKey) != nil {
+			return nil
+		}
+		// Storage created without status index; populate it
+		sb, err := tx.CreateBucket(statusKey)
+		if err != nil {
+			log.Panic(err)
+		}
+		return tx.Bucket(metadataKey).ForEach(func(k, v []byte) error {
+			var meta storage.BlockMetadata
+			_, err := meta.UnmarshalMsg(v)
+			if err != nil {
+				log.Panic(err)
+			}
+			if meta.Status != storage.BS_UNSET {
+				sb.Put(statusIndexKey(string(k), meta.Status), []byte{})
+			}
+			return nil
+		})
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 }
 
+func statusIndexKey(id string, status storage.BlockStatus) []byte {
+	return append([]byte{byte(status)}, []byte(id)...)
+}
+
+// setStatus updates the status index within the transaction;
+// BS_UNSET is used for blocks that do not exist.
+func setStatus(tx *bbolt.Tx, id string, status storage.BlockStatus) {
+	bid := []byte(id)
+	sb := tx.Bucket(statusKey)
+	if v := tx.Bucket(metadataKey).Get(bid); v != nil {
+		var meta storage.BlockMetadata
+		_, err := meta.UnmarshalMsg(v)
+		if err != nil {
+			log.Panic(err)
+		}
+		if meta.Status == status {
+			return
+		}
+		sb.Delete(statusIndexKey(id, meta.Status))
+	}
+	if status != storage.BS_UNSET {
+		sb.Put(statusIndexKey(id, status), []byte{})
+	}
+}
+
+// update runs fn in a read-write transaction, retrying it if the
+// disk is full.
+func (self *boltBackend) update(fn func(tx *bbolt.Tx) error) {
+	err := self.RetryWrite(func() error {
+		return self.db.Update(fn)
+	})
+	storage.PanicIfNoSpace(err)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
 func (self *boltBackend) Flush() {
 
 }
@@ -82,7 +140,8 @@ func (self *boltBackend) Close() {
 func (self *boltBackend) DeleteBlock(b *storage.Block) {
 	mlog.Printf2("storage/bolt/bolt", "bbolt.DeleteBlock %x", b.Id)
 	bid := []byte(b.Id)
-	self.db.Update(func(tx *bbolt.Tx) error {
+	self.update(func(tx *bbolt.Tx) error {
+		setStatus(tx, b.Id, storage.BS_UNSET)
 		tx.Bucket(metadataKey).Delete(bid)
 		tx.Bucket(dataKey).Delete(bid)
 		return nil
@@ -103,6 +162,48 @@ func (self *boltBackend) GetBlockData(b *storage.Block) (v []byte) {
 	return
 }
 
+func (self *boltBackend) IterateBlocks(cb func(b *storage.Block)) {
+	// Gather the blocks first; the callback may want to read
+	// more stuff, and nested transactions are not a good idea
+	blocks := make([]*storage.Block, 0)
+	self.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(metadataKey).ForEach(func(k, v []byte) error {
+			b := &storage.Block{Id: string(k), Backend: self}
+			_, err := b.BlockMetadata.UnmarshalMsg(v)
+			if err != nil {
+				log.Panic(err)
+			}
+			blocks = append(blocks, b)
+			return nil
+		})
+	})
+	for _, b := range blocks {
+		cb(b)
+	}
+}
+
+func (self *boltBackend) IterateBlocksWithStatus(status storage.BlockStatus, cb func(b *storage.Block)) {
+	blocks := make([]*storage.Block, 0)
+	prefix := statusIndexKey("", status)
+	self.db.View(func(tx *bbolt.Tx) error {
+		mb := tx.Bucket(metadataKey)
+		c := tx.Bucket(statusKey).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			id := k[len(prefix):]
+			b := &storage.Block{Id: string(id), Backend: self}
+			_, err := b.BlockMetadata.UnmarshalMsg(mb.Get(id))
+			if err != nil {
+				log.Panic(err)
+			}
+			blocks = append(blocks, b)
+		}
+		return nil
+	})
+	for _, b := range blocks {
+		cb(b)
+	}
+}
+
 func (self *boltBackend) GetBlockById(id string) *storage.Block {
 	bid := []byte(id)
 	var bv []byte
@@ -130,9 +231,45 @@ func (self *boltBackend) GetBlockIdByName(name string) (s string) {
 	return
 }
 
+func (self *boltBackend) IterateNames(cb func(name, block_id string)) {
+	names := make(map[string]string)
+	self.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(nameKey).ForEach(func(k, v []byte) error {
+			if len(v) > 0 {
+				names[string(k)] = string(v)
+			}
+			return nil
+		})
+	})
+	for k, v := range names {
+		cb(k, v)
+	}
+}
+
+// setName sets (or with empty block_id, removes) the name.
+func setName(b *bbolt.Bucket, name, block_id string) error {
+	if block_id == "" {
+		return b.Delete([]byte(name))
+	}
+	return b.Put([]byte(name), []byte(block_id))
+}
+
 func (self *boltBackend) SetNameToBlockId(name, block_id string) {
-	self.db.Update(func(tx *bbolt.Tx) error {
-		tx.Bucket(nameKey).Put([]byte(name), []byte(block_id))
+	self.update(func(tx *bbolt.Tx) error {
+		return setName(tx.Bucket(nameKey), name, block_id)
+	})
+	return
+}
+
+func (self *boltBackend) SetNamesToBlockIds(names map[string]string) {
+	self.update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(nameKey)
+		for k, v := range names {
+			err := setName(b, k, v)
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	return
@@ -146,7 +283,7 @@ func (self *boltBackend) StoreBlock(b *storage.Block) {
 	bid := []byte(b.Id)
 	mlog.Printf2("storage/bolt/bolt", "bbolt.StoreBlock %x (%d b)", bid, len(*data))
 	self.updateBlock(b)
-	self.db.Update(func(tx *bbolt.Tx) error {
+	self.update(func(tx *bbolt.Tx) error {
 		tx.Bucket(dataKey).Put(bid, *data)
 		return nil
 	})
@@ -158,12 +295,35 @@ func (self *boltBackend) updateBlock(b *storage.Block) {
 		log.Panic(err)
 	}
 	bid := []byte(b.Id)
-	self.db.Update(func(tx *bbolt.Tx) error {
+	self.update(func(tx *bbolt.Tx) error {
+		setStatus(tx, b.Id, b.Status)
 		tx.Bucket(metadataKey).Put(bid, buf)
 		return nil
 	})
 }
 
+// ReplaceBlock replaces both the metadata and the data of the block
+// within single transaction.
+func (self *boltBackend) ReplaceBlock(b *storage.Block) {
+	mlog.Printf2("storage/bolt/bolt", "bbolt.ReplaceBlock %x", b.Id)
+	buf, err := b.BlockMetadata.MarshalMsg(nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	bid := []byte(b.Id)
+	self.update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(metadataKey).Get(bid) == nil {
+			log.Panic("Non-existent block id in ReplaceBlock")
+		}
+		setStatus(tx, b.Id, b.Status)
+		err := tx.Bucket(metadataKey).Put(bid, buf)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(dataKey).Put(bid, *b.Data.Get())
+	})
+}
+
 func (self *boltBackend) UpdateBlock(b *storage.Block) int {
 	mlog.Printf2("storage/bolt/bolt", "bbolt.UpdateBlock %x", b.Id)
 	self.updateBlock(b)
@@ -35,6 +35,22 @@ func (self *codecBackend) GetBlockById(id string) *Block {
 	return &nb
 }
 
+func (self *codecBackend) IterateBlocks(cb func(b *Block)) {
+	self.Backend.IterateBlocks(func(b *Block) {
+		b.Backend = self
+		b.Data.Set(nil)
+		cb(b)
+	})
+}
+
+func (self *codecBackend) IterateBlocksWithStatus(status BlockStatus, cb func(b *Block)) {
+	self.Backend.IterateBlocksWithStatus(status, func(b *Block) {
+		b.Backend = self
+		b.Data.Set(nil)
+		cb(b)
+	})
+}
+
 func (self *codecBackend) GetBlockData(bl *Block) []byte {
 	data := self.Backend.GetBlockData(bl)
 	b, err := self.Codec.DecodeBytes(data, []byte(bl.Id))
@@ -44,7 +60,7 @@ func (self *codecBackend) GetBlockData(bl *Block) []byte {
 	return b
 }
 
-func (self *codecBackend) StoreBlock(bl *Block) {
+func (self *codecBackend) encodeBlock(bl *Block) *Block {
 	dp := bl.Data.Get()
 	b, err := self.Codec.EncodeBytes(*dp, []byte(bl.Id))
 	if err != nil {
@@ -52,5 +68,13 @@ func (self *codecBackend) StoreBlock(bl *Block) {
 	}
 	bl2 := *bl
 	bl2.Data.Set(&b)
-	self.Backend.StoreBlock(&bl2)
+	return &bl2
+}
+
+func (self *codecBackend) StoreBlock(bl *Block) {
+	self.Backend.StoreBlock(self.encodeBlock(bl))
+}
+
+func (self *codecBackend) ReplaceBlock(bl *Block) {
+	self.Backend.ReplaceBlock(self.encodeBlock(bl))
 }
@@ -12,9 +12,12 @@
 package storage
 
 import (
+	"errors"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -66,6 +69,10 @@ type DirectoryBackendBase struct {
 	BackendConfiguration
 
 	available, used delayedUInt64Value
+
+	// noSpace is set (atomically) while writes are failing
+	// due to disk being full
+	noSpace int32
 }
 
 func (self *DirectoryBackendBase) Init(config BackendConfiguration) {
@@ -80,7 +87,15 @@ func (self *DirectoryBackendBase) Init(config BackendConfiguration) {
 		callback: func() uint64 { return calculateUsed(self.Directory) }}
 }
 
+// InMemoryBytesAvailable is what backends without directory (that
+// keep their data in memory) claim to have available; memory is
+// assumed to run out elsewhere first.
+const InMemoryBytesAvailable = 1 << 40
+
 func calculateAvailable(dir string) uint64 {
+	if dir == "" {
+		return InMemoryBytesAvailable
+	}
 	var st syscall.Statfs_t
 	err := syscall.Statfs(dir, &st)
 	if err != nil {
@@ -101,7 +116,85 @@ func calculateUsed(dir string) (sum uint64) {
 	return sum
 }
 
+// NoSpaceRetryInterval is how long RetryWrite waits before retrying
+// write that failed due to lack of disk space.
+var NoSpaceRetryInterval = time.Second
+
+// NoSpaceRetries is how many times RetryWrite retries write that
+// failed due to lack of disk space before giving up.
+var NoSpaceRetries = 10
+
+// ErrNoSpace is returned by RetryWrite if the disk stays full.
+var ErrNoSpace = errors.New("out of disk space")
+
+// PanicIfNoSpace panics with ErrNoSpace if err is it. Backends use
+// it (instead of log.Panic) so that Storage can recover from the
+// panic, and keep the write to be retried later.
+func PanicIfNoSpace(err error) {
+	if err == ErrNoSpace {
+		panic(err)
+	}
+}
+
+// IsNoSpace returns true if the error (or the error it wraps) is
+// ENOSPC.
+func IsNoSpace(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *os.PathError:
+			err = e.Err
+		case *os.LinkError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case interface{ Cause() error }:
+			c := e.Cause()
+			if c == err {
+				return false
+			}
+			err = c
+		default:
+			return err == syscall.ENOSPC
+		}
+	}
+	return false
+}
+
+// RetryWrite calls op until it does not fail due to lack of disk
+// space, and returns its result; if it keeps on failing
+// NoSpaceRetries times, ErrNoSpace is returned instead. While the
+// disk is full, the backend claims to have no bytes available so
+// that Storage.HasSpace rejects new writes.
+func (self *DirectoryBackendBase) RetryWrite(op func() error) error {
+	for i := 0; ; i++ {
+		err := op()
+		if !IsNoSpace(err) {
+			if self.IsOutOfSpace() {
+				mlog.Printf2("storage/directory", "ba.RetryWrite recovered")
+				atomic.StoreInt32(&self.noSpace, 0)
+			}
+			return err
+		}
+		if atomic.SwapInt32(&self.noSpace, 1) == 0 {
+			log.Printf("Out of space in %s, retrying writes", self.Directory)
+		}
+		if i >= NoSpaceRetries {
+			return ErrNoSpace
+		}
+		time.Sleep(NoSpaceRetryInterval)
+	}
+}
+
+// IsOutOfSpace returns true if the last write failed due to lack of
+// disk space.
+func (self *DirectoryBackendBase) IsOutOfSpace() bool {
+	return atomic.LoadInt32(&self.noSpace) != 0
+}
+
 func (self *DirectoryBackendBase) GetBytesAvailable() uint64 {
+	if self.IsOutOfSpace() {
+		return 0
+	}
 	return self.available.Value()
 }
 
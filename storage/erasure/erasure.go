@@ -0,0 +1,500 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Fri Apr 13 09:12:55 2018 mstenber
+ * Last modified: Fri Apr 13 12:41:30 2018 mstenber
+ * Edit time:     149 min
+ *
+ */
+
+// erasure package provides backend which splits every block to
+// Reed-Solomon coded shards stored in separate directories.
+package erasure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/file"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/klauspost/reedsolomon"
+)
+
+// erasureBackend splits every block to dataShards data shards, and
+// adds parityShards parity shards to them; shard i is stored (by
+// file backend) in subdirectory shard<i> of the directory. Those can
+// be e.g. symlinks to different disks. Blocks can be read as long as
+// at most parityShards of the directories are missing (or their
+// copies of the block are corrupt); missing directory can be
+// replaced, and then filled with RebuildShard.
+//
+// Shard encoding:
+//
+// - the block data is prefixed with its length (4 bytes) before
+// splitting, as shards are padded to same size
+//
+// - every shard is prefixed with its CRC32 (4 bytes) so that corrupt
+// shards can be treated as missing.
+//
+// Names are stored in (erasure coded) name blocks (see
+// storage.GenerationNameBackend).
+type erasureBackend struct {
+	storage.BackendConfiguration
+	storage.GenerationNameBackend
+	dataShards, parityShards int
+	enc                      reedsolomon.Encoder
+
+	// shards contains the backend of every shard directory; it
+	// is nil for missing ones
+	shards []storage.Backend
+
+	replaceLock util.MutexLocked
+}
+
+var _ storage.Backend = &erasureBackend{}
+
+var ErrNotErasure = errors.New("not erasure coded backend")
+
+func NewErasureBackend(dataShards, parityShards int) storage.Backend {
+	self := &erasureBackend{dataShards: dataShards,
+		parityShards: parityShards}
+	return self
+}
+
+func (self *erasureBackend) shardDirectory(i int) string {
+	return filepath.Join(self.Directory, fmt.Sprintf("shard%d", i))
+}
+
+func (self *erasureBackend) openShard(i int) {
+	config := self.BackendConfiguration
+	config.Directory = self.shardDirectory(i)
+	config.Codec = nil
+	be := file.NewFileBackend()
+	be.Init(config)
+	self.shards[i] = be
+}
+
+func (self *erasureBackend) Init(config storage.BackendConfiguration) {
+	self.BackendConfiguration = config
+	if self.Directory == "" {
+		log.Panic("erasure backend requires directory")
+	}
+	enc, err := reedsolomon.New(self.dataShards, self.parityShards)
+	if err != nil {
+		log.Panic(err)
+	}
+	self.enc = enc
+	n := self.dataShards + self.parityShards
+	self.shards = make([]storage.Backend, n)
+	exists := make([]bool, n)
+	missing := n
+	for i := range exists {
+		_, err := os.Stat(self.shardDirectory(i))
+		exists[i] = err == nil
+		if exists[i] {
+			missing--
+		}
+	}
+	if missing == n {
+		// New storage
+		for i := range exists {
+			err = os.MkdirAll(self.shardDirectory(i), 0700)
+			if err != nil {
+				log.Panic(err)
+			}
+			exists[i] = true
+		}
+	} else if missing > self.parityShards {
+		log.Panicf("%d of %d shard directories missing", missing, n)
+	}
+	for i, ok := range exists {
+		if ok {
+			self.openShard(i)
+		} else {
+			log.Printf("erasure: shard directory %s missing", self.shardDirectory(i))
+		}
+	}
+	self.finishReplace()
+	self.GenerationNameBackend.Init("names", self)
+}
+
+// lookupShards returns the shard backends that are enough to find
+// every block (as only parityShards may lack it).
+func (self *erasureBackend) lookupShards() []storage.Backend {
+	r := make([]storage.Backend, 0, self.parityShards+1)
+	for _, be := range self.shards {
+		if be != nil {
+			r = append(r, be)
+			if len(r) > self.parityShards {
+				break
+			}
+		}
+	}
+	return r
+}
+
+// recoverShard recovers from failed I/O (panic) of shard i of the
+// block, so that the shard can be treated as missing. Running out
+// of space is passed on, as Storage handles it (see
+// storage.PanicIfNoSpace). It MUST be deferred directly.
+func (self *erasureBackend) recoverShard(i int, id string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if r == storage.ErrNoSpace {
+		panic(r)
+	}
+	log.Printf("erasure: shard %d of %x failed: %v", i, id, r)
+}
+
+// shardData returns the valid shard i of the block, or nil.
+func (self *erasureBackend) shardData(i int, id string) (shard []byte) {
+	defer self.recoverShard(i, id)
+	be := self.shards[i]
+	if be == nil {
+		return nil
+	}
+	b := be.GetBlockById(id)
+	if b == nil {
+		return nil
+	}
+	data := be.GetBlockData(b)
+	if len(data) < 4 || crc32.ChecksumIEEE(data[4:]) != binary.BigEndian.Uint32(data) {
+		mlog.Printf2("storage/erasure/erasure", " invalid shard %d of %x", i, id)
+		return nil
+	}
+	return data[4:]
+}
+
+func (self *erasureBackend) haveDataShards(shards [][]byte) bool {
+	for _, shard := range shards[:self.dataShards] {
+		if shard == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// readShards returns the shards of the block; if all is set, missing
+// parity shards are reconstructed too.
+func (self *erasureBackend) readShards(id string, all bool) [][]byte {
+	shards := make([][]byte, len(self.shards))
+	have := 0
+	for i := range shards {
+		if !all && have == self.dataShards {
+			break
+		}
+		shards[i] = self.shardData(i, id)
+		if shards[i] != nil {
+			have++
+		}
+	}
+	if have < self.dataShards {
+		log.Panicf("block %x has only %d of %d required shards", id, have, self.dataShards)
+	}
+	if have == len(shards) || (!all && self.haveDataShards(shards)) {
+		return shards
+	}
+	var err error
+	if all {
+		err = self.enc.Reconstruct(shards)
+	} else {
+		err = self.enc.ReconstructData(shards)
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	return shards
+}
+
+func (self *erasureBackend) GetBlockData(b *storage.Block) []byte {
+	shards := self.readShards(b.Id, false)
+	var buf bytes.Buffer
+	err := self.enc.Join(&buf, shards, len(shards[0])*self.dataShards)
+	if err != nil {
+		log.Panic(err)
+	}
+	data := buf.Bytes()
+	l := int(binary.BigEndian.Uint32(data))
+	if l > len(data)-4 {
+		log.Panicf("invalid length %d in block %x", l, b.Id)
+	}
+	return data[4 : 4+l]
+}
+
+func (self *erasureBackend) GetBlockById(id string) *storage.Block {
+	for _, be := range self.lookupShards() {
+		b := be.GetBlockById(id)
+		if b != nil {
+			b.Backend = self
+			return b
+		}
+	}
+	return nil
+}
+
+// storeShard stores shard data of the block in backend of shard,
+// replacing the existing shard (if any).
+// storeShard stores shard i of the block. The return value is false
+// if it failed.
+func (self *erasureBackend) storeShard(i int, b *storage.Block, shard []byte) (ok bool) {
+	defer self.recoverShard(i, b.Id)
+	be := self.shards[i]
+	data := make([]byte, 4+len(shard))
+	binary.BigEndian.PutUint32(data, crc32.ChecksumIEEE(shard))
+	copy(data[4:], shard)
+	nb := &storage.Block{Id: b.Id, BlockMetadata: b.BlockMetadata}
+	nb.Data.Set(&data)
+	if be.GetBlockById(b.Id) != nil {
+		be.ReplaceBlock(nb)
+	} else {
+		be.StoreBlock(nb)
+	}
+	return true
+}
+
+// storeShards splits the block to shards, and stores them. Failing
+// shards are treated as missing, as long as the block can be still
+// read.
+func (self *erasureBackend) storeShards(b *storage.Block) {
+	data := *b.Data.Get()
+	payload := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(payload, uint32(len(data)))
+	copy(payload[4:], data)
+	shards, err := self.enc.Split(payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = self.enc.Encode(shards)
+	if err != nil {
+		log.Panic(err)
+	}
+	failed := 0
+	for i, be := range self.shards {
+		if be == nil || !self.storeShard(i, b, shards[i]) {
+			failed++
+		}
+	}
+	if failed > self.parityShards {
+		log.Panicf("erasure: storing %d of %d shards of %x failed",
+			failed, len(shards), b.Id)
+	}
+}
+
+func (self *erasureBackend) StoreBlock(b *storage.Block) {
+	mlog.Printf2("storage/erasure/erasure", "eb.StoreBlock %x", b.Id)
+	self.storeShards(b)
+}
+
+// replaceId is the (backend-internal) block which contains the new
+// version of the block being replaced.
+const replaceId = "replace"
+
+// ReplaceBlock stores the new version of the block as replaceId
+// before replacing the shards of the block one by one, as the shards
+// of the old and the new version cannot be mixed. If that is
+// interrupted, Init finishes the job.
+//
+// replaceId block contains the reference count (4 bytes), status
+// (4 bytes), length of the id (4 bytes) and the id of the block,
+// followed by its data.
+func (self *erasureBackend) ReplaceBlock(b *storage.Block) {
+	mlog.Printf2("storage/erasure/erasure", "eb.ReplaceBlock %x", b.Id)
+	defer self.replaceLock.Locked()()
+	data := *b.Data.Get()
+	rdata := make([]byte, 12+len(b.Id)+len(data))
+	binary.BigEndian.PutUint32(rdata, uint32(b.RefCount))
+	binary.BigEndian.PutUint32(rdata[4:], uint32(b.Status))
+	binary.BigEndian.PutUint32(rdata[8:], uint32(len(b.Id)))
+	copy(rdata[12:], b.Id)
+	copy(rdata[12+len(b.Id):], data)
+	rb := &storage.Block{Id: replaceId}
+	rb.Data.Set(&rdata)
+	self.storeShards(rb)
+	self.storeShards(b)
+	self.DeleteBlock(rb)
+}
+
+// finishReplace completes ReplaceBlock that was interrupted.
+func (self *erasureBackend) finishReplace() {
+	if self.GetBlockById(replaceId) == nil {
+		return
+	}
+	have := 0
+	for i := range self.shards {
+		if self.shardData(i, replaceId) != nil {
+			have++
+		}
+	}
+	rb := &storage.Block{Id: replaceId}
+	if have >= self.dataShards {
+		rdata := self.GetBlockData(rb)
+		l := int(binary.BigEndian.Uint32(rdata[8:]))
+		if 12+l > len(rdata) {
+			log.Panicf("invalid %s block", replaceId)
+		}
+		b := &storage.Block{Id: string(rdata[12 : 12+l])}
+		b.RefCount = int32(binary.BigEndian.Uint32(rdata))
+		b.Status = storage.BlockStatus(binary.BigEndian.Uint32(rdata[4:]))
+		data := rdata[12+l:]
+		b.Data.Set(&data)
+		log.Printf("erasure: finishing interrupted replace of %x", b.Id)
+		self.storeShards(b)
+	}
+	// Otherwise, the block itself was not touched yet
+	self.DeleteBlock(rb)
+}
+
+// DeleteBlock and UpdateBlock skip shards that lack the block (e.g.
+// replaced directory not rebuilt yet), as they MUST NOT be called for
+// missing blocks.
+
+func (self *erasureBackend) DeleteBlock(b *storage.Block) {
+	for _, be := range self.shards {
+		if be == nil {
+			continue
+		}
+		sb := be.GetBlockById(b.Id)
+		if sb != nil {
+			be.DeleteBlock(sb)
+		}
+	}
+}
+
+func (self *erasureBackend) UpdateBlock(b *storage.Block) int {
+	for _, be := range self.shards {
+		if be != nil && be.GetBlockById(b.Id) != nil {
+			be.UpdateBlock(b)
+		}
+	}
+	return 1
+}
+
+func (self *erasureBackend) iterate(it func(be storage.Backend, cb func(b *storage.Block)), cb func(b *storage.Block)) {
+	seen := make(map[string]bool)
+	for _, be := range self.lookupShards() {
+		it(be, func(b *storage.Block) {
+			if seen[b.Id] {
+				return
+			}
+			seen[b.Id] = true
+			b.Backend = self
+			cb(b)
+		})
+	}
+}
+
+func (self *erasureBackend) IterateBlocks(cb func(b *storage.Block)) {
+	self.iterate(func(be storage.Backend, cb func(b *storage.Block)) {
+		be.IterateBlocks(cb)
+	}, cb)
+}
+
+func (self *erasureBackend) IterateBlocksWithStatus(status storage.BlockStatus, cb func(b *storage.Block)) {
+	self.iterate(func(be storage.Backend, cb func(b *storage.Block)) {
+		be.IterateBlocksWithStatus(status, cb)
+	}, cb)
+}
+
+// GetBytesAvailable assumes the shard directories are on different
+// disks; blocks fit until the fullest of them is full.
+func (self *erasureBackend) GetBytesAvailable() uint64 {
+	var r uint64
+	for _, be := range self.shards {
+		if be != nil {
+			a := be.GetBytesAvailable()
+			if r == 0 || a < r {
+				r = a
+			}
+		}
+	}
+	return r * uint64(self.dataShards)
+}
+
+func (self *erasureBackend) GetBytesUsed() uint64 {
+	var r uint64
+	for _, be := range self.shards {
+		if be != nil {
+			r += be.GetBytesUsed()
+		}
+	}
+	return r
+}
+
+func (self *erasureBackend) Flush() {
+	for _, be := range self.shards {
+		if be != nil {
+			be.Flush()
+		}
+	}
+}
+
+func (self *erasureBackend) Close() {
+	for _, be := range self.shards {
+		if be != nil {
+			be.Close()
+		}
+	}
+}
+
+func (self *erasureBackend) Supports(feature storage.BackendFeature) bool {
+	return false
+}
+
+// RebuildShard stores shard i of every block in its directory (e.g.
+// after the directory has been replaced with empty one), and returns
+// the number of blocks rebuilt. The backend MUST NOT be in use
+// otherwise at the same time.
+func RebuildShard(be storage.Backend, i int) (int, error) {
+	self, ok := be.(*erasureBackend)
+	if !ok {
+		return 0, ErrNotErasure
+	}
+	if i < 0 || i >= len(self.shards) {
+		return 0, fmt.Errorf("invalid shard %d", i)
+	}
+	mlog.Printf2("storage/erasure/erasure", "RebuildShard %d", i)
+	if self.shards[i] == nil {
+		err := os.MkdirAll(self.shardDirectory(i), 0700)
+		if err != nil {
+			return 0, err
+		}
+		self.openShard(i)
+	}
+	blocks := make([]*storage.Block, 0)
+	seen := make(map[string]bool)
+	for j, obe := range self.shards {
+		if j == i || obe == nil {
+			continue
+		}
+		obe.IterateBlocks(func(b *storage.Block) {
+			if !seen[b.Id] {
+				seen[b.Id] = true
+				blocks = append(blocks, b)
+			}
+		})
+	}
+	count := 0
+	for _, b := range blocks {
+		if self.shardData(i, b.Id) != nil {
+			continue
+		}
+		shards := self.readShards(b.Id, true)
+		if !self.storeShard(i, b, shards[i]) {
+			return count, fmt.Errorf("storing shard %d of %x failed", i, b.Id)
+		}
+		count++
+	}
+	return count, nil
+}
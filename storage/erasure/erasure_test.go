@@ -0,0 +1,140 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Fri Apr 13 12:10:21 2018 mstenber
+ * Last modified: Fri Apr 13 12:58:02 2018 mstenber
+ * Edit time:     22 min
+ *
+ */
+
+package erasure
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/stvp/assert"
+)
+
+func TestErasure(t *testing.T) {
+	t.Parallel()
+
+	dir, _ := ioutil.TempDir("", "erasure")
+	defer os.RemoveAll(dir)
+	open := func() *erasureBackend {
+		be := NewErasureBackend(3, 2)
+		be.Init(storage.BackendConfiguration{Directory: dir})
+		return be.(*erasureBackend)
+	}
+
+	be := open()
+	data := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("id%d", i)
+		v := fmt.Sprintf("data-%d-%s", i, dir)
+		data[id] = v
+		b := &storage.Block{Id: id,
+			BlockMetadata: storage.BlockMetadata{RefCount: 1,
+				Status: storage.BS_NORMAL}}
+		bd := []byte(v)
+		b.Data.Set(&bd)
+		be.StoreBlock(b)
+	}
+	be.SetNameToBlockId("name", "id1")
+	check := func(be *erasureBackend) {
+		for id, v := range data {
+			b := be.GetBlockById(id)
+			assert.True(t, b != nil)
+			assert.Equal(t, string(b.GetData()), v)
+		}
+		assert.Equal(t, be.GetBlockIdByName("name"), "id1")
+	}
+	check(be)
+	be.Close()
+
+	// Up to parityShards directories can be lost
+	os.RemoveAll(be.shardDirectory(0))
+	os.RemoveAll(be.shardDirectory(3))
+	be = open()
+	assert.True(t, be.shards[0] == nil)
+	check(be)
+
+	// Replaced directory can be rebuilt; then others can be lost
+	count, err := RebuildShard(be, 0)
+	assert.Nil(t, err)
+	assert.True(t, count > len(data))
+	count, err = RebuildShard(be, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, count, 0)
+	_, err = RebuildShard(be, 3)
+	assert.Nil(t, err)
+	be.Close()
+	os.RemoveAll(be.shardDirectory(1))
+	os.RemoveAll(be.shardDirectory(2))
+	be = open()
+	check(be)
+	be.Close()
+}
+
+// failingBackend panics with err on block I/O.
+type failingBackend struct {
+	storage.Backend
+	err interface{}
+}
+
+func (self failingBackend) GetBlockData(b *storage.Block) []byte {
+	panic(self.err)
+}
+
+func (self failingBackend) StoreBlock(b *storage.Block) {
+	panic(self.err)
+}
+
+func (self failingBackend) ReplaceBlock(b *storage.Block) {
+	panic(self.err)
+}
+
+func TestErasureShardFailure(t *testing.T) {
+	t.Parallel()
+
+	dir, _ := ioutil.TempDir("", "erasurefail")
+	defer os.RemoveAll(dir)
+	eb := NewErasureBackend(3, 2)
+	eb.Init(storage.BackendConfiguration{Directory: dir})
+	be := eb.(*erasureBackend)
+	defer be.Close()
+	store := func(id, v string) {
+		b := &storage.Block{Id: id,
+			BlockMetadata: storage.BlockMetadata{RefCount: 1,
+				Status: storage.BS_NORMAL}}
+		bd := []byte(v)
+		b.Data.Set(&bd)
+		be.StoreBlock(b)
+	}
+	store("id1", "data1")
+
+	// Failing shards are treated as missing
+	ok := be.shards[1]
+	be.shards[1] = failingBackend{Backend: ok, err: "disk on fire"}
+	store("id2", "data2")
+	for id, v := range map[string]string{"id1": "data1", "id2": "data2"} {
+		b := be.GetBlockById(id)
+		assert.True(t, b != nil)
+		assert.Equal(t, string(b.GetData()), v)
+	}
+
+	// .. but running out of space is not swallowed
+	be.shards[1] = failingBackend{Backend: ok, err: storage.ErrNoSpace}
+	func() {
+		defer func() {
+			assert.Equal(t, recover(), storage.ErrNoSpace)
+		}()
+		store("id3", "data3")
+	}()
+	be.shards[1] = ok
+}
@@ -4,21 +4,31 @@
  * Copyright (c) 2018 Markus Stenberg
  *
  * Created:       Fri Jan  5 12:22:52 2018 mstenber
- * Last modified: Tue Mar 20 13:35:41 2018 mstenber
- * Edit time:     26 min
+ * Last modified: Fri Apr 13 12:52:08 2018 mstenber
+ * Edit time:     39 min
  *
  */
 
 package factory
 
 import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
 	"github.com/fingon/go-tfhfs/codec"
 	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/pb"
 	"github.com/fingon/go-tfhfs/storage"
 	"github.com/fingon/go-tfhfs/storage/badger"
 	"github.com/fingon/go-tfhfs/storage/bolt"
+	"github.com/fingon/go-tfhfs/storage/erasure"
 	"github.com/fingon/go-tfhfs/storage/file"
 	"github.com/fingon/go-tfhfs/storage/inmemory"
+	"github.com/fingon/go-tfhfs/storage/remote"
+	"github.com/fingon/go-tfhfs/storage/s3"
 	"github.com/fingon/go-tfhfs/storage/tree"
 	"github.com/fingon/go-tfhfs/util"
 )
@@ -40,8 +50,27 @@ var backendFactories = map[string]factoryCallback{
 	},
 	"file": func() storage.Backend {
 		return file.NewFileBackend()
+	},
+	"s3": func() storage.Backend {
+		return s3.NewS3Backend()
 	}}
 
+// mirrorPrefix starts backend names of the form mirror:FIRST,SECOND,
+// which mirror everything to both of the named backends.
+const mirrorPrefix = "mirror:"
+
+// tieredPrefix starts backend names of the form tiered:FAST,SLOW,
+// which keep recently used blocks in FAST and the rest in SLOW.
+const tieredPrefix = "tiered:"
+
+// erasurePrefix starts backend names of the form erasure:K,M, which
+// store blocks as K data and M parity shards (see erasure package).
+const erasurePrefix = "erasure:"
+
+// remotePrefix starts backend names of the form remote:ADDRESS, which
+// keep everything in the volume of tfhfs server at ADDRESS.
+const remotePrefix = "remote:"
+
 func List() []string {
 	keys := make([]string, 0, len(backendFactories))
 	for k, _ := range backendFactories {
@@ -50,6 +79,41 @@ func List() []string {
 	return keys
 }
 
+// newBackendPair returns the two backends named after the prefix.
+func newBackendPair(name, prefix string) (storage.Backend, storage.Backend) {
+	names := strings.Split(name[len(prefix):], ",")
+	if len(names) != 2 {
+		log.Panicf("exactly two backends needed: %s", name)
+	}
+	return newBackend(names[0]), newBackend(names[1])
+}
+
+func newBackend(name string) storage.Backend {
+	if strings.HasPrefix(name, mirrorPrefix) {
+		return storage.NewMirrorBackend(newBackendPair(name, mirrorPrefix))
+	}
+	if strings.HasPrefix(name, tieredPrefix) {
+		return storage.NewTieredBackend(newBackendPair(name, tieredPrefix))
+	}
+	if strings.HasPrefix(name, remotePrefix) {
+		url := fmt.Sprintf("http://%s", name[len(remotePrefix):])
+		return remote.NewRemoteBackend(pb.NewFsProtobufClient(url, &http.Client{}))
+	}
+	if strings.HasPrefix(name, erasurePrefix) {
+		var k, m int
+		_, err := fmt.Sscanf(name[len(erasurePrefix):], "%d,%d", &k, &m)
+		if err != nil {
+			log.Panicf("invalid erasure backend %s: %v", name, err)
+		}
+		return erasure.NewErasureBackend(k, m)
+	}
+	f, ok := backendFactories[name]
+	if !ok {
+		log.Panicf("unknown backend: %s", name)
+	}
+	return f()
+}
+
 func New(name, dir string) storage.Backend {
 	var config storage.BackendConfiguration
 	config.Directory = dir
@@ -58,37 +122,222 @@ func New(name, dir string) storage.Backend {
 
 func NewWithConfig(name string, config storage.BackendConfiguration) storage.Backend {
 	mlog.Printf2("storage/factory/factory", "f.NewWithConfig %v %v", name, config)
-	be := backendFactories[name]()
+	be := newBackend(name)
 	be.Init(config)
 	return be
 }
 
 type CryptoStorageConfiguration struct {
 	storage.BackendConfiguration
-	BackendName             string
-	Password, Salt          string
-	Iterations, QueueLength int
+	BackendName string
+	Password    string
+
+	// KDF is the name of key derivation function used for new
+	// stores (see codec.KDFNames). Existing stores record the
+	// function and its parameters in their header.
+	KDF string
+
+	// Cipher is the name of the cipher used for new stores (see
+	// codec.CipherNames). Existing stores record it in their
+	// header.
+	Cipher string
+
+	// Compression is the name of the compression used for new
+	// blocks (see codec.CompressionNames). CompressionLevel is
+	// used only by zstd (0 = default level). If
+	// SkipIncompressible is set, blocks that look random are not
+	// compressed at all.
+	Compression        string
+	CompressionLevel   int
+	SkipIncompressible bool
+
+	// KeyedIds makes new (encrypted) stores use block ids that
+	// are keyed with the store secret, so that the ids do not
+	// reveal what is stored. Existing stores record it in their
+	// header.
+	KeyedIds bool
+
+	// Hash is the name of the hash used for block ids (see
+	// storage.HashNames). Existing encrypted stores record it in
+	// their header. Unencrypted stores use legacy untagged SHA256
+	// if it is not set.
+	Hash string
+
+	// Salt and Iterations are used only with legacy stores that
+	// do not have a header.
+	Salt       string
+	Iterations int
+
+	// Shards is the number of parts the in-memory block state of
+	// the storage is split to (see storage.Storage).
+	Shards int
+
+	// ReadCacheSize is the number of bytes of decoded block data
+	// the storage caches (see storage.Storage).
+	ReadCacheSize int
+
+	// ScrubRate and ScrubPeer configure the background scrubber
+	// of the storage (see storage.Storage).
+	ScrubRate int
+	ScrubPeer pb.Fs
+
+	// ReplicaPeer is used to fetch missing blocks of partial
+	// replica (see storage.Storage).
+	ReplicaPeer pb.Fs
+
+	// IntentLog enables the write-ahead intent log (see
+	// storage.Storage) in the storage directory.
+	IntentLog bool
+}
+
+const DefaultKDF = "argon2id"
+
+const DefaultCipher = "aes-gcm"
+
+func (self *CryptoStorageConfiguration) getCipher() string {
+	if self.Cipher == "" {
+		return DefaultCipher
+	}
+	return self.Cipher
+}
+
+func (self *CryptoStorageConfiguration) compressingCodec() *codec.CompressingCodec {
+	ct := codec.CompressionType_UNSET
+	if self.Compression != "" {
+		var err error
+		ct, err = codec.CompressionTypeByName(self.Compression)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	return &codec.CompressingCodec{CompressionType: ct,
+		Level:              self.CompressionLevel,
+		SkipIncompressible: self.SkipIncompressible}
+}
+
+const DefaultHash = "sha256"
+
+func (self *CryptoStorageConfiguration) getHash() string {
+	if self.Hash == "" {
+		return DefaultHash
+	}
+	return self.Hash
+}
+
+// plainHash returns the hash used by unencrypted stores. It is
+// persisted in header (without data key) when the store is created,
+// so that the existing block ids stay valid.
+func (self *CryptoStorageConfiguration) plainHash() (ht storage.HashType, err error) {
+	if self.Hash != "" {
+		ht, err = storage.HashTypeByName(self.Hash)
+		if err != nil {
+			return
+		}
+	}
+	if self.Directory == "" {
+		return
+	}
+	h, err := readHeader(self.Directory)
+	if err != nil {
+		return
+	}
+	if h != nil {
+		if self.Hash != "" && h.Hash != ht {
+			err = ErrHashMismatch
+			return
+		}
+		return h.Hash, nil
+	}
+	if !isNewStore(self.Directory) {
+		// Existing store without header may be also legacy
+		// encrypted one, so header is not added to it
+		return
+	}
+	mlog.Printf2("storage/factory/factory", " persisting hash %v", ht)
+	err = writeHeader(self.Directory, &Header{Hash: ht})
+	return
+}
+
+func (self *CryptoStorageConfiguration) getKDF() string {
+	if self.KDF == "" {
+		return DefaultKDF
+	}
+	return self.KDF
+}
+
+func (self *CryptoStorageConfiguration) getIterations() int {
+	return util.IOr(self.Iterations, 12345)
+}
+
+func (self *CryptoStorageConfiguration) getSalt() string {
+	return util.SOr(self.Salt, "asdf")
+}
+
+// getCodec returns the codec to be used for the blocks of the store,
+// and how the block ids should be calculated.
+func (self *CryptoStorageConfiguration) getCodec() (c codec.Codec, idKey []byte, ht storage.HashType, err error) {
+	c2 := self.compressingCodec()
+	if self.Password == "" {
+		mlog.Printf2("storage/factory/factory", " only compression")
+		ht, err = self.plainHash()
+		return codec.CodecChain{}.Init(c2), nil, ht, err
+	}
+	mlog.Printf2("storage/factory/factory", " with encryption + compression")
+	key, h, err := self.dataKey()
+	if err != nil {
+		return
+	}
+	ht = h.Hash
+	if h.KeyedIds {
+		mlog.Printf2("storage/factory/factory", " with keyed block ids")
+		idKey = codec.DeriveKey(key, codec.BlockIdKeyPurpose)
+	}
+	c1 := codec.EncryptingCodec{Cipher: h.Cipher}.InitWithKey(key)
+	c = codec.CodecChain{}.Init(c1, c2)
+	if self.Directory == "" {
+		return
+	}
+	state, err := readRecodecState(self.Directory)
+	if err != nil {
+		return
+	}
+	if state != nil && state.FromPlain {
+		mlog.Printf2("storage/factory/factory", " unfinished recodec from plaintext")
+		c = &codec.FallbackCodec{Codec: c,
+			Fallback: codec.CodecChain{}.Init(c2)}
+	}
+	return
+}
+
+// NewCryptoBackend returns the backend described by the
+// configuration, and the codec that has to be used for its block data
+// (nil if the backend handles the codec itself). This is useful for
+// offline tools that do not want Storage in between.
+func NewCryptoBackend(config CryptoStorageConfiguration) (storage.Backend, codec.Codec) {
+	mlog.Printf2("storage/factory/factory", "f.NewCryptoBackend")
+	beconfig := config.BackendConfiguration
+	c, _, _, err := config.getCodec()
+	if err != nil {
+		log.Panic(err)
+	}
+	beconfig.Codec = c
+	be := NewWithConfig(config.BackendName, beconfig)
+	if be.Supports(storage.CodecFeature) {
+		return be, nil
+	}
+	return be, c
 }
 
 func NewCryptoStorage(config CryptoStorageConfiguration) *storage.Storage {
 	mlog.Printf2("storage/factory/factory", "f.NewCryptoStorage")
-	iterations := util.IOr(config.Iterations, 12345)
-	queuelength := util.IOr(config.QueueLength, 100)
-	salt := util.SOr(config.Salt, "asdf")
 	beconfig := config.BackendConfiguration
-	c := &codec.CodecChain{}
-	if config.Password != "" {
-		mlog.Printf2("storage/factory/factory", " with encryption + compression")
-		c1 := codec.EncryptingCodec{}.Init([]byte(config.Password), []byte(salt), iterations)
-		c2 := &codec.CompressingCodec{}
-		c = c.Init(c1, c2)
-	} else {
-		mlog.Printf2("storage/factory/factory", " only compression")
-		c2 := &codec.CompressingCodec{}
-		c = c.Init(c2)
+	c, idKey, ht, err := config.getCodec()
+	if err != nil {
+		log.Panic(err)
 	}
 	beconfig.Codec = c
 	be := NewWithConfig(config.BackendName, beconfig)
+	sc := c
 
 	// If underlying backend takes care of codec, we give nop
 	// codec to storage
@@ -96,5 +345,13 @@ func NewCryptoStorage(config CryptoStorageConfiguration) *storage.Storage {
 		c = &codec.CodecChain{}
 		mlog.Printf2("storage/factory/factory", " backend supports codec -> omitting from storage")
 	}
-	return storage.Storage{QueueLength: queuelength, Backend: be, Codec: c}.Init()
+	intentLog := ""
+	if config.IntentLog && config.Directory != "" {
+		intentLog = filepath.Join(config.Directory, storage.IntentLogFilename)
+	}
+	return storage.Storage{Shards: config.Shards, Backend: be, Codec: c,
+		StreamCodec: sc, IdKey: idKey, Hash: ht,
+		ReadCacheSize: config.ReadCacheSize, Quota: config.Quota,
+		ScrubRate: config.ScrubRate, ScrubPeer: config.ScrubPeer,
+		ReplicaPeer: config.ReplicaPeer, IntentLog: intentLog}.Init()
 }
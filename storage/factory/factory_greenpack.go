@@ -0,0 +1,43 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Mon Mar 26 10:40:02 2018 mstenber
+ * Last modified: Mon Mar 26 10:44:51 2018 mstenber
+ * Edit time:     4 min
+ *
+ */
+
+package factory
+
+import (
+	"github.com/fingon/go-tfhfs/codec"
+	"github.com/fingon/go-tfhfs/storage"
+)
+
+// Header is stored next to the backend data, and it describes how
+// the data within the backend has been encoded.
+type Header struct {
+	// WrappedKey is the data key of the store, wrapped using a
+	// password-derived key (see codec.WrapKey). If it is not
+	// set, the store is not encrypted.
+	WrappedKey []byte `zid:"0"`
+
+	// KDF describes how the password is turned to the key that
+	// wraps WrappedKey. If it is not set, the salt and iterations
+	// of the configuration are used with PBKDF2 (legacy).
+	KDF codec.KDFParameters `zid:"1"`
+
+	// Cipher is the AEAD used to encrypt new blocks (blocks
+	// themselves record what they were encrypted with).
+	Cipher codec.CipherType `zid:"2"`
+
+	// KeyedIds is set if block ids are keyed (HMAC with a key
+	// derived from the data key) instead of plain hash of the
+	// block data.
+	KeyedIds bool `zid:"3"`
+
+	// Hash is the hash used for block ids of the store.
+	Hash storage.HashType `zid:"4"`
+}
@@ -4,16 +4,22 @@
  * Copyright (c) 2018 Markus Stenberg
  *
  * Created:       Fri Jan  5 16:28:57 2018 mstenber
- * Last modified: Fri Jan  5 16:29:17 2018 mstenber
- * Edit time:     1 min
+ * Last modified: Mon Mar 26 12:31:02 2018 mstenber
+ * Edit time:     12 min
  *
  */
 
 package factory
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/fingon/go-tfhfs/codec"
+	"github.com/fingon/go-tfhfs/storage"
 	"github.com/stvp/assert"
 )
 
@@ -21,3 +27,268 @@ func TestList(t *testing.T) {
 	t.Parallel()
 	assert.Equal(t, len(List()), len(backendFactories))
 }
+
+func TestChangePassword(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "passwd")
+	defer os.RemoveAll(dir)
+
+	config := CryptoStorageConfiguration{BackendName: "file",
+		Password: "old", Cipher: "xchacha20-poly1305"}
+	config.Directory = dir
+
+	st := NewCryptoStorage(config)
+	data := []byte("data")
+	b := st.ReferOrStoreBlockBytes0(storage.BS_NORMAL, data, nil)
+	id := b.Id()
+	st.SetNameToBlockId("name", id)
+	b.Close()
+	st.Close()
+
+	h, err := readHeader(dir)
+	assert.Nil(t, err)
+	assert.True(t, h != nil)
+	assert.Equal(t, h.KDF.Type, codec.KDFType_ARGON2ID)
+	assert.Equal(t, h.Cipher, codec.CipherType_XCHACHA20_POLY1305)
+	assert.Equal(t, h.Hash, storage.HashType_SHA256)
+
+	err = ChangePassword(config, "new")
+	assert.Nil(t, err)
+
+	// Old password should no longer work
+	_, _, err = config.dataKey()
+	assert.Equal(t, err, ErrWrongPassword)
+
+	// Salt should be fresh, and KDF and cipher stay the same
+	h2, err := readHeader(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, h2.KDF.Type, codec.KDFType_ARGON2ID)
+	assert.Equal(t, h2.Cipher, codec.CipherType_XCHACHA20_POLY1305)
+	assert.Equal(t, h2.Hash, storage.HashType_SHA256)
+	assert.NotEqual(t, h2.KDF.Salt, h.KDF.Salt)
+
+	// Only password should matter
+	config.Password = "new"
+	config.Salt = "pepper"
+	config.Iterations = 42
+	config.Cipher = ""
+	config.Hash = "blake3"
+	st = NewCryptoStorage(config)
+	defer st.Close()
+	assert.Equal(t, st.GetBlockIdByName("name"), id)
+	b = st.GetBlockById(id)
+	assert.True(t, b != nil)
+	defer b.Close()
+	assert.Equal(t, b.Data(), data)
+}
+
+func TestChangePasswordLegacy(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "passwdl")
+	defer os.RemoveAll(dir)
+
+	config := CryptoStorageConfiguration{BackendName: "file",
+		Password: "old"}
+	config.Directory = dir
+
+	// Legacy store has no header; its blocks are encrypted with
+	// the password-derived key
+	key := config.legacyPasswordKey()
+	c := codec.CodecChain{}.Init(
+		codec.EncryptingCodec{Cipher: codec.CipherType_AES_GCM}.InitWithKey(key),
+		config.compressingCodec())
+	be := New(config.BackendName, dir)
+	data := []byte("data")
+	id := storage.HashType_UNSET.BlockId(nil, data)
+	edata, err := c.EncodeBytes(data, []byte(id))
+	assert.Nil(t, err)
+	b := &storage.Block{Id: id,
+		BlockMetadata: storage.BlockMetadata{RefCount: 1,
+			Status: storage.BS_NORMAL}}
+	b.Data.Set(&edata)
+	be.StoreBlock(b)
+	be.Close()
+
+	// Mistyped old password must not be wrapped in the header
+	wrong := config
+	wrong.Password = "wrong"
+	assert.Equal(t, ChangePassword(wrong, "new"), ErrWrongPassword)
+	h, err := readHeader(dir)
+	assert.Nil(t, err)
+	assert.True(t, h == nil)
+
+	err = ChangePassword(config, "new")
+	assert.Nil(t, err)
+	config.Password = "new"
+	key2, _, err := config.dataKey()
+	assert.Nil(t, err)
+	assert.Equal(t, key2, key)
+}
+
+func TestPlainHash(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "plainhash")
+	defer os.RemoveAll(dir)
+
+	config := CryptoStorageConfiguration{BackendName: "file",
+		Hash: "blake3"}
+	config.Directory = dir
+	st := NewCryptoStorage(config)
+	assert.Equal(t, st.Hash, storage.HashType_BLAKE3)
+	st.Close()
+
+	// Hash is persisted even without encryption
+	config.Hash = ""
+	st = NewCryptoStorage(config)
+	assert.Equal(t, st.Hash, storage.HashType_BLAKE3)
+	st.Close()
+
+	config.Hash = "sha256"
+	_, _, _, err := config.getCodec()
+	assert.Equal(t, err, ErrHashMismatch)
+}
+
+func TestIntentLogEncrypted(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "intentlog")
+	defer os.RemoveAll(dir)
+
+	// Tree encodes the blocks itself, but the log has to be
+	// encrypted too
+	config := CryptoStorageConfiguration{BackendName: "tree",
+		Password: "foo", IntentLog: true}
+	config.Directory = dir
+	st := NewCryptoStorage(config)
+	st.ReplayIntentLog()
+	data := []byte("secret-plaintext-data")
+	id := st.BlockId(data)
+	st.ReferOrStoreBlock0(id, storage.BS_NORMAL, data, nil).Close()
+	st.SetNameToBlockId("name", id)
+	assert.True(t, st.SyncIntentLog())
+	path := filepath.Join(dir, storage.IntentLogFilename)
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, len(b) > 0)
+	assert.False(t, strings.Contains(string(b), "secret"))
+	st.Close()
+
+	// Replay of the (crash-time) log has to decode it too
+	assert.Nil(t, ioutil.WriteFile(path, b, 0600))
+	st = NewCryptoStorage(config)
+	st.ReplayIntentLog()
+	sb := st.GetBlockById(id)
+	assert.True(t, sb != nil)
+	assert.Equal(t, string(sb.Data()), string(data))
+	sb.Close()
+	st.Close()
+}
+
+func TestKeyedIds(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "keyedids")
+	defer os.RemoveAll(dir)
+
+	config := CryptoStorageConfiguration{BackendName: "file",
+		Password: "foo", KeyedIds: true}
+	config.Directory = dir
+	st := NewCryptoStorage(config)
+	assert.True(t, st.IdKey != nil)
+	st.Close()
+
+	// Header determines the behavior of existing stores
+	config.KeyedIds = false
+	st = NewCryptoStorage(config)
+	assert.True(t, st.IdKey != nil)
+	st.Close()
+
+	// .. and it is kept across password changes
+	err := ChangePassword(config, "bar")
+	assert.Nil(t, err)
+	config.Password = "bar"
+	st = NewCryptoStorage(config)
+	assert.True(t, st.IdKey != nil)
+	st.Close()
+}
+
+func TestRecodec(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "recodec")
+	defer os.RemoveAll(dir)
+
+	config := CryptoStorageConfiguration{BackendName: "file"}
+	config.Directory = dir
+
+	iterateReferences := func(id string, data []byte, cb storage.BlockReferenceCallback) {
+		for _, subid := range strings.Split(string(data), " ") {
+			if subid != "" {
+				cb(subid)
+			}
+		}
+	}
+	world := []struct {
+		key, value string
+	}{
+		{"sub1", " "},
+		{"sub2", " "},
+		{"sub", "sub1 sub2"},
+		// Reachable only from the other names
+		{"other", " "},
+		{"snap1", " "},
+		{"snap", "snap1"},
+		{"snaplist", " "},
+	}
+	names := map[string]string{"root": "sub", "sync": "other",
+		"root.snapshot.s1": "snap", "root.snapshots": "snaplist"}
+
+	st := NewCryptoStorage(config)
+	st.IterateReferencesCallback = iterateReferences
+	for _, v := range world {
+		st.ReferOrStoreBlock(v.key, storage.BS_NORMAL, []byte(v.value)).Close()
+	}
+	st.SetNamesToBlockIds(names)
+	for _, v := range world {
+		st.ReleaseBlockId(v.key)
+	}
+	st.Close()
+
+	// Unencrypted -> encrypted
+	config.Password = "foo"
+	config.Compression = "zstd"
+	err := Recodec(config, true)
+	assert.Nil(t, err)
+	_, err = os.Stat(recodecPath(dir))
+	assert.True(t, os.IsNotExist(err))
+
+	// Changing cipher (and resuming; nothing should be redone)
+	config.Cipher = "xchacha20-poly1305"
+	ioutil.WriteFile(recodecPath(dir), []byte(recodecMagic+"\n"+"737562"+"\n"), 0600)
+	err = Recodec(config, false)
+	assert.Nil(t, err)
+	h, err := readHeader(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, h.Cipher, codec.CipherType_XCHACHA20_POLY1305)
+
+	// Encrypted data should be readable only with password
+	st = NewCryptoStorage(config)
+	for k, v := range names {
+		assert.Equal(t, st.GetBlockIdByName(k), v)
+	}
+	for _, v := range world {
+		b := st.GetBlockById(v.key)
+		assert.True(t, b != nil)
+		assert.Equal(t, string(b.Data()), v.value)
+		b.Close()
+	}
+	st.Close()
+
+	config.Password = ""
+	c, _, _, err := config.getCodec()
+	assert.Nil(t, err)
+	be := New(config.BackendName, dir)
+	defer be.Close()
+	for _, v := range world {
+		b := be.GetBlockById(v.key)
+		_, err = c.DecodeBytes(be.GetBlockData(b), []byte(v.key))
+		assert.True(t, err != nil)
+	}
+}
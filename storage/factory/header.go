@@ -0,0 +1,371 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Mon Mar 26 10:45:12 2018 mstenber
+ * Last modified: Mon Mar 26 12:20:33 2018 mstenber
+ * Edit time:     62 min
+ *
+ */
+
+package factory
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/fingon/go-tfhfs/codec"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+)
+
+// HeaderFilename is the name of the file in the storage directory
+// which contains the (encoded) Header.
+const HeaderFilename = "tfhfs.header"
+
+var ErrEmptyPassword = errors.New("Empty password")
+var ErrHashMismatch = errors.New("Hash differs from the one of the storage")
+var ErrNoDirectory = errors.New("Storage directory not set")
+var ErrNotEncrypted = errors.New("Storage is not encrypted")
+var ErrNotNewStore = errors.New("Storage directory is not empty")
+var ErrWrongPassword = errors.New("Unable to unwrap data key (wrong password?)")
+
+func headerPath(dir string) string {
+	return fmt.Sprintf("%s/%s", dir, HeaderFilename)
+}
+
+// readHeader returns the header in the directory, or nil if there is
+// no header.
+func readHeader(dir string) (*Header, error) {
+	b, err := ioutil.ReadFile(headerPath(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var h Header
+	_, err = h.UnmarshalMsg(b)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// writeHeader (re)writes the header in the directory. The write is
+// atomic; either the old or the new header is there even if we
+// crash in the middle.
+func writeHeader(dir string, h *Header) error {
+	mlog.Printf2("storage/factory/header", "writeHeader %s", dir)
+	b, err := h.MarshalMsg(nil)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	path := headerPath(dir)
+	tpath := fmt.Sprintf("%s.new", path)
+	f, err := os.OpenFile(tpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tpath)
+		return err
+	}
+	return os.Rename(tpath, path)
+}
+
+// isNewStore checks if the directory has anything at all in it
+// (missing directory is also new).
+func isNewStore(dir string) bool {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return true
+	}
+	for _, fi := range fis {
+		if fi.Name() != HeaderFilename {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodedHeader returns the header of the storage directory as is,
+// or nil if it does not have one.
+func (self *CryptoStorageConfiguration) EncodedHeader() ([]byte, error) {
+	if self.Directory == "" {
+		return nil, ErrNoDirectory
+	}
+	b, err := ioutil.ReadFile(headerPath(self.Directory))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// ImportHeader initializes new storage directory with the (encoded)
+// header of another storage, so that it shares the data key and the
+// hash with it. The password has to be the same as well.
+func (self *CryptoStorageConfiguration) ImportHeader(b []byte) error {
+	mlog.Printf2("storage/factory/header", "ImportHeader")
+	dir := self.Directory
+	if dir == "" {
+		return ErrNoDirectory
+	}
+	var h Header
+	_, err := h.UnmarshalMsg(b)
+	if err != nil {
+		return err
+	}
+	oh, err := readHeader(dir)
+	if err != nil {
+		return err
+	}
+	if oh != nil || !isNewStore(dir) {
+		return ErrNotNewStore
+	}
+	if h.WrappedKey != nil {
+		kek, err := self.passwordKey(&h)
+		if err != nil {
+			return err
+		}
+		_, err = codec.UnwrapKey(h.WrappedKey, kek)
+		if err != nil {
+			return ErrWrongPassword
+		}
+	}
+	return writeHeader(dir, &h)
+}
+
+// legacyPasswordKey produces the key used in stores that were created
+// before the KDF parameters were persisted in the header.
+func (self *CryptoStorageConfiguration) legacyPasswordKey() []byte {
+	return codec.PasswordKey([]byte(self.Password),
+		[]byte(self.getSalt()), self.getIterations())
+}
+
+// passwordKey produces the key encryption key used to wrap the data
+// key (or, in legacy stores without header, the data key itself).
+func (self *CryptoStorageConfiguration) passwordKey(h *Header) ([]byte, error) {
+	if h == nil || h.KDF.Type == codec.KDFType_UNSET {
+		return self.legacyPasswordKey(), nil
+	}
+	return h.KDF.Key([]byte(self.Password))
+}
+
+// newHeader produces a new header which wraps the key with fresh
+// KDF parameters (and therefore a fresh salt).
+func (self *CryptoStorageConfiguration) newHeader(key []byte, kt codec.KDFType) (*Header, error) {
+	kdf, err := codec.NewKDFParameters(kt)
+	if err != nil {
+		return nil, err
+	}
+	h := &Header{KDF: *kdf}
+	kek, err := self.passwordKey(h)
+	if err != nil {
+		return nil, err
+	}
+	h.WrappedKey, err = codec.WrapKey(key, kek)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// createHeader creates (and persists) header with fresh random data
+// key, using the configured KDF and cipher, and the given block id
+// calculation parameters.
+func (self *CryptoStorageConfiguration) createHeader(keyedIds bool, ht storage.HashType) (key []byte, h *Header, err error) {
+	kt, err := codec.KDFTypeByName(self.getKDF())
+	if err != nil {
+		return
+	}
+	ct, err := codec.CipherTypeByName(self.getCipher())
+	if err != nil {
+		return
+	}
+	key, err = codec.NewDataKey()
+	if err != nil {
+		return
+	}
+	h, err = self.newHeader(key, kt)
+	if err != nil {
+		return
+	}
+	h.Cipher = ct
+	h.KeyedIds = keyedIds
+	h.Hash = ht
+	err = writeHeader(self.Directory, h)
+	return
+}
+
+// dataKey returns the key used to encrypt the blocks of the store,
+// and the header describing how the blocks should be encoded.
+//
+// If the store does not have a header yet, and it is fresh, a random
+// data key is generated and persisted (wrapped with the password)
+// in the header. Legacy stores (and in-memory ones) use the
+// password-derived key directly, and get a header which is not
+// persisted.
+func (self *CryptoStorageConfiguration) dataKey() (key []byte, h *Header, err error) {
+	dir := self.Directory
+	if dir == "" {
+		h = &Header{KeyedIds: self.KeyedIds}
+		h.Cipher, err = codec.CipherTypeByName(self.getCipher())
+		if err != nil {
+			return
+		}
+		h.Hash, err = storage.HashTypeByName(self.getHash())
+		return self.legacyPasswordKey(), h, err
+	}
+	h, err = readHeader(dir)
+	if err != nil {
+		return
+	}
+	if h != nil && h.WrappedKey == nil && isNewStore(dir) {
+		// Unencrypted store without any blocks yet can still
+		// become encrypted one
+		h = nil
+	}
+	if h == nil {
+		if !isNewStore(dir) {
+			mlog.Printf2("storage/factory/header", " legacy store without header")
+			h = &Header{Cipher: codec.CipherType_AES_GCM}
+			return self.legacyPasswordKey(), h, nil
+		}
+		mlog.Printf2("storage/factory/header", " new store, creating data key")
+		var ht storage.HashType
+		ht, err = storage.HashTypeByName(self.getHash())
+		if err != nil {
+			return
+		}
+		return self.createHeader(self.KeyedIds, ht)
+	}
+	if h.WrappedKey == nil {
+		err = ErrNotEncrypted
+		return
+	}
+	kek, err := self.passwordKey(h)
+	if err != nil {
+		return
+	}
+	key, err = codec.UnwrapKey(h.WrappedKey, kek)
+	if err != nil {
+		err = ErrWrongPassword
+		return
+	}
+	if h.Cipher == codec.CipherType_UNSET {
+		h.Cipher = codec.CipherType_AES_GCM
+	}
+	return
+}
+
+// verifyKey checks the (password-derived) key of legacy store, as
+// there is no wrapped key to check it against. The first encrypted
+// block is decoded with it; blocks stored in plaintext (whose data
+// matches their id) tell nothing about the key, and if there are
+// only those, any key is fine.
+func (self *CryptoStorageConfiguration) verifyKey(key []byte, h *Header) error {
+	c := codec.CodecChain{}.Init(
+		codec.EncryptingCodec{Cipher: h.Cipher}.InitWithKey(key),
+		self.compressingCodec())
+	beconfig := self.BackendConfiguration
+	beconfig.Codec = c
+	be := NewWithConfig(self.BackendName, beconfig)
+	defer be.Close()
+	backendCodec := be.Supports(storage.CodecFeature)
+	ids := make([]string, 0)
+	be.IterateBlocks(func(b *storage.Block) {
+		switch b.Status {
+		case storage.BS_NORMAL, storage.BS_WEAK:
+			ids = append(ids, b.Id)
+		}
+	})
+	for _, id := range ids {
+		b := be.GetBlockById(id)
+		if b == nil {
+			continue
+		}
+		data := be.GetBlockData(b)
+		if data == nil {
+			if backendCodec {
+				// Backend was unable to decode it
+				return ErrWrongPassword
+			}
+			continue
+		}
+		if backendCodec {
+			return nil
+		}
+		ht, err := storage.BlockIdHashType(id)
+		if err == nil && ht.BlockId(nil, data) == id {
+			continue
+		}
+		_, err = c.DecodeBytes(data, []byte(id))
+		if err != nil {
+			return ErrWrongPassword
+		}
+		return nil
+	}
+	return nil
+}
+
+// ChangePassword rewraps the data key of the store with a key
+// derived from the new password (using fresh salt). The data itself
+// is not touched, so this is cheap regardless of the store
+// size. Legacy stores (without header) get a header which wraps their
+// current password-derived key, once the old password has been
+// verified against the existing blocks.
+func ChangePassword(config CryptoStorageConfiguration, newPassword string) error {
+	mlog.Printf2("storage/factory/header", "f.ChangePassword")
+	if config.Directory == "" {
+		return ErrNoDirectory
+	}
+	if config.Password == "" {
+		return ErrNotEncrypted
+	}
+	if newPassword == "" {
+		return ErrEmptyPassword
+	}
+	key, oh, err := config.dataKey()
+	if err != nil {
+		return err
+	}
+	if oh.WrappedKey == nil {
+		if err = config.verifyKey(key, oh); err != nil {
+			return err
+		}
+	}
+	// Unless explicitly told otherwise, keep using the same KDF
+	kt := codec.KDFType_UNSET
+	if config.KDF == "" {
+		kt = oh.KDF.Type
+	}
+	if kt == codec.KDFType_UNSET {
+		kt, err = codec.KDFTypeByName(config.getKDF())
+		if err != nil {
+			return err
+		}
+	}
+	nconfig := config
+	nconfig.Password = newPassword
+	h, err := nconfig.newHeader(key, kt)
+	if err != nil {
+		return err
+	}
+	h.Cipher = oh.Cipher
+	h.KeyedIds = oh.KeyedIds
+	h.Hash = oh.Hash
+	return writeHeader(config.Directory, h)
+}
@@ -0,0 +1,265 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Fri Mar 30 09:05:31 2018 mstenber
+ * Last modified: Fri Mar 30 12:47:10 2018 mstenber
+ * Edit time:     128 min
+ *
+ */
+
+package factory
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/fingon/go-tfhfs/codec"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+)
+
+// RecodecFilename is the name of the file in the storage directory
+// which tracks the progress of (unfinished) Recodec.
+const RecodecFilename = "tfhfs.recodec"
+
+// How many blocks are recoded between checkpoints
+const recodecCheckpointInterval = 1000
+
+const (
+	recodecMagic      = "tfhfs-recodec"
+	recodecMagicPlain = "tfhfs-recodec plain"
+)
+
+var ErrInvalidRecodecState = errors.New("Invalid recodec state file")
+
+type recodecState struct {
+	// FromPlain is set if the store was not encrypted before
+	// the recodec started (but will be after it).
+	FromPlain bool
+
+	// Done contains ids of blocks which have been already recoded.
+	Done map[string]bool
+}
+
+func recodecPath(dir string) string {
+	return fmt.Sprintf("%s/%s", dir, RecodecFilename)
+}
+
+// readRecodecState returns the state of unfinished recodec in the
+// directory, or nil if there is none.
+func readRecodecState(dir string) (*recodecState, error) {
+	f, err := os.Open(recodecPath(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	state := &recodecState{Done: make(map[string]bool)}
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		return nil, ErrInvalidRecodecState
+	}
+	switch s.Text() {
+	case recodecMagicPlain:
+		state.FromPlain = true
+	case recodecMagic:
+	default:
+		return nil, ErrInvalidRecodecState
+	}
+	for s.Scan() {
+		id, err := hex.DecodeString(s.Text())
+		if err != nil {
+			// Partially written last line is fine
+			break
+		}
+		state.Done[string(id)] = true
+	}
+	return state, s.Err()
+}
+
+// Recodec re-encodes every block in the backend using the codec
+// described by config. The store may be unencrypted before
+// (fromPlain), in which case the new data key is created here;
+// removing encryption is not supported.
+//
+// Recodec is interruptible; progress is tracked in RecodecFilename
+// and calling Recodec again resumes where it left off. While the
+// recodec is unfinished, the store can be still used with the new
+// configuration. The store MUST NOT be in use while Recodec is
+// running though.
+func Recodec(config CryptoStorageConfiguration, fromPlain bool) error {
+	mlog.Printf2("storage/factory/recodec", "f.Recodec %v", fromPlain)
+	dir := config.Directory
+	if dir == "" {
+		return ErrNoDirectory
+	}
+	state, err := readRecodecState(dir)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		mlog.Printf2("storage/factory/recodec", " resuming; %d done", len(state.Done))
+		fromPlain = state.FromPlain
+	} else {
+		state = &recodecState{FromPlain: fromPlain,
+			Done: make(map[string]bool)}
+	}
+	if config.Password == "" {
+		if fromPlain && len(state.Done) > 0 {
+			return ErrEmptyPassword
+		}
+		// Plaintext to plaintext recodec does not need the
+		// fallback codec
+		fromPlain = false
+		state.FromPlain = false
+	}
+	if err = config.prepareRecodecHeader(fromPlain); err != nil {
+		return err
+	}
+	magic := recodecMagic
+	if fromPlain {
+		magic = recodecMagicPlain
+	}
+	f, err := os.OpenFile(recodecPath(dir), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if len(state.Done) == 0 {
+		if err = f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintln(f, magic); err != nil {
+			return err
+		}
+	}
+
+	// getCodec takes care of the fallback as the state file
+	// exists now
+	c, _, _, err := config.getCodec()
+	if err != nil {
+		return err
+	}
+	beconfig := config.BackendConfiguration
+	beconfig.Codec = c
+	be := NewWithConfig(config.BackendName, beconfig)
+	defer be.Close()
+	backendCodec := be.Supports(storage.CodecFeature)
+
+	var pending []string
+	checkpoint := func() error {
+		be.Flush()
+		w := bufio.NewWriter(f)
+		for _, id := range pending {
+			fmt.Fprintln(w, hex.EncodeToString([]byte(id)))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		pending = nil
+		return f.Sync()
+	}
+
+	// Every block with data is recoded, whichever name (if any)
+	// it is reachable from. The backend must not be modified
+	// while iterating, so the ids are gathered first.
+	var todo []string
+	be.IterateBlocks(func(b *storage.Block) {
+		switch b.Status {
+		case storage.BS_NORMAL, storage.BS_WEAK:
+			if !state.Done[b.Id] {
+				todo = append(todo, b.Id)
+			}
+		}
+	})
+	for _, id := range todo {
+		b := be.GetBlockById(id)
+		if b == nil {
+			return fmt.Errorf("Missing block %x", id)
+		}
+		data := be.GetBlockData(b)
+		if data == nil {
+			return fmt.Errorf("Unable to read block %x", id)
+		}
+		// Backend with codec encodes the data itself
+		if !backendCodec {
+			data, err = c.DecodeBytes(data, []byte(id))
+			if err != nil {
+				return err
+			}
+			data, err = c.EncodeBytes(data, []byte(id))
+			if err != nil {
+				return err
+			}
+		}
+		nb := &storage.Block{Id: id, BlockMetadata: b.BlockMetadata}
+		nb.Data.Set(&data)
+		be.ReplaceBlock(nb)
+		pending = append(pending, id)
+		if len(pending) >= recodecCheckpointInterval {
+			if err = checkpoint(); err != nil {
+				return err
+			}
+		}
+	}
+	if err = checkpoint(); err != nil {
+		return err
+	}
+	mlog.Printf2("storage/factory/recodec", " done; %d blocks", len(todo))
+	return os.Remove(recodecPath(dir))
+}
+
+// prepareRecodecHeader ensures the header matches the new
+// configuration; encrypted stores get their cipher updated, and
+// previously unencrypted ones get a new data key.
+func (self *CryptoStorageConfiguration) prepareRecodecHeader(fromPlain bool) error {
+	if self.Password == "" {
+		return nil
+	}
+	h, err := readHeader(self.Directory)
+	if err != nil {
+		return err
+	}
+	if h == nil || h.WrappedKey == nil {
+		if !fromPlain {
+			if h != nil {
+				return ErrNotEncrypted
+			}
+			// Legacy stores keep using AES GCM
+			mlog.Printf2("storage/factory/recodec", " legacy store without header")
+			return nil
+		}
+		mlog.Printf2("storage/factory/recodec", " creating data key")
+		// Existing block ids are not keyed, and their hash
+		// stays the same
+		ht, err := self.plainHash()
+		if err != nil {
+			return err
+		}
+		_, _, err = self.createHeader(false, ht)
+		return err
+	}
+	if self.Cipher == "" {
+		return nil
+	}
+	ct, err := codec.CipherTypeByName(self.Cipher)
+	if err != nil {
+		return err
+	}
+	if h.Cipher == ct {
+		return nil
+	}
+	// Ensure the password is right before touching the header
+	if _, _, err = self.dataKey(); err != nil {
+		return err
+	}
+	h.Cipher = ct
+	return writeHeader(self.Directory, h)
+}
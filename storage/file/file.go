@@ -12,6 +12,7 @@
 package file
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -30,8 +31,9 @@ import (
 //
 // Name encoding:
 //
-// - names/ directory has files with base64 encoded name of link,
-// containing raw bytes for the block id.
+// - names are stored in blocks (see storage.GenerationNameBackend);
+// legacy names/ directory with files with hex encoded name of link,
+// containing raw bytes for the block id, is converted on Init.
 //
 // Block encoding:
 //
@@ -40,11 +42,17 @@ import (
 //
 // Number of characters used for subdirectory name can be also chosen,
 // as keeping all blocks in same location does not make sense.
+//
+// Status index:
+//
+// - status/<status>/ directory contains empty files with hex dumped
+// block ids as names, for every block with that status.
 
 const directoryBytes = 2 // 65536 subdirs should be plenty
 
 type fileBackend struct {
 	storage.DirectoryBackendBase
+	storage.GenerationNameBackend
 	created     map[string]bool
 	createdLock util.MutexLocked
 }
@@ -58,6 +66,85 @@ func NewFileBackend() storage.Backend {
 
 func (self *fileBackend) Init(config storage.BackendConfiguration) {
 	(&self.DirectoryBackendBase).Init(config)
+	dir := fmt.Sprintf("%s/status", self.Directory)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// Storage created without status index; populate it
+		self.IterateBlocks(func(b *storage.Block) {
+			self.setStatus(b.Id, storage.BS_UNSET, b.Status)
+		})
+		self.mkdirAll(dir)
+	}
+	self.GenerationNameBackend.Init("names", self)
+	self.convertNames()
+}
+
+// convertNames moves the names from the legacy names/ directory to
+// the name blocks.
+func (self *fileBackend) convertNames() {
+	dir := fmt.Sprintf("%s/names", self.Directory)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	// If we crashed while removing the directory, the names
+	// are already there
+	if self.NameGeneration() == 0 {
+		names := make(map[string]string)
+		for _, fi := range fis {
+			name, err := hex.DecodeString(fi.Name())
+			if err != nil {
+				log.Panic(err)
+			}
+			b, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", dir, fi.Name()))
+			if err != nil {
+				log.Panic(err)
+			}
+			names[string(name)] = string(b)
+		}
+		mlog.Printf2("storage/file/file", "fbb.convertNames %d names", len(names))
+		self.SetNamesToBlockIds(names)
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (self *fileBackend) statusPath(id string, status storage.BlockStatus) (dir string, full string) {
+	dir = fmt.Sprintf("%s/status/%v", self.Directory, status)
+	full = fmt.Sprintf("%s/%x", dir, id)
+	return
+}
+
+// setStatus updates the status index; BS_UNSET is used for blocks
+// that do not exist.
+func (self *fileBackend) setStatus(id string, old, status storage.BlockStatus) {
+	if old == status {
+		return
+	}
+	if old != storage.BS_UNSET {
+		_, path := self.statusPath(id, old)
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Panic(err)
+		}
+	}
+	if status != storage.BS_UNSET {
+		dir, path := self.statusPath(id, status)
+		self.mkdirAll(dir)
+		self.writeFile(path, nil)
+	}
+}
+
+// writeFile writes the file, retrying it if the disk is full.
+func (self *fileBackend) writeFile(path string, data []byte) {
+	err := self.RetryWrite(func() error {
+		return ioutil.WriteFile(path, data, 0600)
+	})
+	storage.PanicIfNoSpace(err)
+	if err != nil {
+		log.Panic(err)
+	}
 }
 
 func (self *fileBackend) Flush() {
@@ -76,6 +163,11 @@ func (self *fileBackend) DeleteBlock(bl *storage.Block) {
 	if err != nil {
 		log.Panic(err)
 	}
+	status := bl.Status
+	if bl.Stored != nil {
+		status = bl.Stored.Status
+	}
+	self.setStatus(bl.Id, status, storage.BS_UNSET)
 }
 
 func (self *fileBackend) mkdirAllRec(path string) {
@@ -149,48 +241,104 @@ func (self *fileBackend) GetBlockById(id string) *storage.Block {
 	return nil
 }
 
-func (self *fileBackend) GetBlockIdByName(name string) string {
-	mlog.Printf2("storage/file/file", "fbb.GetBlockIdByName %v", name)
-	path := fmt.Sprintf("%s/names/%x", self.Directory, name)
-	b, err := ioutil.ReadFile(path)
+func (self *fileBackend) IterateBlocks(cb func(b *storage.Block)) {
+	self.delay()
+	dir := fmt.Sprintf("%s/blocks", self.Directory)
+	dfis, err := ioutil.ReadDir(dir)
 	if err != nil {
-		mlog.Printf2("storage/file/file", " nope, %v", err)
-		return ""
+		mlog.Printf2("storage/file/file", " no blocks: %v", err)
+		return
 	}
-	return string(b)
-}
-
-func (self *fileBackend) SetInFlush(value bool) {
-}
-
-func (self *fileBackend) SetNameToBlockId(name, block_id string) {
-	mlog.Printf2("storage/file/file", "fbb.SetNameToBlockId %v %x", name, block_id)
-	dir := fmt.Sprintf("%s/names", self.Directory)
-	path := fmt.Sprintf("%s/%x", dir, name)
-	self.mkdirAll(dir)
-	if block_id == "" {
-		err := os.Remove(path)
+	for _, dfi := range dfis {
+		prefix, err := hex.DecodeString(dfi.Name())
+		if err != nil {
+			continue
+		}
+		fis, err := ioutil.ReadDir(fmt.Sprintf("%s/%s", dir, dfi.Name()))
 		if err != nil {
 			log.Panic(err)
 		}
-		return
+		for _, fi := range fis {
+			arr := strings.Split(fi.Name(), "_")
+			if len(arr) != 3 {
+				continue
+			}
+			suffix, err := hex.DecodeString(arr[0])
+			if err != nil {
+				continue
+			}
+			refcount, err := strconv.Atoi(arr[1])
+			if err != nil {
+				continue
+			}
+			status, err := strconv.Atoi(arr[2])
+			if err != nil {
+				continue
+			}
+			meta := storage.BlockMetadata{RefCount: int32(refcount),
+				Status: storage.BlockStatus(status)}
+			cb(&storage.Block{Id: string(prefix) + string(suffix),
+				Backend: self, BlockMetadata: meta})
+		}
 	}
-	err := ioutil.WriteFile(path, []byte(block_id), 0600)
+}
+
+func (self *fileBackend) IterateBlocksWithStatus(status storage.BlockStatus, cb func(b *storage.Block)) {
+	self.delay()
+	dir, _ := self.statusPath("", status)
+	fis, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Panic(err)
+		mlog.Printf2("storage/file/file", " no blocks with status %v: %v", status, err)
+		return
+	}
+	for _, fi := range fis {
+		id, err := hex.DecodeString(fi.Name())
+		if err != nil || len(id) <= directoryBytes {
+			continue
+		}
+		b := self.GetBlockById(string(id))
+		if b != nil {
+			cb(b)
+		}
 	}
-	mlog.Printf2("storage/file/file", " wrote to %v", path)
+}
+
+func (self *fileBackend) SetInFlush(value bool) {
 }
 
 func (self *fileBackend) StoreBlock(bl *storage.Block) {
 	self.delay()
 	dir, path := self.blockPath(bl, nil)
 	self.mkdirAll(dir)
-	err := ioutil.WriteFile(path, *bl.Data.Get(), 0600)
+	self.writeFile(path, *bl.Data.Get())
+	self.setStatus(bl.Id, storage.BS_UNSET, bl.Status)
+	mlog.Printf2("storage/file/file", "fbb.StoreBlock %x to %v", bl.Id, path)
+}
+
+// ReplaceBlock writes the new data to a temporary file, and renames
+// it over the old one.
+func (self *fileBackend) ReplaceBlock(bl *storage.Block) {
+	self.delay()
+	ob := self.GetBlockById(bl.Id)
+	if ob == nil {
+		log.Panic("Non-existent block id in ReplaceBlock")
+	}
+	_, oldpath := self.blockPath(ob, nil)
+	_, path := self.blockPath(bl, nil)
+	tmppath := path + ".new"
+	self.writeFile(tmppath, *bl.Data.Get())
+	err := os.Rename(tmppath, path)
 	if err != nil {
 		log.Panic(err)
 	}
-	mlog.Printf2("storage/file/file", "fbb.StoreBlock %x to %v", bl.Id, path)
+	if oldpath != path {
+		err = os.Remove(oldpath)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	self.setStatus(bl.Id, ob.Status, bl.Status)
+	mlog.Printf2("storage/file/file", "fbb.ReplaceBlock %x to %v", bl.Id, path)
 }
 
 func (self *fileBackend) UpdateBlock(bl *storage.Block) int {
@@ -207,6 +355,7 @@ func (self *fileBackend) UpdateBlock(bl *storage.Block) int {
 	if err != nil {
 		log.Panic(err)
 	}
+	self.setStatus(bl.Id, bl.Stored.Status, bl.Status)
 	mlog.Printf2("storage/file/file", "fbb.UpdateBlock %x", bl.Id)
 	return 1
 }
@@ -0,0 +1,181 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Tue Apr 10 09:02:44 2018 mstenber
+ * Last modified: Tue Apr 10 11:31:19 2018 mstenber
+ * Edit time:     104 min
+ *
+ */
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// nameGenerations is the number of generations kept in the block
+// backend; the oldest one is replaced when a new one is written.
+const nameGenerations = 2
+
+// GenerationNameBackend saves the names in blocks of a BlockBackend.
+// Every change writes the whole name map with increased generation
+// number to the block of the oldest generation, so the current
+// generation is intact even if the write never finishes. On open,
+// the newest valid generation is used.
+//
+// Name maps of the legacy single-block design (block with prefix as
+// its id) are used if there are no generations yet; the legacy block
+// is removed once the first generation has been written.
+type GenerationNameBackend struct {
+	prefix  string
+	bb      BlockBackend
+	current *NameGenerationBlock
+	legacy  *Block
+	lock    util.MutexLocked
+}
+
+var _ NameBackend = &GenerationNameBackend{}
+
+func (self *GenerationNameBackend) Init(prefix string, bb BlockBackend) {
+	self.prefix = prefix
+	self.bb = bb
+}
+
+func (self *GenerationNameBackend) blockId(generation uint64) string {
+	return fmt.Sprintf("%s.%d", self.prefix, generation%nameGenerations)
+}
+
+// loadGeneration returns the valid generation in the block, or nil.
+func (self *GenerationNameBackend) loadGeneration(b *Block) *NameGenerationBlock {
+	data := b.GetData()
+	if len(data) < 4 {
+		return nil
+	}
+	if crc32.ChecksumIEEE(data[4:]) != binary.BigEndian.Uint32(data) {
+		mlog.Printf2("storage/generationnames", " invalid checksum in %s", b.Id)
+		return nil
+	}
+	var ngb NameGenerationBlock
+	_, err := ngb.UnmarshalMsg(data[4:])
+	if err != nil {
+		mlog.Printf2("storage/generationnames", " invalid data in %s: %v", b.Id, err)
+		return nil
+	}
+	if self.blockId(ngb.Generation) != b.Id {
+		return nil
+	}
+	return &ngb
+}
+
+func (self *GenerationNameBackend) loadLegacy() *NameGenerationBlock {
+	b := self.bb.GetBlockById(self.prefix)
+	if b == nil {
+		return nil
+	}
+	var nmb NameMapBlock
+	_, err := nmb.UnmarshalMsg(b.GetData())
+	if err != nil {
+		log.Panic(err)
+	}
+	self.legacy = b
+	return &NameGenerationBlock{NameToBlockId: nmb.NameToBlockId}
+}
+
+// get returns the current generation; lock MUST be held.
+func (self *GenerationNameBackend) get() *NameGenerationBlock {
+	if self.current != nil {
+		return self.current
+	}
+	for i := uint64(0); i < nameGenerations; i++ {
+		b := self.bb.GetBlockById(self.blockId(i))
+		if b == nil {
+			continue
+		}
+		ngb := self.loadGeneration(b)
+		if ngb != nil && (self.current == nil || ngb.Generation > self.current.Generation) {
+			self.current = ngb
+		}
+	}
+	if self.current == nil {
+		self.current = self.loadLegacy()
+	}
+	if self.current == nil {
+		self.current = &NameGenerationBlock{NameToBlockId: make(map[string]string)}
+	}
+	mlog.Printf2("storage/generationnames", "gnb.get - generation %d", self.current.Generation)
+	return self.current
+}
+
+// NameGeneration returns the current generation number; it is 0 if the
+// names have never been changed.
+func (self *GenerationNameBackend) NameGeneration() uint64 {
+	defer self.lock.Locked()()
+	return self.get().Generation
+}
+
+func (self *GenerationNameBackend) GetBlockIdByName(name string) string {
+	defer self.lock.Locked()()
+	return self.get().NameToBlockId[name]
+}
+
+func (self *GenerationNameBackend) IterateNames(cb func(name, block_id string)) {
+	self.lock.Lock()
+	names := self.get().NameToBlockId
+	self.lock.Unlock()
+	// The map is never modified once it is current
+	for k, v := range names {
+		cb(k, v)
+	}
+}
+
+func (self *GenerationNameBackend) SetNameToBlockId(name, block_id string) {
+	self.SetNamesToBlockIds(map[string]string{name: block_id})
+}
+
+func (self *GenerationNameBackend) SetNamesToBlockIds(names map[string]string) {
+	defer self.lock.Locked()()
+	old := self.get()
+	ngb := &NameGenerationBlock{Generation: old.Generation + 1,
+		NameToBlockId: make(map[string]string)}
+	for k, v := range old.NameToBlockId {
+		ngb.NameToBlockId[k] = v
+	}
+	for k, v := range names {
+		if v != "" {
+			ngb.NameToBlockId[k] = v
+		} else {
+			delete(ngb.NameToBlockId, k)
+		}
+	}
+	b, err := ngb.MarshalMsg(make([]byte, 4, 4+ngb.Msgsize()))
+	if err != nil {
+		log.Panic(err)
+	}
+	binary.BigEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
+	id := self.blockId(ngb.Generation)
+	mlog.Printf2("storage/generationnames", "gnb.SetNamesToBlockIds %s = generation %d", id, ngb.Generation)
+
+	// Only the oldest generation is removed; the current one
+	// stays valid until the new one is there.
+	ob := self.bb.GetBlockById(id)
+	if ob != nil {
+		self.bb.DeleteBlock(ob)
+	}
+	bl := &Block{Id: id}
+	bl.Data.Set(&b)
+	self.bb.StoreBlock(bl)
+	self.current = ngb
+
+	if self.legacy != nil {
+		self.bb.DeleteBlock(self.legacy)
+		self.legacy = nil
+	}
+}
@@ -22,9 +22,11 @@ import (
 // inMemoryBackend provides In-memory storage; data is always
 // assumed to be available and is just stored in maps.
 type inMemoryBackend struct {
-	id2Block map[string]storage.Block
-	name2Id  map[string]string
-	lock     util.MutexLocked
+	id2Block   map[string]storage.Block
+	name2Id    map[string]string
+	status2Ids map[storage.BlockStatus]map[string]bool
+	used       uint64
+	lock       util.MutexLocked
 }
 
 var _ storage.Backend = &inMemoryBackend{}
@@ -34,6 +36,7 @@ func NewInMemoryBackend() storage.Backend {
 	self := &inMemoryBackend{}
 	self.id2Block = make(map[string]storage.Block)
 	self.name2Id = make(map[string]string)
+	self.status2Ids = make(map[storage.BlockStatus]map[string]bool)
 	return self
 }
 
@@ -52,9 +55,32 @@ func (self *inMemoryBackend) Close() {
 func (self *inMemoryBackend) DeleteBlock(b *storage.Block) {
 	defer self.lock.Locked()()
 	mlog.Printf2("storage/inmemory/inmemory", "im.DeleteBlock %x", b.Id)
+	if ob, ok := self.id2Block[b.Id]; ok {
+		self.setStatus(b.Id, ob.Status, storage.BS_UNSET)
+		self.used -= uint64(len(*ob.Data.Get()))
+	}
 	delete(self.id2Block, b.Id)
 }
 
+// setStatus updates the status index; BS_UNSET is used for blocks
+// that do not exist.
+func (self *inMemoryBackend) setStatus(id string, old, status storage.BlockStatus) {
+	if old == status {
+		return
+	}
+	if old != storage.BS_UNSET {
+		delete(self.status2Ids[old], id)
+	}
+	if status != storage.BS_UNSET {
+		ids, ok := self.status2Ids[status]
+		if !ok {
+			ids = make(map[string]bool)
+			self.status2Ids[status] = ids
+		}
+		ids[id] = true
+	}
+}
+
 func (self *inMemoryBackend) GetBlockData(bl *storage.Block) []byte {
 	defer self.lock.Locked()()
 	b, ok := self.id2Block[bl.Id]
@@ -64,6 +90,35 @@ func (self *inMemoryBackend) GetBlockData(bl *storage.Block) []byte {
 	return *b.Data.Get()
 }
 
+func (self *inMemoryBackend) IterateBlocks(cb func(b *storage.Block)) {
+	self.lock.Lock()
+	blocks := make([]*storage.Block, 0, len(self.id2Block))
+	for _, b := range self.id2Block {
+		b := b
+		b.Backend = self
+		blocks = append(blocks, &b)
+	}
+	self.lock.Unlock()
+	for _, b := range blocks {
+		cb(b)
+	}
+}
+
+func (self *inMemoryBackend) IterateBlocksWithStatus(status storage.BlockStatus, cb func(b *storage.Block)) {
+	self.lock.Lock()
+	ids := self.status2Ids[status]
+	blocks := make([]*storage.Block, 0, len(ids))
+	for id, _ := range ids {
+		b := self.id2Block[id]
+		b.Backend = self
+		blocks = append(blocks, &b)
+	}
+	self.lock.Unlock()
+	for _, b := range blocks {
+		cb(b)
+	}
+}
+
 func (self *inMemoryBackend) GetBlockById(id string) *storage.Block {
 	defer self.lock.Locked()()
 	b, ok := self.id2Block[id]
@@ -78,12 +133,27 @@ func (self *inMemoryBackend) GetBlockIdByName(name string) string {
 	return self.name2Id[name]
 }
 
+func (self *inMemoryBackend) IterateNames(cb func(name, block_id string)) {
+	names := make(map[string]string)
+	self.lock.Lock()
+	for k, v := range self.name2Id {
+		if v != "" {
+			names[k] = v
+		}
+	}
+	self.lock.Unlock()
+	for k, v := range names {
+		cb(k, v)
+	}
+}
+
 func (self *inMemoryBackend) GetBytesAvailable() uint64 {
-	return 0
+	return storage.InMemoryBytesAvailable
 }
 
 func (self *inMemoryBackend) GetBytesUsed() uint64 {
-	return 0
+	defer self.lock.Locked()()
+	return self.used
 }
 
 func (self *inMemoryBackend) SetNameToBlockId(name, block_id string) {
@@ -91,6 +161,13 @@ func (self *inMemoryBackend) SetNameToBlockId(name, block_id string) {
 	self.name2Id[name] = block_id
 }
 
+func (self *inMemoryBackend) SetNamesToBlockIds(names map[string]string) {
+	defer self.lock.Locked()()
+	for k, v := range names {
+		self.name2Id[k] = v
+	}
+}
+
 func (self *inMemoryBackend) StoreBlock(b *storage.Block) {
 	defer self.lock.Locked()()
 	_, ok := self.id2Block[b.Id]
@@ -101,18 +178,38 @@ func (self *inMemoryBackend) StoreBlock(b *storage.Block) {
 	nb := *b
 	nb.Backend = self
 	self.id2Block[b.Id] = nb
+	self.setStatus(b.Id, storage.BS_UNSET, b.Status)
+	self.used += uint64(len(*b.Data.Get()))
 }
 
 func (self *inMemoryBackend) UpdateBlock(b *storage.Block) int {
 	defer self.lock.Locked()()
-	_, ok := self.id2Block[b.Id]
+	ob, ok := self.id2Block[b.Id]
 	if !ok {
 		log.Panic("Non-existent block id in StoreBlock")
 	}
 	mlog.Printf2("storage/inmemory/inmemory", "im.UpdateBlock %x", b.Id)
+	self.setStatus(b.Id, ob.Status, b.Status)
+	ob.BlockMetadata = b.BlockMetadata
+	self.id2Block[b.Id] = ob
 	return 1
 }
 
+func (self *inMemoryBackend) ReplaceBlock(b *storage.Block) {
+	defer self.lock.Locked()()
+	ob, ok := self.id2Block[b.Id]
+	if !ok {
+		log.Panic("Non-existent block id in ReplaceBlock")
+	}
+	mlog.Printf2("storage/inmemory/inmemory", "im.ReplaceBlock %x", b.Id)
+	self.used -= uint64(len(*ob.Data.Get()))
+	self.setStatus(b.Id, ob.Status, b.Status)
+	nb := *b
+	nb.Backend = self
+	self.id2Block[b.Id] = nb
+	self.used += uint64(len(*b.Data.Get()))
+}
+
 func (self *inMemoryBackend) Supports(feature storage.BackendFeature) bool {
 	return false
 }
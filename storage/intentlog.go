@@ -0,0 +1,269 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Mon Apr  9 10:12:31 2018 mstenber
+ * Last modified: Thu Apr 12 10:02:17 2018 mstenber
+ * Edit time:     131 min
+ *
+ */
+
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// IntentLogFilename is the name of the intent log within the storage
+// directory.
+const IntentLogFilename = "intent.log"
+
+// intentLogHeaderSize is the size of the header preceding each
+// record: 4 bytes of length, and 4 bytes of CRC32 of the record.
+const intentLogHeaderSize = 8
+
+// intentLog is append-only write-ahead log of the changes done to
+// the storage since the last flush. The records are buffered until
+// sync, and the log is truncated once flush has persisted
+// everything in the backend.
+type intentLog struct {
+	lock   util.MutexLocked
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// recordMarshaler and recordUnmarshaler are implemented by the
+// greenpack types framed with writeRecord/readRecord.
+type recordMarshaler interface {
+	MarshalMsg(b []byte) ([]byte, error)
+	Msgsize() int
+}
+
+type recordUnmarshaler interface {
+	UnmarshalMsg(b []byte) ([]byte, error)
+}
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// encodeRecord returns the record with the header prepended.
+func encodeRecord(r recordMarshaler) []byte {
+	b, err := r.MarshalMsg(make([]byte, intentLogHeaderSize, intentLogHeaderSize+r.Msgsize()))
+	if err != nil {
+		log.Panic(err)
+	}
+	payload := b[intentLogHeaderSize:]
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(payload))
+	return b
+}
+
+// readRecord reads the next record written by encodeRecord. io.EOF
+// is returned only if there is nothing left at all.
+func readRecord(r io.Reader, m recordUnmarshaler) error {
+	var h [intentLogHeaderSize]byte
+	_, err := io.ReadFull(r, h[:])
+	if err != nil {
+		return err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(h[:]))
+	_, err = io.ReadFull(r, b)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(b) != binary.BigEndian.Uint32(h[4:]) {
+		return errCorruptRecord
+	}
+	_, err = m.UnmarshalMsg(b)
+	return err
+}
+
+// openIntentLog opens (or creates) the intent log at path, and
+// returns it and the records in it. Reading stops at the first
+// incomplete or corrupt record, as the rest of the log was never
+// synced.
+func openIntentLog(path string) (*intentLog, []*IntentLogRecord) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+	records := make([]*IntentLogRecord, 0)
+	br := bufio.NewReader(f)
+	for {
+		var r IntentLogRecord
+		err = readRecord(br, &r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF || err == errCorruptRecord {
+			mlog.Printf2("storage/intentlog", "torn record at end of %s", path)
+			break
+		}
+		if err != nil {
+			log.Panic(err)
+		}
+		records = append(records, &r)
+	}
+	return &intentLog{file: f, writer: bufio.NewWriter(f)}, records
+}
+
+func (self *intentLog) append(r *IntentLogRecord) {
+	b := encodeRecord(r)
+	defer self.lock.Locked()()
+	_, err := self.writer.Write(b)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// sync ensures everything appended so far is on disk.
+func (self *intentLog) sync() {
+	defer self.lock.Locked()()
+	err := self.writer.Flush()
+	if err != nil {
+		log.Panic(err)
+	}
+	err = self.file.Sync()
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// truncate drops all records; they MUST have been persisted
+// elsewhere.
+func (self *intentLog) truncate() {
+	defer self.lock.Locked()()
+	self.writer.Reset(self.file)
+	err := self.file.Truncate(0)
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = self.file.Seek(0, io.SeekStart)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (self *intentLog) close() {
+	self.sync()
+	self.file.Close()
+}
+
+// logBlock records new block in the intent log (if any). The data is
+// encoded with StreamCodec, as Codec is nop if the backend encodes
+// the blocks itself (and the log would then contain plaintext).
+func (self *Storage) logBlock(id string, status BlockStatus, data []byte) {
+	if self.intentLog == nil {
+		return
+	}
+	r := &IntentLogRecord{Type: ILR_BLOCK, Id: id, Status: status}
+	if len(data) > 0 {
+		var err error
+		r.Data, err = self.StreamCodec.EncodeBytes(data, []byte(id))
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	self.intentLog.append(r)
+}
+
+func (self *Storage) logStatus(id string, status BlockStatus) {
+	if self.intentLog == nil {
+		return
+	}
+	self.intentLog.append(&IntentLogRecord{Type: ILR_STATUS, Id: id,
+		Status: status})
+}
+
+func (self *Storage) logNames(names map[string]string) {
+	if self.intentLog == nil {
+		return
+	}
+	if len(names) == 1 {
+		for name, id := range names {
+			self.intentLog.append(&IntentLogRecord{Type: ILR_NAME,
+				Id: id, Name: name})
+		}
+		return
+	}
+	self.intentLog.append(&IntentLogRecord{Type: ILR_NAMES, Names: names})
+}
+
+// ReplayIntentLog applies the records left in the intent log (if
+// IntentLog is set) by previous user of the storage, flushes the
+// result to the backend, and starts logging. It MUST be called
+// before the names are used (hugger.Hugger does it in RootIsNew), and
+// after IterateReferencesCallback has been set. Subsequent calls do
+// nothing.
+func (self *Storage) ReplayIntentLog() {
+	if self.IntentLog == "" {
+		return
+	}
+	self.intentLogOnce.Do(func() {
+		il, records := openIntentLog(self.IntentLog)
+		mlog.Printf2("storage/intentlog", "st.ReplayIntentLog %d records", len(records))
+		// The blocks are kept referenced until all names are
+		// set; after flush only the blocks referred to (by
+		// names or other blocks) remain
+		blocks := make([]*StorageBlock, 0)
+		for _, r := range records {
+			switch r.Type {
+			case ILR_BLOCK:
+				var data []byte
+				if len(r.Data) > 0 {
+					var err error
+					data, err = self.StreamCodec.DecodeBytes(r.Data, []byte(r.Id))
+					if err != nil && self.VerifyBlockId(r.Id, r.Data) {
+						// Plaintext written by older version
+						data, err = r.Data, nil
+					}
+					if err != nil {
+						log.Panic(err)
+					}
+				}
+				blocks = append(blocks, self.ReferOrStoreBlock0(r.Id, r.Status, data, nil))
+			case ILR_STATUS:
+				b := self.GetBlockById(r.Id)
+				if b != nil {
+					b.SetStatus(r.Status)
+					b.Close()
+				}
+			case ILR_NAME:
+				self.SetNameToBlockId(r.Name, r.Id)
+			case ILR_NAMES:
+				self.SetNamesToBlockIds(r.Names)
+			default:
+				log.Panicf("invalid intent log record type %v", r.Type)
+			}
+		}
+		for _, b := range blocks {
+			b.Close()
+		}
+		self.Flush()
+		il.truncate()
+		self.intentLog = il
+	})
+}
+
+// SyncIntentLog ensures that everything done to the storage so far
+// survives a crash, by syncing the intent log to disk. If there is
+// no intent log, it returns false; Flush has to be used instead.
+func (self *Storage) SyncIntentLog() bool {
+	if self.intentLog == nil {
+		return false
+	}
+	self.intentLog.sync()
+	return true
+}
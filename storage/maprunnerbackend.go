@@ -82,6 +82,20 @@ func (self *mapRunnerBackend) GetBlockById(id string) *Block {
 	return fut.Get()
 }
 
+func (self *mapRunnerBackend) IterateBlocks(cb func(b *Block)) {
+	self.Backend.IterateBlocks(func(bl *Block) {
+		bl.Backend = self
+		cb(bl)
+	})
+}
+
+func (self *mapRunnerBackend) IterateBlocksWithStatus(status BlockStatus, cb func(b *Block)) {
+	self.Backend.IterateBlocksWithStatus(status, func(bl *Block) {
+		bl.Backend = self
+		cb(bl)
+	})
+}
+
 func (self *mapRunnerBackend) StoreBlock(b *Block) {
 	b = b.copy()
 	self.runWithBlock(b, func() {
@@ -89,6 +103,13 @@ func (self *mapRunnerBackend) StoreBlock(b *Block) {
 	})
 }
 
+func (self *mapRunnerBackend) ReplaceBlock(b *Block) {
+	b = b.copy()
+	self.runWithBlock(b, func() {
+		self.Backend.ReplaceBlock(b)
+	})
+}
+
 func (self *mapRunnerBackend) UpdateBlock(b *Block) int {
 	b = b.copy()
 	self.runWithBlock(b, func() {
@@ -0,0 +1,289 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Thu Apr 12 13:10:44 2018 mstenber
+ * Last modified: Thu Apr 12 15:02:19 2018 mstenber
+ * Edit time:     88 min
+ *
+ */
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// mirrorBackend keeps the same blocks and names in two backends
+// (RAID1-style). Changes go to both; reads come from the first one,
+// and if its copy is missing, from the second one, which is then
+// used to repair the first one. Copies that do not match the block
+// id are detected by Storage (once it has decoded the data), which
+// then calls heal.
+//
+// The child backends are given subdirectories mirror0 and mirror1
+// of the directory (they can be e.g. symlinks to different disks).
+type mirrorBackend struct {
+	proxyBackend
+	second Backend
+
+	// verify checks the data returned by a child; it is set by
+	// Storage. If it is not set, heal detects only missing data.
+	verify func(id string, data []byte) bool
+
+	repaired util.AtomicInt
+}
+
+var _ Backend = &mirrorBackend{}
+
+// NewMirrorBackend returns backend that mirrors everything to both
+// first and second.
+func NewMirrorBackend(first, second Backend) Backend {
+	self := &mirrorBackend{second: second}
+	self.Backend = first
+	return self
+}
+
+func (self *mirrorBackend) children() []Backend {
+	return []Backend{self.Backend, self.second}
+}
+
+func (self *mirrorBackend) Init(config BackendConfiguration) {
+	self.BackendConfiguration = config
+	// Codec can be left to the children only if both handle it
+	if !self.Supports(CodecFeature) {
+		config.Codec = nil
+	}
+	for i, be := range self.children() {
+		cconfig := config
+		if config.Directory != "" {
+			cconfig.Directory = filepath.Join(config.Directory,
+				fmt.Sprintf("mirror%d", i))
+			os.MkdirAll(cconfig.Directory, 0700)
+		}
+		be.Init(cconfig)
+	}
+}
+
+func (self *mirrorBackend) Flush() {
+	for _, be := range self.children() {
+		be.Flush()
+	}
+}
+
+func (self *mirrorBackend) Close() {
+	mlog.Printf2("storage/mirrorbackend", "mb.Close - %d repaired", self.repaired.Get())
+	for _, be := range self.children() {
+		be.Close()
+	}
+}
+
+func (self *mirrorBackend) Supports(feature BackendFeature) bool {
+	return self.Backend.Supports(feature) && self.second.Supports(feature)
+}
+
+// childData returns the data of block in the child, if it has valid
+// copy of it.
+func (self *mirrorBackend) childData(be Backend, b *Block) []byte {
+	cb := be.GetBlockById(b.Id)
+	if cb == nil {
+		return nil
+	}
+	data := be.GetBlockData(cb)
+	// Blocks without status are backend-internal
+	if data == nil || b.Status == BS_UNSET || self.verify == nil || self.verify(b.Id, data) {
+		return data
+	}
+	mlog.Printf2("storage/mirrorbackend", " invalid copy of %x", b.Id)
+	return nil
+}
+
+// repair replaces the copy of the block in the child.
+func (self *mirrorBackend) repair(be Backend, b *Block, data []byte) {
+	mlog.Printf2("storage/mirrorbackend", "mb.repair %x", b.Id)
+	nb := &Block{Id: b.Id, BlockMetadata: b.BlockMetadata}
+	nb.Data.Set(&data)
+	if be.GetBlockById(b.Id) != nil {
+		be.ReplaceBlock(nb)
+	} else {
+		be.StoreBlock(nb)
+	}
+	self.repaired.AddInt(1)
+}
+
+func (self *mirrorBackend) GetBlockData(b *Block) []byte {
+	if cb := self.Backend.GetBlockById(b.Id); cb != nil {
+		data := self.Backend.GetBlockData(cb)
+		if data != nil {
+			return data
+		}
+	}
+	data := self.childData(self.second, b)
+	if data != nil {
+		self.repair(self.Backend, b, data)
+	}
+	return data
+}
+
+// heal checks the copies of the block in both children, and replaces
+// the missing or invalid ones with a valid one. It returns valid
+// data of the block, or nil if there is no valid copy.
+func (self *mirrorBackend) heal(b *Block) (data []byte) {
+	mlog.Printf2("storage/mirrorbackend", "mb.heal %x", b.Id)
+	bad := make([]Backend, 0)
+	for _, be := range self.children() {
+		cdata := self.childData(be, b)
+		if cdata == nil {
+			bad = append(bad, be)
+		} else if data == nil {
+			data = cdata
+		}
+	}
+	if data != nil {
+		for _, be := range bad {
+			self.repair(be, b, data)
+		}
+	}
+	return
+}
+
+func (self *mirrorBackend) GetBlockById(id string) *Block {
+	b := self.Backend.GetBlockById(id)
+	if b == nil {
+		b = self.second.GetBlockById(id)
+		if b == nil {
+			return nil
+		}
+		data := self.childData(self.second, b)
+		if data != nil {
+			self.repair(self.Backend, b, data)
+		}
+	}
+	// Data (if set by the child) is cleared, so that it is read
+	// (and verified) via GetBlockData
+	nb := *b
+	nb.Backend = self
+	nb.Data.Set(nil)
+	return &nb
+}
+
+func (self *mirrorBackend) IterateBlocks(cb func(b *Block)) {
+	self.Backend.IterateBlocks(func(b *Block) {
+		b.Backend = self
+		b.Data.Set(nil)
+		cb(b)
+	})
+}
+
+func (self *mirrorBackend) IterateBlocksWithStatus(status BlockStatus, cb func(b *Block)) {
+	self.Backend.IterateBlocksWithStatus(status, func(b *Block) {
+		b.Backend = self
+		b.Data.Set(nil)
+		cb(b)
+	})
+}
+
+func (self *mirrorBackend) GetBlockIdByName(name string) string {
+	id := self.Backend.GetBlockIdByName(name)
+	if id == "" {
+		id = self.second.GetBlockIdByName(name)
+	}
+	return id
+}
+
+// IterateNames iterates the names of both children; like with
+// GetBlockIdByName, the first child takes precedence.
+func (self *mirrorBackend) IterateNames(cb func(name, block_id string)) {
+	seen := make(map[string]bool)
+	self.Backend.IterateNames(func(name, block_id string) {
+		seen[name] = true
+		cb(name, block_id)
+	})
+	self.second.IterateNames(func(name, block_id string) {
+		if !seen[name] {
+			cb(name, block_id)
+		}
+	})
+}
+
+// GetBytesAvailable returns what is available in the fuller child
+func (self *mirrorBackend) GetBytesAvailable() uint64 {
+	a1 := self.Backend.GetBytesAvailable()
+	a2 := self.second.GetBytesAvailable()
+	if a2 < a1 {
+		return a2
+	}
+	return a1
+}
+
+// GetBytesUsed returns what is used in the fuller child
+func (self *mirrorBackend) GetBytesUsed() uint64 {
+	u1 := self.Backend.GetBytesUsed()
+	u2 := self.second.GetBytesUsed()
+	if u2 > u1 {
+		return u2
+	}
+	return u1
+}
+
+// DeleteBlock and UpdateBlock skip children that lack the block
+// (e.g. due to earlier failure), as they MUST NOT be called for
+// missing blocks.
+
+func (self *mirrorBackend) DeleteBlock(b *Block) {
+	for _, be := range self.children() {
+		cb := be.GetBlockById(b.Id)
+		if cb != nil {
+			be.DeleteBlock(cb)
+		}
+	}
+}
+
+func (self *mirrorBackend) UpdateBlock(b *Block) int {
+	r := 0
+	for i, be := range self.children() {
+		if be.GetBlockById(b.Id) == nil {
+			continue
+		}
+		v := be.UpdateBlock(b)
+		if i == 0 {
+			r = v
+		}
+	}
+	return r
+}
+
+// ReplaceBlock stores the block also in children that lack it.
+func (self *mirrorBackend) ReplaceBlock(b *Block) {
+	for _, be := range self.children() {
+		if be.GetBlockById(b.Id) != nil {
+			be.ReplaceBlock(b)
+		} else {
+			be.StoreBlock(b)
+		}
+	}
+}
+
+func (self *mirrorBackend) StoreBlock(b *Block) {
+	for _, be := range self.children() {
+		be.StoreBlock(b)
+	}
+}
+
+func (self *mirrorBackend) SetNameToBlockId(name, block_id string) {
+	for _, be := range self.children() {
+		be.SetNameToBlockId(name, block_id)
+	}
+}
+
+func (self *mirrorBackend) SetNamesToBlockIds(names map[string]string) {
+	for _, be := range self.children() {
+		be.SetNamesToBlockIds(names)
+	}
+}
@@ -57,10 +57,28 @@ func (self *proxyBackend) GetBlockById(id string) *Block {
 	return bl
 }
 
+func (self *proxyBackend) IterateBlocks(cb func(b *Block)) {
+	self.Backend.IterateBlocks(func(bl *Block) {
+		bl.Backend = self
+		cb(bl)
+	})
+}
+
+func (self *proxyBackend) IterateBlocksWithStatus(status BlockStatus, cb func(b *Block)) {
+	self.Backend.IterateBlocksWithStatus(status, func(bl *Block) {
+		bl.Backend = self
+		cb(bl)
+	})
+}
+
 func (self *proxyBackend) GetBlockIdByName(name string) string {
 	return self.Backend.GetBlockIdByName(name)
 }
 
+func (self *proxyBackend) IterateNames(cb func(name, block_id string)) {
+	self.Backend.IterateNames(cb)
+}
+
 func (self *proxyBackend) GetBytesAvailable() uint64 {
 	return self.Backend.GetBytesAvailable()
 }
@@ -73,10 +91,18 @@ func (self *proxyBackend) SetNameToBlockId(name, block_id string) {
 	self.Backend.SetNameToBlockId(name, block_id)
 }
 
+func (self *proxyBackend) SetNamesToBlockIds(names map[string]string) {
+	self.Backend.SetNamesToBlockIds(names)
+}
+
 func (self *proxyBackend) StoreBlock(b *Block) {
 	self.Backend.StoreBlock(b)
 }
 
+func (self *proxyBackend) ReplaceBlock(b *Block) {
+	self.Backend.ReplaceBlock(b)
+}
+
 func (self *proxyBackend) Supports(feature BackendFeature) bool {
 	return self.Backend.Supports(feature)
 }
@@ -0,0 +1,90 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Thu Apr  5 10:02:11 2018 mstenber
+ * Last modified: Thu Apr  5 10:48:30 2018 mstenber
+ * Edit time:     46 min
+ *
+ */
+
+package storage
+
+import "github.com/fingon/go-tfhfs/mlog"
+
+// PendingBytes returns the amount of block data that has not been
+// stored in the backend yet.
+func (self *Storage) PendingBytes() int64 {
+	return self.pendingBytes.Get()
+}
+
+// TierBytesUsed returns the number of bytes used by each tier of the
+// backend, or nil if it does not have tiers.
+func (self *Storage) TierBytesUsed() map[string]uint64 {
+	if self.tieredBackend == nil {
+		return nil
+	}
+	return self.tieredBackend.GetTierBytesUsed()
+}
+
+// BytesUsed returns the number of bytes used by the backend.
+func (self *Storage) BytesUsed() uint64 {
+	return self.Backend.GetBytesUsed()
+}
+
+// BytesTotal returns the size of the store; it is the Quota, if
+// set, and otherwise whatever the backend uses or has available.
+func (self *Storage) BytesTotal() uint64 {
+	if self.Quota > 0 {
+		return self.Quota
+	}
+	return self.Backend.GetBytesUsed() + self.Backend.GetBytesAvailable()
+}
+
+// SpaceReserve is the amount of backend space that is not given out
+// by BytesAvailable. HasSpace is checked only before writes are
+// accepted, and the backend needs still room for the metadata
+// (e.g. names and the status index) that is written afterwards.
+const SpaceReserve = 64 << 20
+
+// BytesAvailable returns the number of bytes that can be still
+// written, taking into account the Quota (if any), the space
+// available to the backend (minus SpaceReserve), and the data that
+// is pending to be written to the backend.
+func (self *Storage) BytesAvailable() uint64 {
+	avail := self.Backend.GetBytesAvailable()
+	if avail > SpaceReserve {
+		avail -= SpaceReserve
+	} else {
+		avail = 0
+	}
+	if self.Quota > 0 {
+		used := self.Backend.GetBytesUsed()
+		if used >= self.Quota {
+			return 0
+		}
+		if self.Quota-used < avail {
+			avail = self.Quota - used
+		}
+	}
+	pending := uint64(self.PendingBytes())
+	if pending >= avail {
+		return 0
+	}
+	return avail - pending
+}
+
+// HasSpace returns true if there is room for n more bytes of data.
+func (self *Storage) HasSpace(n int) bool {
+	if self.IsOutOfSpace() {
+		mlog.Printf2("storage/quota", "st.HasSpace - out of space")
+		return false
+	}
+	avail := self.BytesAvailable()
+	if uint64(n) > avail {
+		mlog.Printf2("storage/quota", "st.HasSpace %d > %d", n, avail)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Fri Apr  6 09:20:33 2018 mstenber
+ * Last modified: Fri Apr  6 10:47:12 2018 mstenber
+ * Edit time:     71 min
+ *
+ */
+
+package storage
+
+import (
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// Typical size of a block; used to bound the number of entries (and
+// the history) of the read cache
+const readCacheAverageBlockSize = 4096
+
+// readCache caches (decoded) block data by block id. As ids are
+// derived from the data, entries never need to be invalidated.
+type readCache struct {
+	cart         BlockDataCart
+	lock         util.MutexLocked
+	hits, misses util.AtomicInt
+}
+
+func newReadCache(size int) *readCache {
+	self := &readCache{}
+	self.cart.Size = func(value *[]byte) int {
+		return len(*value)
+	}
+	self.cart.MaximumSize = size
+	self.cart.Init(util.IMax(1, size/readCacheAverageBlockSize))
+	return self
+}
+
+func (self *readCache) get(id string) []byte {
+	defer self.lock.Locked()()
+	v, found := self.cart.Get(id)
+	if !found {
+		self.misses.Add(1)
+		return nil
+	}
+	self.hits.Add(1)
+	return *v
+}
+
+func (self *readCache) set(id string, data []byte) {
+	defer self.lock.Locked()()
+	self.cart.Set(id, &data)
+}
+
+// getBlockData returns the data of the block, from the read cache if
+// possible.
+func (self *Storage) getBlockData(b *Block) []byte {
+	if self.readCache != nil {
+		data := self.readCache.get(b.Id)
+		if data != nil {
+			mlog.Printf2("storage/readcache", "st.getBlockData %x cached", b.Id)
+			return data
+		}
+	}
+	data := self.Backend.GetBlockData(b)
+	// Invalid copy of mirror can be replaced with the other one
+	if self.mirrorBackend != nil &&
+		(b.Status == BS_NORMAL || b.Status == BS_WEAK) &&
+		(data == nil || !self.VerifyBlockId(b.Id, data)) {
+		if self.mirrorBackend.heal(b) != nil {
+			data = self.Backend.GetBlockData(b)
+		}
+	}
+	self.counters[C_READ].AddInt(1)
+	self.counters[C_READBYTES].AddInt(len(data))
+	// Only data of BS_NORMAL blocks is cached; e.g. BS_MISSING
+	// blocks have (empty) data until they are fetched
+	if self.readCache != nil && data != nil && b.Status == BS_NORMAL {
+		self.readCache.set(b.Id, data)
+	}
+	return data
+}
+
+// ReadCacheStatistics returns the number of hits and misses of the
+// read cache.
+func (self *Storage) ReadCacheStatistics() (hits, misses int64) {
+	if self.readCache == nil {
+		return
+	}
+	return self.readCache.hits.Get(), self.readCache.misses.Get()
+}
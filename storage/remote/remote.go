@@ -0,0 +1,265 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Tue Apr 17 11:25:02 2018 mstenber
+ * Last modified: Tue Apr 17 13:48:31 2018 mstenber
+ * Edit time:     102 min
+ *
+ */
+
+// remote package provides backend which stores everything in the
+// volume of a tfhfs server (see server/volume.go).
+package remote
+
+import (
+	"context"
+	"log"
+
+	"github.com/fingon/go-tfhfs/codec"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/pb"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// DefaultCacheSize is the default number of bytes of (encoded) block
+// data that is cached locally.
+const DefaultCacheSize = 64 << 20
+
+// Typical size of a block; used to bound the number of cache entries
+const cacheAverageBlockSize = 4096
+
+// remoteBackend keeps the blocks and names in the server. It handles
+// the codec itself, so the data is encoded (and encrypted) before it
+// leaves the client; the server has only the ciphertext. The
+// fetched (encoded) data is cached locally; as the ids are derived
+// from the data, the cache never needs to be invalidated.
+type remoteBackend struct {
+	storage.BackendConfiguration
+	client    pb.Fs
+	cache     BlockDataCart
+	cacheLock util.MutexLocked
+}
+
+var _ storage.Backend = &remoteBackend{}
+
+func NewRemoteBackend(client pb.Fs) storage.Backend {
+	return &remoteBackend{client: client}
+}
+
+func (self *remoteBackend) Init(config storage.BackendConfiguration) {
+	self.BackendConfiguration = config
+	if self.Codec == nil {
+		self.Codec = codec.CodecChain{}.Init()
+	}
+	size := config.RemoteCacheSize
+	if size == 0 {
+		size = DefaultCacheSize
+	}
+	self.cache.Size = func(value *[]byte) int {
+		return len(*value)
+	}
+	self.cache.MaximumSize = size
+	self.cache.Init(util.IMax(1, size/cacheAverageBlockSize))
+}
+
+func (self *remoteBackend) Flush() {
+	_, err := self.client.FlushVolume(context.Background(), &pb.VolumeRequest{})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (self *remoteBackend) Close() {
+}
+
+func (self *remoteBackend) block(vb *pb.VolumeBlock) *storage.Block {
+	return &storage.Block{Id: vb.Id, Backend: self,
+		BlockMetadata: storage.BlockMetadata{RefCount: vb.RefCount,
+			Status: storage.BlockStatus(vb.Status)}}
+}
+
+func (self *remoteBackend) GetBlockById(id string) *storage.Block {
+	mlog.Printf2("storage/remote/remote", "rb.GetBlockById %x", id)
+	vb, err := self.client.GetVolumeBlock(context.Background(),
+		&pb.GetBlockRequest{Id: id})
+	if err != nil {
+		log.Panic(err)
+	}
+	if vb.Id == "" {
+		return nil
+	}
+	return self.block(vb)
+}
+
+func (self *remoteBackend) cached(id string) []byte {
+	defer self.cacheLock.Locked()()
+	v, found := self.cache.Get(id)
+	if !found {
+		return nil
+	}
+	return *v
+}
+
+func (self *remoteBackend) setCached(id string, data []byte) {
+	defer self.cacheLock.Locked()()
+	self.cache.Set(id, &data)
+}
+
+func (self *remoteBackend) GetBlockData(b *storage.Block) []byte {
+	data := self.cached(b.Id)
+	if data == nil {
+		mlog.Printf2("storage/remote/remote", "rb.GetBlockData %x", b.Id)
+		vb, err := self.client.GetVolumeBlock(context.Background(),
+			&pb.GetBlockRequest{Id: b.Id, WantData: true})
+		if err != nil {
+			log.Panic(err)
+		}
+		if vb.Id == "" {
+			log.Panic("Non-existent block id in GetBlockData")
+		}
+		data = []byte(vb.Data)
+		self.setCached(b.Id, data)
+	}
+	plain, err := self.Codec.DecodeBytes(data, []byte(b.Id))
+	if err != nil {
+		log.Panic("Decoding failed", err)
+	}
+	return plain
+}
+
+func (self *remoteBackend) StoreBlock(b *storage.Block) {
+	mlog.Printf2("storage/remote/remote", "rb.StoreBlock %x", b.Id)
+	data, err := self.Codec.EncodeBytes(*b.Data.Get(), []byte(b.Id))
+	if err != nil {
+		log.Panic("Encoding failed", err)
+	}
+	_, err = self.client.StoreVolumeBlock(context.Background(),
+		&pb.VolumeBlock{Id: b.Id, RefCount: b.RefCount,
+			Status: int32(b.Status), Data: string(data)})
+	if err != nil {
+		log.Panic(err)
+	}
+	self.setCached(b.Id, data)
+}
+
+func (self *remoteBackend) ReplaceBlock(b *storage.Block) {
+	mlog.Printf2("storage/remote/remote", "rb.ReplaceBlock %x", b.Id)
+	data, err := self.Codec.EncodeBytes(*b.Data.Get(), []byte(b.Id))
+	if err != nil {
+		log.Panic("Encoding failed", err)
+	}
+	_, err = self.client.ReplaceVolumeBlock(context.Background(),
+		&pb.VolumeBlock{Id: b.Id, RefCount: b.RefCount,
+			Status: int32(b.Status), Data: string(data)})
+	if err != nil {
+		log.Panic(err)
+	}
+	self.setCached(b.Id, data)
+}
+
+func (self *remoteBackend) UpdateBlock(b *storage.Block) int {
+	mlog.Printf2("storage/remote/remote", "rb.UpdateBlock %x", b.Id)
+	_, err := self.client.UpdateVolumeBlock(context.Background(),
+		&pb.VolumeBlock{Id: b.Id, RefCount: b.RefCount,
+			Status: int32(b.Status)})
+	if err != nil {
+		log.Panic(err)
+	}
+	return 1
+}
+
+func (self *remoteBackend) DeleteBlock(b *storage.Block) {
+	mlog.Printf2("storage/remote/remote", "rb.DeleteBlock %x", b.Id)
+	_, err := self.client.DeleteVolumeBlock(context.Background(),
+		&pb.BlockId{Id: b.Id})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// iterateLimit is the number of blocks requested at once.
+const iterateLimit = 1000
+
+// iterate fetches the blocks a page at a time; blocks changed in the
+// meanwhile may or may not be seen, but no block is seen twice.
+func (self *remoteBackend) iterate(req *pb.IterateRequest, cb func(b *storage.Block)) {
+	req.Limit = iterateLimit
+	for {
+		res, err := self.client.IterateVolumeBlocks(context.Background(), req)
+		if err != nil {
+			log.Panic(err)
+		}
+		for _, vb := range res.Blocks {
+			cb(self.block(vb))
+		}
+		if !res.More || len(res.Blocks) == 0 {
+			return
+		}
+		req.StartId = res.Blocks[len(res.Blocks)-1].Id
+	}
+}
+
+func (self *remoteBackend) IterateBlocks(cb func(b *storage.Block)) {
+	self.iterate(&pb.IterateRequest{All: true}, cb)
+}
+
+func (self *remoteBackend) IterateBlocksWithStatus(status storage.BlockStatus, cb func(b *storage.Block)) {
+	self.iterate(&pb.IterateRequest{Status: int32(status)}, cb)
+}
+
+func (self *remoteBackend) GetBlockIdByName(name string) string {
+	res, err := self.client.GetVolumeBlockIdByName(context.Background(),
+		&pb.BlockName{Name: name})
+	if err != nil {
+		log.Panic(err)
+	}
+	return res.Id
+}
+
+func (self *remoteBackend) IterateNames(cb func(name, block_id string)) {
+	res, err := self.client.GetVolumeNames(context.Background(),
+		&pb.VolumeRequest{})
+	if err != nil {
+		log.Panic(err)
+	}
+	for k, v := range res.Names {
+		cb(k, v)
+	}
+}
+
+func (self *remoteBackend) SetNameToBlockId(name, block_id string) {
+	self.SetNamesToBlockIds(map[string]string{name: block_id})
+}
+
+func (self *remoteBackend) SetNamesToBlockIds(names map[string]string) {
+	mlog.Printf2("storage/remote/remote", "rb.SetNamesToBlockIds %v", names)
+	_, err := self.client.SetVolumeNames(context.Background(),
+		&pb.SetNamesRequest{Names: names})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (self *remoteBackend) usage() *pb.VolumeUsage {
+	res, err := self.client.GetVolumeUsage(context.Background(),
+		&pb.VolumeRequest{})
+	if err != nil {
+		log.Panic(err)
+	}
+	return res
+}
+
+func (self *remoteBackend) GetBytesAvailable() uint64 {
+	return self.usage().BytesAvailable
+}
+
+func (self *remoteBackend) GetBytesUsed() uint64 {
+	return self.usage().BytesUsed
+}
+
+func (self *remoteBackend) Supports(feature storage.BackendFeature) bool {
+	return feature == storage.CodecFeature
+}
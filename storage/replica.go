@@ -0,0 +1,110 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Wed Apr 18 09:05:17 2018 mstenber
+ * Last modified: Wed Apr 18 12:31:44 2018 mstenber
+ * Edit time:     113 min
+ *
+ */
+
+package storage
+
+import (
+	"sync/atomic"
+
+	"github.com/fingon/go-tfhfs/mlog"
+)
+
+// Partial replicas do not have the data of every block. Evicted
+// blocks stay in the backend with BS_MISSING status (and no data),
+// so their reference counts are still maintained, and their data is
+// fetched back from ReplicaPeer when needed.
+
+// EvictBlock drops the data of the block, leaving it with
+// BS_MISSING status. Only blocks that are not needed to reach other
+// blocks (e.g. file extents) should be evicted; blocks referring to
+// other blocks, as well as ones that are not in the backend yet,
+// have unflushed changes or are open (someone may be reading them),
+// are left alone. The return value is the number of bytes of data
+// dropped.
+func (self *Storage) EvictBlock(id string) (n int) {
+	mlog.Printf2("storage/replica", "st.EvictBlock %x", id)
+	defer self.job(jobEvictBlock)()
+	self.withBlockId(id, func() {
+		ob, found := self.shardFor(id).blocks[id]
+		if found && (ob.Stored != nil || ob.Status != BS_NORMAL ||
+			atomic.LoadInt32(&ob.externalStorageRefCount) > 0) {
+			return
+		}
+		b := self.Backend.GetBlockById(id)
+		if b == nil || b.Status != BS_NORMAL {
+			return
+		}
+		data := self.Backend.GetBlockData(b)
+		if self.IterateReferencesCallback != nil {
+			refs := 0
+			self.IterateReferencesCallback(id, data, func(id string) {
+				refs++
+			})
+			if refs > 0 {
+				return
+			}
+		}
+		nb := &Block{Id: id, BlockMetadata: b.BlockMetadata}
+		nb.Status = BS_MISSING
+		empty := []byte{}
+		nb.Data.Set(&empty)
+		self.Backend.ReplaceBlock(nb)
+		if found {
+			ob.Status = BS_MISSING
+			ob.Data.Set(nil)
+		}
+		n = len(data)
+	})
+	return
+}
+
+// restoreBlock stores the data of BS_MISSING block in the
+// backend. The shard of the block must be locked.
+func (self *Storage) restoreBlock(id string, data []byte) {
+	mlog.Printf2("storage/replica", "st.restoreBlock %x", id)
+	// The block may be also only in memory (e.g. stub from
+	// metadata-only sync that has not been flushed yet)
+	b := self.Backend.GetBlockById(id)
+	if b != nil && b.Status == BS_MISSING {
+		nb := &Block{Id: id, BlockMetadata: b.BlockMetadata}
+		nb.Status = BS_NORMAL
+		nb.Data.Set(&data)
+		self.Backend.ReplaceBlock(nb)
+	}
+	if ob, found := self.shardFor(id).blocks[id]; found {
+		if ob.Status == BS_MISSING {
+			ob.Status = BS_NORMAL
+		}
+		if ob.Stored != nil && ob.Stored.Status == BS_MISSING {
+			ob.Stored.Status = BS_NORMAL
+		}
+		ob.Data.Set(&data)
+	}
+}
+
+// FetchBlock fetches the data of BS_MISSING block from ReplicaPeer,
+// and stores it locally. The return value is true if the data is
+// available locally afterwards.
+func (self *Storage) FetchBlock(id string) bool {
+	mlog.Printf2("storage/replica", "st.FetchBlock %x", id)
+	if self.ReplicaPeer == nil {
+		return false
+	}
+	data := self.fetchBlock(self.ReplicaPeer, id)
+	if data == nil {
+		return false
+	}
+	defer self.job(jobFetchBlock)()
+	self.withBlockId(id, func() {
+		self.restoreBlock(id, data)
+	})
+	return true
+}
@@ -0,0 +1,205 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Mon Apr 16 09:20:31 2018 mstenber
+ * Last modified: Mon Apr 16 11:02:47 2018 mstenber
+ * Edit time:     58 min
+ *
+ */
+
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	minio "github.com/minio/minio-go"
+)
+
+// objectStore is the minimal API the backend needs from the object
+// store. Get returns nil data (and no error) for objects that do not
+// exist.
+type objectStore interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+	Delete(keys []string) error
+}
+
+// credentials returns the access key and the secret key of the
+// object store; see storage.BackendConfiguration.S3Credentials.
+func credentials(path string) (access, secret string, err error) {
+	if path == "" {
+		access = os.Getenv("AWS_ACCESS_KEY_ID")
+		secret = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	} else {
+		var b []byte
+		b, err = ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) == 2 {
+			access, secret = fields[0], fields[1]
+		}
+	}
+	if access == "" || secret == "" {
+		err = fmt.Errorf("object store credentials missing")
+	}
+	return
+}
+
+// newObjectStore returns object store described by the URL; see
+// storage.BackendConfiguration.S3URL and S3Credentials.
+func newObjectStore(s, credentialsPath string) (objectStore, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		err = os.MkdirAll(u.Path, 0700)
+		if err != nil {
+			return nil, err
+		}
+		return &dirStore{dir: u.Path}, nil
+	case "http", "https":
+		if u.User != nil {
+			return nil, fmt.Errorf("credentials must not be in the URL")
+		}
+		bucket := strings.Trim(u.Path, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("bucket required: %s", s)
+		}
+		access, secret, err := credentials(credentialsPath)
+		if err != nil {
+			return nil, err
+		}
+		client, err := minio.New(u.Host, access, secret,
+			u.Scheme == "https")
+		if err != nil {
+			return nil, err
+		}
+		exists, err := client.BucketExists(bucket)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			err = client.MakeBucket(bucket, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &minioStore{client: client, bucket: bucket}, nil
+	}
+	return nil, fmt.Errorf("unsupported object store: %s", s)
+}
+
+// minioStore stores the objects in bucket of S3-compatible service.
+type minioStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// minioRetries is the number of times failed requests are retried,
+// as the errors are most likely transient network ones. The first
+// retry is done after minioRetryInterval, and the interval doubles
+// after every retry.
+const minioRetries = 5
+
+var minioRetryInterval = 100 * time.Millisecond
+
+func isNotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+func (self *minioStore) retry(op func() error) (err error) {
+	interval := minioRetryInterval
+	for i := 0; ; i++ {
+		err = op()
+		if err == nil || isNotFound(err) || i == minioRetries {
+			return
+		}
+		mlog.Printf2("storage/s3/objectstore", "ms.retry %d: %v", i, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+func (self *minioStore) Get(key string) (data []byte, err error) {
+	err = self.retry(func() error {
+		o, err := self.client.GetObject(self.bucket, key, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		defer o.Close()
+		data, err = ioutil.ReadAll(o)
+		return err
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return
+}
+
+func (self *minioStore) Put(key string, data []byte) error {
+	return self.retry(func() error {
+		_, err := self.client.PutObject(self.bucket, key, bytes.NewReader(data),
+			int64(len(data)), minio.PutObjectOptions{})
+		return err
+	})
+}
+
+func (self *minioStore) Delete(keys []string) error {
+	return self.retry(func() (err error) {
+		ch := make(chan string, len(keys))
+		for _, key := range keys {
+			ch <- key
+		}
+		close(ch)
+		// The channel has to be drained for RemoveObjects to
+		// finish
+		for e := range self.client.RemoveObjects(self.bucket, ch) {
+			if err == nil {
+				err = e.Err
+			}
+		}
+		return
+	})
+}
+
+// dirStore stores the objects as files in a directory; it stands in
+// for the real thing e.g. in tests.
+type dirStore struct {
+	dir string
+}
+
+func (self *dirStore) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(self.dir, key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (self *dirStore) Put(key string, data []byte) error {
+	return ioutil.WriteFile(filepath.Join(self.dir, key), data, 0600)
+}
+
+func (self *dirStore) Delete(keys []string) error {
+	for _, key := range keys {
+		err := os.Remove(filepath.Join(self.dir, key))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
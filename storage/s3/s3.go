@@ -0,0 +1,191 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Mon Apr 16 08:45:12 2018 mstenber
+ * Last modified: Mon Apr 16 11:40:05 2018 mstenber
+ * Edit time:     96 min
+ *
+ */
+
+// s3 package provides backend which stores the block data in
+// S3-compatible object store.
+package s3
+
+import (
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/bolt"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// s3Backend stores the (encoded) data of every block in object named
+// by the hex encoded block id. The block metadata (reference count,
+// status) and the names are kept in local metadata index (bolt
+// backend in the directory), in which the blocks have no data.
+//
+// Deletes of the objects are batched until Flush; until then, the
+// objects are garbage that is not referred to by the index.
+//
+// Without S3URL, the objects are stored in the objects subdirectory
+// of the directory instead.
+//
+// The size of the object store is not known, so the space used and
+// available are those of the index.
+type s3Backend struct {
+	storage.BackendConfiguration
+
+	// Backend is the metadata index
+	storage.Backend
+
+	store objectStore
+
+	// deleted contains the keys of objects to delete on Flush
+	deleted     map[string]bool
+	deletedLock util.MutexLocked
+}
+
+var _ storage.Backend = &s3Backend{}
+
+func NewS3Backend() storage.Backend {
+	self := &s3Backend{Backend: bolt.NewBoltBackend(),
+		deleted: make(map[string]bool)}
+	return self
+}
+
+func (self *s3Backend) Init(config storage.BackendConfiguration) {
+	self.BackendConfiguration = config
+	if config.S3URL == "" {
+		// Local stand-in within the directory
+		self.store = &dirStore{dir: filepath.Join(config.Directory, "objects")}
+		err := os.MkdirAll(self.store.(*dirStore).dir, 0700)
+		if err != nil {
+			log.Panic(err)
+		}
+	} else {
+		store, err := newObjectStore(config.S3URL, config.S3Credentials)
+		if err != nil {
+			log.Panic(err)
+		}
+		self.store = store
+	}
+	self.Backend.Init(config)
+}
+
+func objectKey(id string) string {
+	return hex.EncodeToString([]byte(id))
+}
+
+// withBackend returns copy of the index block that reads its data
+// via the backend.
+func (self *s3Backend) withBackend(b *storage.Block) *storage.Block {
+	nb := *b
+	nb.Backend = self
+	nb.Data.Set(nil)
+	return &nb
+}
+
+func (self *s3Backend) GetBlockById(id string) *storage.Block {
+	b := self.Backend.GetBlockById(id)
+	if b == nil {
+		return nil
+	}
+	return self.withBackend(b)
+}
+
+func (self *s3Backend) IterateBlocks(cb func(b *storage.Block)) {
+	self.Backend.IterateBlocks(func(b *storage.Block) {
+		cb(self.withBackend(b))
+	})
+}
+
+func (self *s3Backend) IterateBlocksWithStatus(status storage.BlockStatus, cb func(b *storage.Block)) {
+	self.Backend.IterateBlocksWithStatus(status, func(b *storage.Block) {
+		cb(self.withBackend(b))
+	})
+}
+
+// GetBlockData returns nil if the object does not exist; errors
+// that persist despite the retries of the object store are fatal.
+func (self *s3Backend) GetBlockData(b *storage.Block) []byte {
+	data, err := self.store.Get(objectKey(b.Id))
+	if err != nil {
+		log.Panic(err)
+	}
+	return data
+}
+
+func (self *s3Backend) StoreBlock(b *storage.Block) {
+	mlog.Printf2("storage/s3/s3", "s3.StoreBlock %x", b.Id)
+	key := objectKey(b.Id)
+	self.deletedLock.Lock()
+	delete(self.deleted, key)
+	self.deletedLock.Unlock()
+	err := self.store.Put(key, *b.Data.Get())
+	if err != nil {
+		log.Panic(err)
+	}
+	// The object is there before the index refers to it
+	nb := &storage.Block{Id: b.Id, BlockMetadata: b.BlockMetadata}
+	data := []byte{}
+	nb.Data.Set(&data)
+	self.Backend.StoreBlock(nb)
+}
+
+// ReplaceBlock overwrites the object (which is atomic), and updates
+// the index. Blocks are replaced either with data of the same id, or
+// without data (evicted blocks); the one with data is written first,
+// so interrupted replace does not leave the index referring to
+// missing data.
+func (self *s3Backend) ReplaceBlock(b *storage.Block) {
+	mlog.Printf2("storage/s3/s3", "s3.ReplaceBlock %x", b.Id)
+	key := objectKey(b.Id)
+	data := *b.Data.Get()
+	nb := &storage.Block{Id: b.Id, BlockMetadata: b.BlockMetadata}
+	if len(data) == 0 {
+		self.Backend.UpdateBlock(nb)
+	}
+	err := self.store.Put(key, data)
+	if err != nil {
+		log.Panic(err)
+	}
+	if len(data) > 0 {
+		self.Backend.UpdateBlock(nb)
+	}
+}
+
+func (self *s3Backend) DeleteBlock(b *storage.Block) {
+	mlog.Printf2("storage/s3/s3", "s3.DeleteBlock %x", b.Id)
+	self.Backend.DeleteBlock(b)
+	defer self.deletedLock.Locked()()
+	self.deleted[objectKey(b.Id)] = true
+}
+
+func (self *s3Backend) Flush() {
+	self.deletedLock.Lock()
+	keys := make([]string, 0, len(self.deleted))
+	for k, _ := range self.deleted {
+		keys = append(keys, k)
+	}
+	self.deleted = make(map[string]bool)
+	self.deletedLock.Unlock()
+	if len(keys) > 0 {
+		mlog.Printf2("storage/s3/s3", "s3.Flush deleting %d objects", len(keys))
+		err := self.store.Delete(keys)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	self.Backend.Flush()
+}
+
+func (self *s3Backend) Close() {
+	self.Flush()
+	self.Backend.Close()
+}
@@ -0,0 +1,206 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Wed Apr  4 09:12:40 2018 mstenber
+ * Last modified: Wed Apr  4 11:48:03 2018 mstenber
+ * Edit time:     96 min
+ *
+ */
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/pb"
+)
+
+// ScrubStatistics describes what the scrubber has done so far.
+type ScrubStatistics struct {
+	// Passes is the number of completed passes over the backend
+	Passes int64
+
+	// Blocks is the number of blocks checked
+	Blocks int64
+
+	// Corrupt is the number of corrupt blocks found
+	Corrupt int64
+
+	// Repaired is the number of corrupt blocks re-fetched from
+	// ScrubPeer
+	Repaired int64
+}
+
+// scrubBlock checks that the data of the block in the backend still
+// matches its id. Blocks that are not in the backend (yet, or any
+// more), or whose data is not supposed to be there (e.g. evicted
+// BS_MISSING blocks of partial replicas), are fine.
+func (self *Storage) scrubBlock(id string) (ok bool) {
+	mlog.Printf2("storage/scrubber", "st.scrubBlock %x", id)
+	defer self.job(jobScrubBlock)()
+	ok = true
+	self.withBlockId(id, func() {
+		if b, found := self.shardFor(id).blocks[id]; found && b.Backend == nil {
+			return
+		}
+		b := self.Backend.GetBlockById(id)
+		// Blocks without status are backend-internal
+		if b == nil {
+			return
+		}
+		switch b.Status {
+		case BS_NORMAL, BS_WEAK:
+		default:
+			return
+		}
+		if self.mirrorBackend != nil {
+			// Both copies are checked (and repaired)
+			ok = self.mirrorBackend.heal(b) != nil
+			return
+		}
+		data := self.peekBlockData(b)
+		ok = data != nil && self.VerifyBlockId(id, data)
+	})
+	self.setCorrupt(id, !ok)
+	return
+}
+
+// peekBlockData returns the data of the block in the backend. Tiered
+// backends are read so that the block does not become hot (or, with
+// TierPromote, get moved to the fast tier) just by being scrubbed.
+func (self *Storage) peekBlockData(b *Block) []byte {
+	if self.tieredBackend != nil {
+		return self.tieredBackend.PeekBlockData(b)
+	}
+	return self.Backend.GetBlockData(b)
+}
+
+// repairBlock replaces the data of the block in the backend.
+func (self *Storage) repairBlock(id string, data []byte) (ok bool) {
+	mlog.Printf2("storage/scrubber", "st.repairBlock %x", id)
+	defer self.job(jobRepairBlock)()
+	self.withBlockId(id, func() {
+		b := self.Backend.GetBlockById(id)
+		if b == nil {
+			return
+		}
+		nb := &Block{Id: id, BlockMetadata: b.BlockMetadata}
+		nb.Data.Set(&data)
+		self.Backend.ReplaceBlock(nb)
+		if ob, found := self.shardFor(id).blocks[id]; found {
+			ob.Data.Set(&data)
+		}
+		ok = true
+	})
+	if ok {
+		self.setCorrupt(id, false)
+	}
+	return
+}
+
+func (self *Storage) setCorrupt(id string, corrupt bool) {
+	defer self.corruptIdsLock.Locked()()
+	if corrupt {
+		self.corruptIds[id] = true
+	} else {
+		delete(self.corruptIds, id)
+	}
+}
+
+// fetchBlock gets the data of the block from peer, and verifies it
+// matches the id.
+func (self *Storage) fetchBlock(peer pb.Fs, id string) []byte {
+	req := &pb.GetBlockRequest{Id: id, WantData: true}
+	res, err := peer.GetBlockById(context.Background(), req)
+	if err != nil {
+		mlog.Printf2("storage/scrubber", " fetch failed: %v", err)
+		return nil
+	}
+	if res.Id != id {
+		mlog.Printf2("storage/scrubber", " peer does not have it")
+		return nil
+	}
+	data, err := self.Codec.DecodeBytes([]byte(res.Data), []byte(id))
+	if err != nil || !self.VerifyBlockId(id, data) {
+		mlog.Printf2("storage/scrubber", " peer copy is not valid either")
+		return nil
+	}
+	return data
+}
+
+// ScrubBlock checks that the stored data of the block still matches
+// its id. Corrupt blocks are re-fetched from ScrubPeer if it is set;
+// ones that cannot be are listed in CorruptBlockIds. The return value
+// is true if the block is fine (or was repaired).
+func (self *Storage) ScrubBlock(id string) bool {
+	self.scrubStatistics.Blocks.AddInt(1)
+	if self.scrubBlock(id) {
+		return true
+	}
+	mlog.Printf2("storage/scrubber", "corrupt block %x", id)
+	self.scrubStatistics.Corrupt.AddInt(1)
+	if self.ScrubPeer != nil {
+		data := self.fetchBlock(self.ScrubPeer, id)
+		if data != nil && self.repairBlock(id, data) {
+			self.scrubStatistics.Repaired.AddInt(1)
+			return true
+		}
+	}
+	return false
+}
+
+// CorruptBlockIds returns the ids of corrupt blocks found by the
+// scrubber which could not be repaired.
+func (self *Storage) CorruptBlockIds() []string {
+	defer self.job(jobGetCorruptBlockIds)()
+	defer self.corruptIdsLock.Locked()()
+	ids := make([]string, 0, len(self.corruptIds))
+	for id, _ := range self.corruptIds {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ScrubStatistics returns what the scrubber has done so far.
+func (self *Storage) ScrubStatistics() ScrubStatistics {
+	st := &self.scrubStatistics
+	return ScrubStatistics{Passes: st.Passes.Get(), Blocks: st.Blocks.Get(),
+		Corrupt: st.Corrupt.Get(), Repaired: st.Repaired.Get()}
+}
+
+// scrub is the background scrubber; it checks at most ScrubRate
+// blocks per second, and once done with the blocks in the backend,
+// starts over.
+func (self *Storage) scrub() {
+	defer close(self.scrubDone)
+	ticker := time.NewTicker(time.Second / time.Duration(self.ScrubRate))
+	defer ticker.Stop()
+	for {
+		ids := make([]string, 0)
+		self.Backend.IterateBlocks(func(b *Block) {
+			if b.Status != BS_UNSET {
+				ids = append(ids, b.Id)
+			}
+		})
+		mlog.Printf2("storage/scrubber", "st.scrub pass start, %d blocks", len(ids))
+		for _, id := range ids {
+			select {
+			case <-self.scrubQuit:
+				return
+			case <-ticker.C:
+			}
+			self.ScrubBlock(id)
+		}
+		self.scrubStatistics.Passes.AddInt(1)
+		// Do not spin if there is nothing to do
+		select {
+		case <-self.scrubQuit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
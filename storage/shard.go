@@ -0,0 +1,101 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Fri Apr  6 09:40:22 2018 mstenber
+ * Last modified: Fri Apr  6 13:55:10 2018 mstenber
+ * Edit time:     185 min
+ *
+ */
+
+package storage
+
+import "github.com/fingon/go-tfhfs/util"
+
+const defaultShards = 32
+
+// blockOp is operation on block with particular id; it is run
+// while holding the lock of the shard of the id.
+type blockOp struct {
+	id string
+	cb func()
+}
+
+// storageShard contains the in-memory state of the blocks whose ids
+// map to it. Operations on blocks in different shards run in
+// parallel.
+type storageShard struct {
+	lock util.MutexLocked
+
+	// blocks is Block object herd; they are reference counted, so
+	// as long as someone keeps a reference to one, it stays
+	// here. Being in dirtyBlocks means it also has extra
+	// storage-reference. dirtyRefBlocks on the other hand do NOT
+	// have references, but consist of blocks with either recently
+	// zeroed or non-zeroed storageRefCount
+	blocks                             blockMap
+	dirtyBlocks, dirtyStorageRefBlocks blockObjectMap
+
+	// later contains operations on (typically other) blocks
+	// that were caused by the operation currently holding the
+	// lock. They are run once the lock has been released, so
+	// that at most one shard is locked at a time.
+	later []blockOp
+}
+
+func newStorageShard() *storageShard {
+	return &storageShard{blocks: make(blockMap),
+		dirtyBlocks:           make(blockObjectMap),
+		dirtyStorageRefBlocks: make(blockObjectMap)}
+}
+
+func (self *Storage) shardFor(id string) *storageShard {
+	if id == "" {
+		return self.shards[0]
+	}
+	// Ids are (mostly) hashes, so last byte is as good as any
+	return self.shards[int(id[len(id)-1])%len(self.shards)]
+}
+
+// withBlockId calls cb while holding the lock of the shard of the
+// block id. The operations that cb causes on other blocks are run
+// afterwards in the order they were requested.
+//
+// The caller MUST hold the storage lock (either reading or writing).
+func (self *Storage) withBlockId(id string, cb func()) {
+	todo := []blockOp{{id: id, cb: cb}}
+	for len(todo) > 0 {
+		op := todo[0]
+		todo = todo[1:]
+		sh := self.shardFor(op.id)
+		sh.lock.Lock()
+		op.cb()
+		todo = append(todo, sh.later...)
+		sh.later = nil
+		sh.lock.Unlock()
+	}
+}
+
+// withBlock is convenience wrapper of withBlockId, which provides
+// cb with the block (or nil, if it does not exist).
+func (self *Storage) withBlock(id string, cb func(b *Block)) {
+	self.withBlockId(id, func() {
+		cb(self.getBlockById(id))
+	})
+}
+
+// later schedules an operation on the block with the given id, to
+// be run after the current operation on self is done. The
+// operation MUST NOT assume that the block still exists.
+func (self *Block) later(id string, cb func(b *Block)) {
+	sh := self.shard()
+	sh.lock.AssertLocked()
+	sh.later = append(sh.later, blockOp{id: id, cb: func() {
+		cb(self.storage.getBlockById(id))
+	}})
+}
+
+func (self *Block) shard() *storageShard {
+	return self.storage.shardFor(self.Id)
+}
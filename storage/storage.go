@@ -12,10 +12,13 @@
 package storage
 
 import (
+	"log"
+	"sync"
+
 	"github.com/fingon/go-tfhfs/codec"
 	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/pb"
 	"github.com/fingon/go-tfhfs/util"
-	"github.com/minio/sha256-simd"
 )
 
 type BlockReferenceCallback func(string)
@@ -50,43 +53,131 @@ type Storage struct {
 	// inside block data.
 	IterateReferencesCallback BlockIterateReferencesCallback
 
-	// QueueLength specifies how long channel queue is there for
-	// storage operations. Zero means unbuffered (which is fancy
-	// for debugging but crap performance-wise).
-	QueueLength int
+	// Shards is the number of parts the in-memory block state is
+	// split to; operations on blocks in different shards run in
+	// parallel (default: defaultShards).
+	Shards int
 
 	// Codec (if set) specifies the codec used to encode the data
 	// before it is stored in backend, or to decode it when
 	// fetching it from backend
 	Codec codec.Codec
 
-	// blocks is Block object herd; they are reference counted, so
-	// as long as someone keeps a reference to one, it stays
-	// here. Being in dirtyBlocks means it also has extra
-	// storage-reference. dirtyRefBlocks on the other hand do NOT
-	// have references, but consist of blocks with either recently
-	// zeroed or non-zeroed storageRefCount
-	blocks                             blockMap
-	dirtyBlocks, dirtyStorageRefBlocks blockObjectMap
+	// StreamCodec (if set) is used instead of Codec to encode the
+	// blocks stored outside the backend (streams, intent log). It
+	// is needed if the backend encodes the blocks itself, and Codec
+	// is therefore nop.
+	StreamCodec codec.Codec
+
+	// Hash is used to calculate the block ids (default: legacy
+	// untagged SHA256).
+	Hash HashType
+
+	// IdKey (if set) is used to key the block ids; they are then
+	// HMAC of the data instead of hash of it. This way the ids do
+	// not reveal what is stored to whoever does not have the key.
+	IdKey []byte
+
+	// ReadCacheSize (if set) is the number of bytes of decoded
+	// block data to cache, in addition to the data of the blocks
+	// currently in use.
+	ReadCacheSize int
+
+	// Quota (if set) is the maximum number of bytes the backend
+	// may use. Together with the space actually available to the
+	// backend, it limits what HasSpace permits.
+	Quota uint64
+
+	// ScrubRate (if set) is the number of blocks per second the
+	// background scrubber checks.
+	ScrubRate int
+
+	// ScrubPeer (if set) is used to re-fetch the blocks the
+	// scrubber finds corrupt.
+	ScrubPeer pb.Fs
+
+	// ReplicaPeer (if set) is used to fetch the data of BS_MISSING
+	// blocks (see FetchBlock).
+	ReplicaPeer pb.Fs
+
+	// IntentLog (if set) is the path of the write-ahead intent
+	// log. New blocks, status changes and names are recorded in it
+	// as they happen, so SyncIntentLog can be used instead of
+	// (expensive) Flush to make them durable. See
+	// ReplayIntentLog.
+	IntentLog string
+
+	// lock is held for reading by the operations, and for
+	// writing by flush (which therefore sees consistent state)
+	lock *sync.RWMutex
+
+	// shards contain the in-memory state of the blocks
+	shards []*storageShard
 
 	// Stuff below here is ~DelayedStorage
-	names map[string]*oldNewStruct
+	names     map[string]*oldNewStruct
+	namesLock *util.MutexLocked
+
+	// counters are cumulative; flushedCounters are their values
+	// at the time of the last flush
+	counters        [NUM_C]util.AtomicInt
+	flushedCounters [NUM_C]int64
+
+	jobCounts [numJobTypes]util.AtomicInt
+
+	// Background scrubber state
+	scrubQuit, scrubDone chan struct{}
+
+	scrubStatistics struct {
+		Passes, Blocks, Corrupt, Repaired util.AtomicInt
+	}
 
-	counters [NUM_C]util.AtomicInt
+	corruptIds     map[string]bool
+	corruptIdsLock *util.MutexLocked
 
-	jobChannel chan *jobIn
+	readCache *readCache
 
-	jobCounts map[jobType]int
+	intentLog     *intentLog
+	intentLogOnce *sync.Once
+
+	// tieredBackend is the Backend, if it has tiers
+	tieredBackend TieredBackend
+
+	// mirrorBackend is the Backend, if it is a mirror
+	mirrorBackend *mirrorBackend
+
+	// pendingBytes is the amount of block data not yet stored in
+	// the backend
+	pendingBytes util.AtomicInt
+
+	// outOfSpace is set if the last flush failed due to lack of
+	// space in the backend
+	outOfSpace util.AtomicInt
 }
 
 // Init sets up the default values to be usable
 func (self Storage) Init() *Storage {
+	self.lock = &sync.RWMutex{}
+	self.shards = make([]*storageShard, util.IOr(self.Shards, defaultShards))
+	for i := range self.shards {
+		self.shards[i] = newStorageShard()
+	}
 	self.names = make(map[string]*oldNewStruct)
-	self.jobChannel = make(chan *jobIn, self.QueueLength)
-	self.blocks = make(blockMap)
-	self.dirtyBlocks = make(blockObjectMap)
-	self.dirtyStorageRefBlocks = make(blockObjectMap)
-	self.jobCounts = make(map[jobType]int)
+	self.namesLock = &util.MutexLocked{}
+	self.corruptIds = make(map[string]bool)
+	self.corruptIdsLock = &util.MutexLocked{}
+	self.intentLogOnce = &sync.Once{}
+	if self.ReadCacheSize > 0 {
+		self.readCache = newReadCache(self.ReadCacheSize)
+	}
+
+	if mb, ok := self.Backend.(*mirrorBackend); ok {
+		mb.verify = self.verifyBackendData
+		self.mirrorBackend = mb
+	}
+	if tb, ok := self.Backend.(TieredBackend); ok {
+		self.tieredBackend = tb
+	}
 
 	if self.Codec != nil {
 		// No need to care about encoding elsewhere with this
@@ -97,24 +188,36 @@ func (self Storage) Init() *Storage {
 		// assume Codec is present
 		self.Codec = codec.CodecChain{}.Init()
 	}
+	if self.StreamCodec == nil {
+		self.StreamCodec = self.Codec
+	}
 
 	self.Backend = mapRunnerBackend{}.SetBackend(self.Backend)
 
-	go func() { // ok, singleton per storage
-		self.run()
-	}()
+	if self.ScrubRate > 0 {
+		self.scrubQuit = make(chan struct{})
+		self.scrubDone = make(chan struct{})
+		go func() { // ok, singleton per storage
+			self.scrub()
+		}()
+	}
 	return &self
 }
 
 func (self *Storage) Close() {
+	if self.scrubQuit != nil {
+		close(self.scrubQuit)
+		<-self.scrubDone
+	}
+
 	// Implicitly also flush; storage that persists randomly seems bad
 	if self.Backend != nil {
 		self.Flush()
 	}
 
-	out := make(chan *jobOut)
-	self.jobChannel <- &jobIn{jobType: jobQuit, out: out}
-	<-out
+	if self.intentLog != nil {
+		self.intentLog.close()
+	}
 
 	if self.Backend != nil {
 		mlog.Printf2("storage/storage", "Storage also closing Backend")
@@ -122,30 +225,66 @@ func (self *Storage) Close() {
 	}
 }
 
+// rlocked acquires the storage lock for reading (for the duration of
+// an operation); use as defer self.rlocked()().
+func (self *Storage) rlocked() func() {
+	self.lock.RLock()
+	return self.lock.RUnlock
+}
+
 func (self *Storage) TransientCount() int {
 	// mlog.Printf2("storage/storage", "TransientCount")
 	transient := 0
-	for _, b := range self.blocks {
-		if b.RefCount == 0 {
-			// mlog.Printf2("storage/storage", " %v", b)
-			transient++
+	for _, sh := range self.shards {
+		sh.lock.Lock()
+		for _, b := range sh.blocks {
+			if b.RefCount == 0 {
+				// mlog.Printf2("storage/storage", " %v", b)
+				transient++
+			}
 		}
+		sh.lock.Unlock()
 	}
 	return transient
 }
 
-func (self *Storage) setNameToBlockId(name, bid string) {
-	n := self.getName(name)
-	if bid != "" {
-		self.getBlockById(bid).addStorageRefCount(1)
+// counts returns the number of blocks, and dirty blocks, in memory.
+func (self *Storage) counts() (blocks, dirty int) {
+	for _, sh := range self.shards {
+		sh.lock.Lock()
+		blocks += len(sh.blocks)
+		dirty += len(sh.dirtyBlocks)
+		sh.lock.Unlock()
 	}
-	if n.gotStorageRef {
-		self.getBlockById(n.newValue).addStorageRefCount(-1)
+	return
+}
+
+func (self *Storage) addBlockIdStorageRefCount(id string, count int32) {
+	self.withBlock(id, func(b *Block) {
+		if b == nil {
+			log.Panicf("block id %x disappeared", id)
+		}
+		b.addStorageRefCount(count)
+	})
+}
+
+func (self *Storage) setNamesToBlockIds(names map[string]string) {
+	defer self.namesLock.Locked()()
+	for name, bid := range names {
+		n := self.getName(name)
+		if bid != "" {
+			self.addBlockIdStorageRefCount(bid, 1)
+		}
+		if n.gotStorageRef {
+			self.addBlockIdStorageRefCount(n.newValue, -1)
+		}
+		n.newValue = bid
+		n.gotStorageRef = true
 	}
-	n.newValue = bid
-	n.gotStorageRef = true
+	self.logNames(names)
 }
 
+// getName returns the name state; namesLock MUST be held.
 func (self *Storage) getName(name string) *oldNewStruct {
 	n, ok := self.names[name]
 	if ok {
@@ -159,36 +298,48 @@ func (self *Storage) getName(name string) *oldNewStruct {
 
 func (self *Storage) flushBlockName(k string, v *oldNewStruct) {
 	mlog.Printf2("storage/storage", "flushBlockName %s=%x", k, v.newValue)
-	self.Backend.SetNameToBlockId(k, v.newValue)
 	if v.newValue != "" {
-		b := self.getBlockById(v.newValue)
-		b.addRefCount(1)
-		b.addStorageRefCount(-1)
+		self.withBlock(v.newValue, func(b *Block) {
+			b.addRefCount(1)
+			b.addStorageRefCount(-1)
+		})
 		v.gotStorageRef = false
 	}
 	if v.oldValue != "" {
-		b := self.getBlockById(v.oldValue)
-		b.addRefCount(-1)
+		self.withBlock(v.oldValue, func(b *Block) {
+			b.addRefCount(-1)
+		})
 	}
 	v.oldValue = v.newValue
 }
 
+// flushBlockNames stores the changed names in the backend (all at
+// once, so the names changed since the previous flush stay
+// consistent with each other).
 func (self *Storage) flushBlockNames() int {
-	ops := 0
+	changed := make(map[string]string)
 	for k, v := range self.names {
 		if v.oldValue != v.newValue {
-			self.flushBlockName(k, v)
-			ops++
+			changed[k] = v.newValue
 		}
 	}
-	return ops
+	if len(changed) == 0 {
+		return 0
+	}
+	self.Backend.SetNamesToBlockIds(changed)
+	for k, _ := range changed {
+		self.flushBlockName(k, self.names[k])
+	}
+	return len(changed)
 }
 
 func (self *Storage) flush() int {
 	mlog.Printf2("storage/storage", "st.Flush")
 	var c [NUM_C]int64
 	for i := 0; i < NUM_C; i++ {
-		c[i] = self.counters[i].Get()
+		v := self.counters[i].Get()
+		c[i] = v - self.flushedCounters[i]
+		self.flushedCounters[i] = v
 	}
 	if c[C_READ] > 0 {
 		mlog.Printf2("storage/storage", " reads since last flush: %d - %d k", c[C_READ], c[C_READBYTES]/1024)
@@ -199,37 +350,60 @@ func (self *Storage) flush() int {
 	if c[C_DELETE] > 0 {
 		mlog.Printf2("storage/storage", " deletes since last flush: %d", c[C_DELETE])
 	}
-	mlog.Printf2("storage/storage", " blocks:%d (%d dirty, %d transient)",
-		len(self.blocks),
-		len(self.dirtyBlocks),
-		self.TransientCount())
 	if mlog.IsEnabled() {
-		total := 0
-		for _, v := range self.jobCounts {
-			total += v
-		}
-		for k, v := range self.jobCounts {
+		blocks, dirty := self.counts()
+		mlog.Printf2("storage/storage", " blocks:%d (%d dirty, %d transient)",
+			blocks, dirty, self.TransientCount())
+	}
+	if mlog.IsEnabled() {
+		for i := range self.jobCounts {
+			v := self.jobCounts[i].Get()
 			if v > 0 {
-				mlog.Printf2("storage/storage", " %v %d", k, v)
+				mlog.Printf2("storage/storage", " %v %d", jobType(i), v)
 			}
 		}
 	}
-	for i := 0; i < NUM_C; i++ {
-		self.counters[i].Set(0)
-	}
 
 	// _flush_names in Python prototype
-	ops := self.flushBlockNames()
+	ops, ok := tryWrite(self.flushBlockNames)
+	noSpace := !ok
 
 	// flush_dirty_stored_blocks in Python
-	for len(self.dirtyBlocks) > 0 {
+	//
+	// Blocks that do not fit in the backend stay dirty, and are
+	// retried on the next flush; the rest (e.g. deletes that free
+	// space) are flushed anyway.
+	dirtyBlocks := func(sh *storageShard) blockObjectMap {
+		return sh.dirtyBlocks
+	}
+	failed := make(map[*Block]bool)
+	flushBlock := func(b *Block) int {
+		return self.flushBlockIn(b, dirtyBlocks, func() int {
+			ops, ok := tryWrite(b.flush)
+			if !ok {
+				failed[b] = true
+				noSpace = true
+			}
+			return ops
+		})
+	}
+	for {
+		dirty := make([]*Block, 0)
+		for _, b := range self.collectBlocks(dirtyBlocks) {
+			if !failed[b] {
+				dirty = append(dirty, b)
+			}
+		}
+		if len(dirty) == 0 {
+			break
+		}
 		oops := ops
-		mlog.Printf2("storage/storage", " flushing %d dirty", len(self.dirtyBlocks))
+		mlog.Printf2("storage/storage", " flushing %d dirty", len(dirty))
 		// first nonzero refcounts as they may add references;
 		// then zero refcounts as they reduce references
-		for b, _ := range self.dirtyBlocks {
+		for _, b := range dirty {
 			if b.RefCount != 0 {
-				ops += b.flush()
+				ops += flushBlock(b)
 			}
 		}
 		if ops != oops {
@@ -238,30 +412,40 @@ func (self *Storage) flush() int {
 
 		// only removals left
 		mlog.Printf2("storage/storage", " flushing refcnt=0")
-		for b, _ := range self.dirtyBlocks {
+		for _, b := range dirty {
 			if b.RefCount != 0 {
 				break
 			}
-			ops += b.flush()
+			ops += flushBlock(b)
 		}
 	}
 
 	// similarly handle the storageRefCounts
-	for len(self.dirtyStorageRefBlocks) > 0 {
+	dirtyStorageRefBlocks := func(sh *storageShard) blockObjectMap {
+		return sh.dirtyStorageRefBlocks
+	}
+	flushStorageRef := func(b *Block) int {
+		return self.flushBlockIn(b, dirtyStorageRefBlocks, b.flushStorageRef)
+	}
+	for {
+		dirty := self.collectBlocks(dirtyStorageRefBlocks)
+		if len(dirty) == 0 {
+			break
+		}
 		oops := ops
-		for b, _ := range self.dirtyStorageRefBlocks {
+		for _, b := range dirty {
 			if b.storageRefCount != 0 {
-				ops += b.flushStorageRef()
+				ops += flushStorageRef(b)
 			}
 		}
 		if ops != oops {
 			continue
 		}
-		for b, _ := range self.dirtyStorageRefBlocks {
+		for _, b := range dirty {
 			if b.storageRefCount != 0 {
 				break
 			}
-			ops += b.flushStorageRef()
+			ops += flushStorageRef(b)
 		}
 	}
 
@@ -269,14 +453,114 @@ func (self *Storage) flush() int {
 		self.Backend.Flush()
 	}
 
+	if noSpace {
+		log.Printf("Out of space, flush incomplete (%d blocks left)", len(failed))
+		self.outOfSpace.Set(1)
+	} else {
+		self.outOfSpace.Set(0)
+
+		// Everything in the intent log is now in the backend
+		if self.intentLog != nil {
+			self.intentLog.truncate()
+		}
+	}
+
 	mlog.Printf2("storage/storage", " ops:%v", ops)
 	return ops
 }
 
+// tryWrite calls op, which writes to the backend. If the backend
+// gives up due to lack of space (see PanicIfNoSpace), ok is false.
+func tryWrite(op func() int) (ops int, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != ErrNoSpace {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+	return op(), true
+}
+
+// IsOutOfSpace returns true if the last flush could not store
+// everything in the backend due to lack of space.
+func (self *Storage) IsOutOfSpace() bool {
+	return self.outOfSpace.Get() != 0
+}
+
+// collectBlocks returns the blocks in the given per-shard set.
+func (self *Storage) collectBlocks(set func(sh *storageShard) blockObjectMap) []*Block {
+	blocks := make([]*Block, 0)
+	for _, sh := range self.shards {
+		sh.lock.Lock()
+		for b, _ := range set(sh) {
+			blocks = append(blocks, b)
+		}
+		sh.lock.Unlock()
+	}
+	return blocks
+}
+
+// flushBlockIn calls flush if the block is (still) in the given
+// per-shard set, and returns the number of operations it did.
+func (self *Storage) flushBlockIn(b *Block, set func(sh *storageShard) blockObjectMap, flush func() int) (ops int) {
+	self.withBlockId(b.Id, func() {
+		if set(b.shard())[b] {
+			ops = flush()
+		}
+	})
+	return
+}
+
+// Counters returns the cumulative values of the C_* counters.
+func (self *Storage) Counters() (counters [NUM_C]int64) {
+	for i := 0; i < NUM_C; i++ {
+		counters[i] = self.counters[i].Get()
+	}
+	return
+}
+
+// JobCounts returns the number of jobs of each type the storage has
+// run.
+func (self *Storage) JobCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	for i := range self.jobCounts {
+		counts[jobType(i).String()] = self.jobCounts[i].Get()
+	}
+	return counts
+}
+
+// BlockId returns the id of a block with the given data.
+func (self *Storage) BlockId(b []byte) string {
+	return self.Hash.BlockId(self.IdKey, b)
+}
+
+// VerifyBlockId checks that the id matches the data. The hash
+// used is determined by the id, not by the Hash of the storage, so
+// blocks with ids from other stores (sharing IdKey) can be verified
+// too.
+func (self *Storage) VerifyBlockId(id string, b []byte) bool {
+	ht, err := BlockIdHashType(id)
+	if err != nil {
+		return false
+	}
+	return ht.BlockId(self.IdKey, b) == id
+}
+
+// verifyBackendData checks data of the block as returned by Backend
+// (without Storage wrappers); it is encoded with Codec, unless the
+// block was stored in plaintext.
+func (self *Storage) verifyBackendData(id string, data []byte) bool {
+	if self.VerifyBlockId(id, data) {
+		return true
+	}
+	data, err := self.Codec.DecodeBytes(data, []byte(id))
+	return err == nil && self.VerifyBlockId(id, data)
+}
+
 func (self *Storage) ReferOrStoreBlockBytes0(status BlockStatus, b []byte, deps *util.StringList) *StorageBlock {
-	h := sha256.Sum256(b)
-	bid := h[:]
-	id := string(bid)
+	id := self.BlockId(b)
 	bl := self.ReferOrStoreBlock0(id, status, b, deps)
 	return bl
 }
@@ -4,8 +4,8 @@
  * Copyright (c) 2017 Markus Stenberg
  *
  * Created:       Sun Dec 24 08:37:14 2017 mstenber
- * Last modified: Mon Jan 15 18:43:51 2018 mstenber
- * Edit time:     21 min
+ * Last modified: Thu Apr 12 10:05:40 2018 mstenber
+ * Edit time:     27 min
  *
  */
 
@@ -64,6 +64,67 @@ type BlockMetadata struct {
 	Status BlockStatus `zid:"1"`
 }
 
+// NameMapBlock is the legacy single-block name storage
 type NameMapBlock struct {
 	NameToBlockId map[string]string
 }
+
+// NameGenerationBlock is one generation of the names (see
+// GenerationNameBackend)
+type NameGenerationBlock struct {
+	Generation    uint64            `zid:"0"`
+	NameToBlockId map[string]string `zid:"1"`
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// Intent log
+
+type IntentLogRecordType byte
+
+const (
+	ILR_UNSET IntentLogRecordType = iota
+
+	// New block with Id, Status and (encoded) Data
+	ILR_BLOCK
+
+	// Status of block Id changed to Status
+	ILR_STATUS
+
+	// Name points to block Id
+	ILR_NAME
+
+	// Names point to the block ids (changed together)
+	ILR_NAMES
+)
+
+type IntentLogRecord struct {
+	Type   IntentLogRecordType `zid:"0"`
+	Id     string              `zid:"1"`
+	Name   string              `zid:"2"`
+	Status BlockStatus         `zid:"3"`
+	Data   []byte              `zid:"4"`
+
+	Names map[string]string `zid:"5"`
+}
+
+// Streams (see Storage.NewStreamWriter)
+
+type StreamHeader struct {
+	// Name the root was sent as
+	Name string `zid:"0"`
+
+	// RootId is the id of the root block
+	RootId string `zid:"1"`
+
+	// BaseId is the id of the root block the receiver has to have
+	// already (if any); blocks reachable from it are not in the
+	// stream
+	BaseId string `zid:"2"`
+
+	// StoreHeader is the (encoded) header of the sending storage,
+	// if it has one. Storage directory that does not exist yet
+	// can be initialized with it, so that it shares the data key
+	// (and the hash) with the sender.
+	StoreHeader []byte `zid:"3"`
+}
@@ -12,15 +12,21 @@
 package storage_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/fingon/go-tfhfs/codec"
 	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/pb"
 	"github.com/fingon/go-tfhfs/storage"
 	"github.com/fingon/go-tfhfs/storage/factory"
 	"github.com/stvp/assert"
@@ -49,6 +55,34 @@ func ProdBackend(t *testing.T, factory func() storage.Backend) {
 	assert.Equal(t, int(b2.RefCount), 123)
 	assert.Equal(t, b2.Status, storage.BS_NORMAL)
 
+	found := 0
+	be.IterateBlocks(func(b *storage.Block) {
+		if b.Id == "foo" {
+			found++
+			assert.Equal(t, int(b.RefCount), 123)
+		}
+	})
+	assert.Equal(t, found, 1)
+
+	countWithStatus := func(status storage.BlockStatus) int {
+		found := 0
+		be.IterateBlocksWithStatus(status, func(b *storage.Block) {
+			assert.Equal(t, b.Id, "foo")
+			assert.Equal(t, b.Status, status)
+			found++
+		})
+		return found
+	}
+	assert.Equal(t, countWithStatus(storage.BS_NORMAL), 1)
+	assert.Equal(t, countWithStatus(storage.BS_WEAK), 0)
+
+	b1.Stored = &storage.BlockMetadata{RefCount: 123,
+		Status: storage.BS_NORMAL}
+	b1.Status = storage.BS_WEAK
+	be.UpdateBlock(b1)
+	assert.Equal(t, countWithStatus(storage.BS_NORMAL), 0)
+	assert.Equal(t, countWithStatus(storage.BS_WEAK), 1)
+
 	//be.UpdateBlockStatus(b1, BS_MISSING)
 	//assert.Equal(t, b2.Status, BS_MISSING)
 
@@ -61,6 +95,12 @@ func ProdBackend(t *testing.T, factory func() storage.Backend) {
 
 	bn = be.GetBlockIdByName("name")
 	assert.Equal(t, bn, "")
+
+	be.SetNamesToBlockIds(map[string]string{"name": "foo", "name2": "foo"})
+	assert.Equal(t, be.GetBlockIdByName("name"), "foo")
+	assert.Equal(t, be.GetBlockIdByName("name2"), "foo")
+	be.SetNamesToBlockIds(map[string]string{"name": "", "name2": ""})
+	assert.Equal(t, be.GetBlockIdByName("name2"), "")
 	be.Close()
 
 	// Ensure second backend nop key fetch will return nothing
@@ -219,7 +259,7 @@ func ProdStorage(t *testing.T, factory func() storage.Backend) {
 }
 
 func TestBackend(t *testing.T) {
-	for _, k := range factory.List() {
+	for _, k := range append(factory.List(), "mirror:badger,tree", "erasure:2,1", "tiered:badger,file") {
 		k := k
 		t.Run(k, func(t *testing.T) {
 			t.Parallel()
@@ -234,6 +274,383 @@ func TestBackend(t *testing.T) {
 	}
 }
 
+func TestKeyedBlockId(t *testing.T) {
+	be := factory.New("inmemory", "")
+	s := storage.Storage{Backend: be}.Init()
+	defer s.Close()
+	ks := storage.Storage{Backend: be, IdKey: []byte("key")}.Init()
+	defer ks.Close()
+	ks2 := storage.Storage{Backend: be, IdKey: []byte("key2")}.Init()
+	defer ks2.Close()
+
+	data := []byte("data")
+	id := s.BlockId(data)
+	kid := ks.BlockId(data)
+	assert.Equal(t, len(kid), len(id))
+	assert.True(t, kid != id)
+	assert.True(t, ks2.BlockId(data) != kid)
+	assert.Equal(t, ks.BlockId(data), kid)
+
+	b := ks.ReferOrStoreBlockBytes0(storage.BS_NORMAL, data, nil)
+	defer b.Close()
+	assert.Equal(t, b.Id(), kid)
+}
+
+func TestBlockIdHash(t *testing.T) {
+	data := []byte("data")
+	for _, name := range append(storage.HashNames(), "") {
+		ht := storage.HashType_UNSET
+		if name != "" {
+			var err error
+			ht, err = storage.HashTypeByName(name)
+			assert.Nil(t, err)
+		}
+		for _, key := range [][]byte{nil, []byte("key")} {
+			s := storage.Storage{Hash: ht, IdKey: key}
+			id := s.BlockId(data)
+			ht2, err := storage.BlockIdHashType(id)
+			assert.Nil(t, err)
+			assert.Equal(t, ht2, ht)
+			assert.True(t, s.VerifyBlockId(id, data))
+			assert.True(t, !s.VerifyBlockId(id, []byte("other")))
+
+			// Storage with different hash should still
+			// verify it correctly
+			s2 := storage.Storage{Hash: storage.HashType_BLAKE3,
+				IdKey: key}
+			assert.True(t, s2.VerifyBlockId(id, data))
+		}
+	}
+	_, err := storage.HashTypeByName("md5")
+	assert.Equal(t, err, storage.ErrUnknownHash)
+	_, err = storage.BlockIdHashType("foo")
+	assert.Equal(t, err, storage.ErrUnknownHash)
+}
+
+func TestCounters(t *testing.T) {
+	be := factory.New("inmemory", "")
+	s := storage.Storage{Backend: be}.Init()
+	defer s.Close()
+	data := []byte("data")
+	s.ReferOrStoreBlock(s.BlockId(data), storage.BS_NORMAL, data).Close()
+	s.Flush()
+	c := s.Counters()
+	assert.Equal(t, c[storage.C_WRITE], int64(1))
+	assert.Equal(t, c[storage.C_WRITEBYTES], int64(len(data)))
+
+	// Flushing does not reset them
+	s.Flush()
+	assert.Equal(t, s.Counters(), c)
+	assert.Equal(t, s.JobCounts()["jobFlush"], int64(2))
+	assert.Equal(t, s.JobCounts()["jobReferOrStoreBlock"], int64(1))
+}
+
+func TestParallel(t *testing.T) {
+	be := factory.New("inmemory", "")
+	s := storage.Storage{Backend: be, Shards: 4}.Init()
+	defer s.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				shared := []byte("shared")
+				own := []byte(fmt.Sprintf("own%d-%d", i, j))
+				s.ReferOrStoreBlock(s.BlockId(shared), storage.BS_NORMAL, shared).Close()
+				s.ReferOrStoreBlock(s.BlockId(own), storage.BS_NORMAL, own).Close()
+				if j%10 == 0 {
+					s.Flush()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	s.Flush()
+	shared := []byte("shared")
+	b := be.GetBlockById(s.BlockId(shared))
+	assert.Equal(t, int(b.RefCount), 800)
+	b = be.GetBlockById(s.BlockId([]byte("own7-99")))
+	assert.Equal(t, int(b.RefCount), 1)
+}
+
+func TestQuota(t *testing.T) {
+	be := factory.New("inmemory", "")
+	s := storage.Storage{Backend: be, Quota: 100}.Init()
+	defer s.Close()
+	assert.Equal(t, s.BytesTotal(), uint64(100))
+	assert.True(t, s.HasSpace(50))
+
+	data := make([]byte, 80)
+	s.ReferOrStoreBlock(s.BlockId(data), storage.BS_NORMAL, data).Close()
+	assert.Equal(t, s.PendingBytes(), int64(80))
+	assert.True(t, !s.HasSpace(50))
+	assert.True(t, s.HasSpace(20))
+
+	// Once stored, the data counts against the quota instead
+	s.Flush()
+	assert.Equal(t, s.PendingBytes(), int64(0))
+	assert.Equal(t, s.BytesAvailable(), uint64(20))
+	assert.True(t, !s.HasSpace(50))
+}
+
+// noSpaceBackend fails writes with ENOSPC while full is set
+type noSpaceBackend struct {
+	storage.Backend
+	base storage.DirectoryBackendBase
+	full int32
+}
+
+func (self *noSpaceBackend) StoreBlock(b *storage.Block) {
+	err := self.base.RetryWrite(func() error {
+		if atomic.LoadInt32(&self.full) != 0 {
+			return &os.PathError{Op: "write", Path: b.Id,
+				Err: syscall.ENOSPC}
+		}
+		self.Backend.StoreBlock(b)
+		return nil
+	})
+	storage.PanicIfNoSpace(err)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (self *noSpaceBackend) GetBytesAvailable() uint64 {
+	return self.base.GetBytesAvailable()
+}
+
+func TestNoSpace(t *testing.T) {
+	storage.NoSpaceRetryInterval = time.Millisecond
+	be := &noSpaceBackend{Backend: factory.New("inmemory", ""), full: 1}
+	be.base.Init(storage.BackendConfiguration{})
+	s := storage.Storage{Backend: be}.Init()
+	defer s.Close()
+	assert.True(t, s.HasSpace(50))
+
+	// The write does not panic (or hang), but it is left
+	// pending and no more space is given out
+	data := []byte("data")
+	id := s.BlockId(data)
+	s.ReferOrStoreBlock(id, storage.BS_NORMAL, data).Close()
+	s.Flush()
+	assert.True(t, s.IsOutOfSpace())
+	assert.True(t, !s.HasSpace(1))
+	assert.Equal(t, s.BytesAvailable(), uint64(0))
+	assert.True(t, be.Backend.GetBlockById(id) == nil)
+
+	// Next flush stores it once there is space
+	atomic.StoreInt32(&be.full, 0)
+	s.Flush()
+	assert.True(t, !s.IsOutOfSpace())
+	assert.True(t, s.HasSpace(50))
+	b := be.Backend.GetBlockById(id)
+	assert.True(t, b != nil)
+	assert.Equal(t, string(b.GetData()), "data")
+}
+
+func TestReadCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "readcache")
+	defer os.RemoveAll(dir)
+	be := factory.New("bolt", dir)
+	s := storage.Storage{Backend: be, ReadCacheSize: 1 << 20}.Init()
+	defer s.Close()
+	data := []byte("data")
+	id := s.BlockId(data)
+	s.ReferOrStoreBlock(id, storage.BS_NORMAL, data).Close()
+	s.Flush()
+
+	read := func() {
+		b := s.GetBlockById(id)
+		assert.Equal(t, string(b.Data()), "data")
+		b.Close()
+		// Ensure the Block is forgotten so the data is not
+		// in memory any more
+		s.Flush()
+	}
+	read()
+	hits, misses := s.ReadCacheStatistics()
+	assert.Equal(t, hits, int64(0))
+	assert.Equal(t, misses, int64(1))
+	read()
+	read()
+	hits, misses = s.ReadCacheStatistics()
+	assert.Equal(t, hits, int64(2))
+	assert.Equal(t, misses, int64(1))
+	assert.Equal(t, s.Counters()[storage.C_READ], int64(1))
+}
+
+type scrubPeer struct {
+	pb.Fs
+	data map[string][]byte
+}
+
+func (self *scrubPeer) GetBlockById(ctx context.Context, req *pb.GetBlockRequest) (*pb.Block, error) {
+	data, ok := self.data[req.Id]
+	if !ok {
+		return &pb.Block{}, nil
+	}
+	return &pb.Block{Id: req.Id, Data: string(data)}, nil
+}
+
+func TestScrub(t *testing.T) {
+	be := factory.New("inmemory", "")
+	s := storage.Storage{Backend: be}.Init()
+	defer s.Close()
+
+	// inmemory backend shares the data slices with us, so they
+	// can be corrupted underneath it
+	data1 := []byte("data1")
+	data2 := []byte("data2")
+	id1 := s.BlockId(data1)
+	id2 := s.BlockId(data2)
+	s.ReferOrStoreBlock(id1, storage.BS_NORMAL, data1).Close()
+	s.ReferOrStoreBlock(id2, storage.BS_NORMAL, data2).Close()
+	s.Flush()
+	assert.True(t, s.ScrubBlock(id1))
+	assert.True(t, s.ScrubBlock(id2))
+	assert.True(t, s.ScrubBlock("nonexistent"))
+	assert.Equal(t, len(s.CorruptBlockIds()), 0)
+
+	peer := &scrubPeer{data: make(map[string][]byte)}
+	peer.data[id1] = []byte("bogus")
+	peer.data[id2] = []byte("data2")
+	data1[0] = 'x'
+	data2[0] = 'x'
+	s.ScrubPeer = peer
+	assert.True(t, !s.ScrubBlock(id1))
+	assert.True(t, s.ScrubBlock(id2))
+	assert.Equal(t, s.CorruptBlockIds(), []string{id1})
+	assert.Equal(t, s.ScrubStatistics(),
+		storage.ScrubStatistics{Blocks: 5, Corrupt: 2, Repaired: 1})
+	b := be.GetBlockById(id2)
+	assert.Equal(t, string(be.GetBlockData(b)), "data2")
+	assert.Equal(t, int(b.RefCount), 1)
+
+	peer.data[id1] = []byte("data1")
+	assert.True(t, s.ScrubBlock(id1))
+	assert.Equal(t, len(s.CorruptBlockIds()), 0)
+
+	// Open blocks are not evicted
+	sb := s.GetBlockById(id2)
+	assert.Equal(t, s.EvictBlock(id2), 0)
+	assert.Equal(t, string(sb.Data()), "data2")
+	sb.Close()
+
+	// Evicted blocks have no data, which is fine
+	assert.Equal(t, s.EvictBlock(id2), 5)
+	assert.True(t, s.ScrubBlock(id2))
+	assert.Equal(t, len(s.CorruptBlockIds()), 0)
+	assert.Equal(t, be.GetBlockById(id2).Status, storage.BS_MISSING)
+
+	// Background scrubber
+	data3 := []byte("data3")
+	id3 := s.BlockId(data3)
+	s.ReferOrStoreBlock(id3, storage.BS_NORMAL, data3).Close()
+	s.Flush()
+	data3[0] = 'x'
+	s2 := storage.Storage{Backend: be, ScrubRate: 1000}.Init()
+	defer s2.Close()
+	for i := 0; i < 100 && s2.ScrubStatistics().Passes == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, s2.CorruptBlockIds(), []string{id3})
+}
+
+func TestGenerationNameBackend(t *testing.T) {
+	be := factory.New("inmemory", "")
+	defer be.Close()
+	var nb storage.GenerationNameBackend
+	nb.Init("names", be)
+	assert.Equal(t, nb.NameGeneration(), uint64(0))
+	nb.SetNameToBlockId("a", "1")
+	nb.SetNamesToBlockIds(map[string]string{"a": "2", "b": "3"})
+	assert.Equal(t, nb.NameGeneration(), uint64(2))
+	assert.Equal(t, nb.GetBlockIdByName("a"), "2")
+
+	// Corrupt the newest generation; the previous one is used
+	be.DeleteBlock(be.GetBlockById("names.0"))
+	data := []byte("garbage")
+	b := &storage.Block{Id: "names.0"}
+	b.Data.Set(&data)
+	be.StoreBlock(b)
+	var nb2 storage.GenerationNameBackend
+	nb2.Init("names", be)
+	assert.Equal(t, nb2.NameGeneration(), uint64(1))
+	assert.Equal(t, nb2.GetBlockIdByName("a"), "1")
+	assert.Equal(t, nb2.GetBlockIdByName("b"), "")
+
+	// The next generation replaces the corrupt one
+	nb2.SetNameToBlockId("b", "4")
+	var nb3 storage.GenerationNameBackend
+	nb3.Init("names", be)
+	assert.Equal(t, nb3.NameGeneration(), uint64(2))
+	assert.Equal(t, nb3.GetBlockIdByName("a"), "1")
+	assert.Equal(t, nb3.GetBlockIdByName("b"), "4")
+}
+
+func TestIntentLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "intentlog")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, storage.IntentLogFilename)
+	iterateReferences := func(id string, data []byte, cb storage.BlockReferenceCallback) {
+		for _, subid := range strings.Split(string(data), " ") {
+			if subid != "" {
+				cb(subid)
+			}
+		}
+	}
+	s := storage.Storage{Backend: factory.New("file", dir), IntentLog: path,
+		IterateReferencesCallback: iterateReferences}.Init()
+	s.ReplayIntentLog()
+	for _, v := range []string{"sub1", "sub2", "sub1 sub2"} {
+		data := []byte(v)
+		s.ReferOrStoreBlock(v, storage.BS_NORMAL, data).Close()
+	}
+	s.SetNameToBlockId("name", "sub1 sub2")
+	s.ReleaseBlockId("sub1")
+	s.ReleaseBlockId("sub2")
+	s.ReleaseBlockId("sub1 sub2")
+	// Not referred to by anything
+	data := []byte("orphan")
+	s.ReferOrStoreBlock("orphan", storage.BS_NORMAL, data).Close()
+	s.ReleaseBlockId("orphan")
+	assert.True(t, s.SyncIntentLog())
+
+	// 'Crash' without flushing
+	s.Backend = nil
+	s.Close()
+
+	be := factory.New("file", dir)
+	assert.Nil(t, be.GetBlockById("sub1"))
+	s = storage.Storage{Backend: be, IntentLog: path,
+		IterateReferencesCallback: iterateReferences}.Init()
+	s.ReplayIntentLog()
+	assert.Equal(t, s.GetBlockIdByName("name"), "sub1 sub2")
+	for _, id := range []string{"sub1", "sub2", "sub1 sub2"} {
+		assert.Equal(t, int(be.GetBlockById(id).RefCount), 1)
+	}
+	assert.Nil(t, be.GetBlockById("orphan"))
+	fi, _ := os.Stat(path)
+	assert.Equal(t, fi.Size(), int64(0))
+	s.Close()
+}
+
+func BenchmarkBlockId(b *testing.B) {
+	data := make([]byte, 65536)
+	for _, name := range storage.HashNames() {
+		ht, _ := storage.HashTypeByName(name)
+		s := storage.Storage{Hash: ht}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				s.BlockId(data)
+			}
+		})
+	}
+}
+
 func BenchmarkBackend(b *testing.B) {
 	for _, k := range factory.List() {
 		k := k
@@ -290,3 +707,151 @@ func BenchmarkBackend(b *testing.B) {
 			})
 	}
 }
+
+func BenchmarkStorageParallel(b *testing.B) {
+	// inmemory has a global lock of its own which hides most of
+	// the sharding gains, so badger is measured too
+	for _, k := range []string{"inmemory", "badger"} {
+		for _, shards := range []int{1, 32} {
+			b.Run(fmt.Sprintf("%s/shards-%d", k, shards), func(b *testing.B) {
+				dir, _ := ioutil.TempDir("", k)
+				defer os.RemoveAll(dir)
+				be := factory.New(k, dir)
+				s := storage.Storage{Backend: be, Shards: shards}.Init()
+				defer s.Close()
+				b.RunParallel(func(p *testing.PB) {
+					i := 0
+					for p.Next() {
+						i++
+						data := []byte(fmt.Sprintf("data%d", i%1000))
+						id := s.BlockId(data)
+						s.ReferOrStoreBlock(id, storage.BS_NORMAL, data).Close()
+						s.GetBlockById(id).Close()
+					}
+				})
+			})
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+	be1 := factory.New("inmemory", "")
+	be2 := factory.New("inmemory", "")
+	mb := storage.NewMirrorBackend(be1, be2)
+	s := storage.Storage{Backend: mb}.Init()
+	data := []byte("data")
+	id := s.BlockId(data)
+	s.ReferOrStoreBlock(id, storage.BS_NORMAL, data).Close()
+	s.SetNameToBlockId("name", id)
+	s.Flush()
+	assert.Equal(t, be1.GetBlockIdByName("name"), id)
+	assert.Equal(t, be2.GetBlockIdByName("name"), id)
+	s.Backend = nil
+	s.Close()
+
+	// Corrupt the copy in the first backend; the read should
+	// come from the second, and repair the first
+	b := be1.GetBlockById(id)
+	be1.DeleteBlock(b)
+	bogus := []byte("bogus")
+	b.Data.Set(&bogus)
+	be1.StoreBlock(b)
+
+	s = storage.Storage{Backend: mb}.Init()
+	sb := s.GetBlockById(id)
+	assert.True(t, sb != nil)
+	assert.Equal(t, string(sb.Data()), "data")
+	sb.Close()
+	b = be1.GetBlockById(id)
+	assert.Equal(t, string(be1.GetBlockData(b)), "data")
+
+	// Scrubber repairs the second copy that is never read
+	b2 := be2.GetBlockById(id)
+	be2.DeleteBlock(b2)
+	b2.Data.Set(&bogus)
+	be2.StoreBlock(b2)
+	assert.True(t, s.ScrubBlock(id))
+	assert.Equal(t, string(be2.GetBlockData(be2.GetBlockById(id))), "data")
+
+	s.Close()
+
+	// Missing blocks are also fetched from the second one
+	be1.DeleteBlock(b)
+	assert.True(t, mb.GetBlockById(id) != nil)
+	assert.True(t, be1.GetBlockById(id) != nil)
+}
+
+func TestTiered(t *testing.T) {
+	t.Parallel()
+	fast := factory.New("inmemory", "")
+	slow := factory.New("inmemory", "")
+	be := storage.NewTieredBackend(fast, slow)
+	be.Init(storage.BackendConfiguration{TierColdAge: 200 * time.Millisecond,
+		TierPromote: true})
+	s := storage.Storage{Backend: be}.Init()
+	defer s.Close()
+	assert.Equal(t, be.GetBytesAvailable(), fast.GetBytesAvailable())
+
+	data := []byte("data")
+	id := s.BlockId(data)
+	b := &storage.Block{Id: id,
+		BlockMetadata: storage.BlockMetadata{RefCount: 1,
+			Status: storage.BS_NORMAL}}
+	b.Data.Set(&data)
+	be.StoreBlock(b)
+	assert.True(t, slow.GetBlockById(id) == nil)
+
+	// Unread block moves to the slow tier; only metadata stays
+	time.Sleep(300 * time.Millisecond)
+	be.(interface {
+		MoveColdBlocks() int
+	}).MoveColdBlocks()
+	assert.True(t, slow.GetBlockById(id) != nil)
+	fb := fast.GetBlockById(id)
+	assert.Equal(t, len(fast.GetBlockData(fb)), 0)
+	assert.Equal(t, fb.RefCount, int32(1))
+
+	// Scrubbing it leaves it in the slow tier
+	assert.True(t, s.ScrubBlock(id))
+	assert.True(t, slow.GetBlockById(id) != nil)
+
+	// Reading it promotes it back
+	assert.Equal(t, string(be.GetBlockById(id).GetData()), "data")
+	assert.True(t, slow.GetBlockById(id) == nil)
+	assert.Equal(t, string(fast.GetBlockData(fast.GetBlockById(id))), "data")
+
+	tiers := be.(storage.TieredBackend).GetTierBytesUsed()
+	assert.Equal(t, len(tiers), 2)
+}
+
+func TestTieredNames(t *testing.T) {
+	t.Parallel()
+	dir, _ := ioutil.TempDir("", "tieredn")
+	defer os.RemoveAll(dir)
+	config := storage.BackendConfiguration{Directory: dir,
+		TierColdAge: 100 * time.Millisecond}
+
+	// The name blocks of file backend must stay in the fast tier
+	be := factory.NewWithConfig("tiered:file,badger", config)
+	b := &storage.Block{Id: "id",
+		BlockMetadata: storage.BlockMetadata{RefCount: 1,
+			Status: storage.BS_NORMAL}}
+	data := []byte("data")
+	b.Data.Set(&data)
+	be.StoreBlock(b)
+	be.SetNameToBlockId("name", "id")
+	be.SetNameToBlockId("name2", "id")
+	time.Sleep(200 * time.Millisecond)
+	// (the background mover may have done it already)
+	be.(interface {
+		MoveColdBlocks() int
+	}).MoveColdBlocks()
+	be.Close()
+
+	be = factory.NewWithConfig("tiered:file,badger", config)
+	defer be.Close()
+	assert.Equal(t, be.GetBlockIdByName("name"), "id")
+	assert.Equal(t, be.GetBlockIdByName("name2"), "id")
+	assert.Equal(t, string(be.GetBlockById("id").GetData()), "data")
+}
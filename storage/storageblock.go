@@ -55,7 +55,7 @@ func (self *StorageBlock) Open() *StorageBlock {
 }
 
 func (self *StorageBlock) Close() {
-	// direct path is tempting, but bad; do it via the channel so
+	// direct path is tempting, but bad; do it via the storage so
 	// we don't kill things too soon or without proper locking of
 	// maps etc.
 	//
@@ -70,7 +70,7 @@ func (self *StorageBlock) Close() {
 	}
 	if self.block.Get().addExternalStorageRefCount(-1) == 0 {
 		// We may be in whatever thread -> do final release
-		// through the job mechanism
+		// through the storage (with the shard locked)
 		self.block.Get().storage.ReleaseStorageBlockId(self.id)
 	}
 }
@@ -115,7 +115,7 @@ func (self *StorageBlock) String() string {
 
 func (self *StorageBlock) setBlock(b *Block) {
 	if b != nil {
-		// This is called only within storage goroutine
+		// This is called only with the shard of the block locked
 		if b.addExternalStorageRefCount(1) == 1 {
 			b.addStorageRefCount(1)
 		}
@@ -18,6 +18,8 @@ import (
 	"github.com/fingon/go-tfhfs/util"
 )
 
+// jobType is the type of storage operation. The operations are
+// counted by type (see JobCounts).
 type jobType int
 
 const (
@@ -30,116 +32,35 @@ const (
 	jobUpdateBlockIdRefCount        // ReferBlockId, ReleaseBlockId
 	jobUpdateBlockIdStorageRefCount // ReleaseStorageBlockId
 	jobStoreBlock                   // StoreBlock, StoreBlock0
-	jobQuit
+	jobScrubBlock                   // ScrubBlock
+	jobRepairBlock                  // ScrubBlock
+	jobGetCorruptBlockIds           // CorruptBlockIds
+	jobEvictBlock                   // EvictBlock
+	jobFetchBlock                   // FetchBlock
+	numJobTypes
 )
 
-type jobOut struct {
-	sb *StorageBlock
-	id string
-	ok bool
-}
-
-type jobIn struct {
-	// see job* above
-	jobType jobType
-
-	sb *StorageBlock
-
-	// in jobReferOrStoreBlock, jobUpdateBlockIdRefCount, jobStoreBlock
-	count int32
-
-	// block id
-	id string
-
-	// block name
-	name string
-
-	// block data
-	data []byte
-
-	// dependencies (if any)
-	deps *util.StringList
-
-	status BlockStatus
-
-	out chan *jobOut
-}
-
-func (self *Storage) run() {
-	for job := range self.jobChannel {
-		self.jobCounts[job.jobType] = self.jobCounts[job.jobType] + 1
-		mlog.Printf2("storage/storagejob", "st.run job %v", job.jobType)
-		switch job.jobType {
-		case jobQuit:
-			job.out <- nil
-			return
-		case jobFlush:
-			self.flush()
-			job.out <- nil
-		case jobGetBlockById:
-			b := self.getBlockById(job.sb.id)
-			job.sb.setBlock(b)
-		case jobGetBlockIdByName:
-			job.out <- &jobOut{id: self.getName(job.name).newValue}
-		case jobReferOrStoreBlock:
-			b := self.getBlockById(job.sb.id)
-			if b != nil {
-				b.addRefCount(job.count)
-				job.sb.setBlock(b)
-				continue
-			}
-			mlog.Printf2("storage/storagejob", "fallthrough to storing block")
-			fallthrough
-		case jobStoreBlock:
-			b := &Block{Id: job.sb.id,
-				storage: self,
-				deps:    job.deps,
-			}
-			//nd := make([]byte, len(job.data))
-			//mlog.Printf2("storage/storagejob", "allocated size:%d", len(job.data))
-			//copy(nd, job.data)
-			//b.Data.Set(&nd)
-			b.Data.Set(&job.data)
-			self.blocks[job.sb.id] = b
-			b.Status = job.status
-			b.addRefCount(job.count)
-			job.sb.setBlock(b)
-		case jobUpdateBlockIdRefCount:
-			b := self.getBlockById(job.id)
-			if b == nil {
-				log.Panicf("block id %x disappeared", job.id)
-			}
-			b.addRefCount(job.count)
-		case jobUpdateBlockIdStorageRefCount:
-			b := self.getBlockById(job.id)
-			if b == nil {
-				log.Panicf("block id %x disappeared", job.id)
-			}
-			// Now handled directly within StorageBlock
-			b.addStorageRefCount(job.count)
-		case jobSetNameToBlockId:
-			self.setNameToBlockId(job.name, job.id)
-		case jobSetStorageBlockStatus:
-			jo := &jobOut{ok: job.sb.block.Get().setStatus(job.status)}
-			job.out <- jo
-		default:
-			log.Panicf("Unknown job type: %d", job.jobType)
-		}
-		mlog.Printf2("storage/storagejob", " st.run job done")
-	}
+// job starts an operation of the given type; use as defer
+// self.job(jobX)().
+func (self *Storage) job(jobType jobType) func() {
+	mlog.Printf2("storage/storagejob", "st.job %v", jobType)
+	self.jobCounts[jobType].Add(1)
+	return self.rlocked()
 }
 
 func (self *Storage) Flush() {
-	out := make(chan *jobOut, 1)
-	self.jobChannel <- &jobIn{jobType: jobFlush, out: out}
-	<-out
+	self.jobCounts[jobFlush].Add(1)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.flush()
 }
 
 func (self *Storage) GetBlockById(id string) *StorageBlock {
+	defer self.job(jobGetBlockById)()
 	sb := newStorageBlock(id)
-	self.jobChannel <- &jobIn{jobType: jobGetBlockById,
-		sb: sb,
-	}
+	self.withBlock(id, func(b *Block) {
+		sb.setBlock(b)
+	})
 	b := sb.block.Get()
 	if b == nil {
 		return nil
@@ -148,19 +69,47 @@ func (self *Storage) GetBlockById(id string) *StorageBlock {
 }
 
 func (self *Storage) GetBlockIdByName(name string) string {
-	out := make(chan *jobOut, 1)
-	self.jobChannel <- &jobIn{jobType: jobGetBlockIdByName, out: out,
-		name: name,
-	}
-	jr := <-out
-	return jr.id
+	defer self.job(jobGetBlockIdByName)()
+	defer self.namesLock.Locked()()
+	return self.getName(name).newValue
 }
 
 func (self *Storage) storeBlockInternal(jobType jobType, id string, status BlockStatus, data []byte, deps *util.StringList, count int32) *StorageBlock {
+	defer self.job(jobType)()
 	sb := newStorageBlock(id)
-	self.jobChannel <- &jobIn{jobType: jobType,
-		sb: sb, data: data, deps: deps, count: count, status: status,
-	}
+	self.withBlockId(id, func() {
+		if jobType == jobReferOrStoreBlock {
+			b := self.getBlockById(id)
+			if b != nil {
+				if b.Status == BS_MISSING && len(data) > 0 {
+					// We have the data now
+					self.restoreBlock(id, data)
+				}
+				b.addRefCount(count)
+				sb.setBlock(b)
+				return
+			}
+			mlog.Printf2("storage/storagejob", "fallthrough to storing block")
+		}
+		b := &Block{Id: id,
+			storage: self,
+			deps:    deps,
+		}
+		//nd := make([]byte, len(data))
+		//mlog.Printf2("storage/storagejob", "allocated size:%d", len(data))
+		//copy(nd, data)
+		//b.Data.Set(&nd)
+		b.Data.Set(&data)
+		b.pendingSize = len(data)
+		self.pendingBytes.AddInt(b.pendingSize)
+		b.shard().blocks[id] = b
+		b.Status = status
+		b.addRefCount(count)
+		sb.setBlock(b)
+		// Logged with the shard locked, so that no one can
+		// refer to the block before it is in the log
+		self.logBlock(id, status, data)
+	})
 	return sb
 }
 
@@ -172,36 +121,46 @@ func (self *Storage) ReferOrStoreBlock0(id string, status BlockStatus, data []by
 	return self.storeBlockInternal(jobReferOrStoreBlock, id, status, data, deps, 0)
 }
 
+func (self *Storage) addBlockIdRefCount(id string, count int32) {
+	defer self.job(jobUpdateBlockIdRefCount)()
+	self.withBlock(id, func(b *Block) {
+		if b == nil {
+			log.Panicf("block id %x disappeared", id)
+		}
+		b.addRefCount(count)
+	})
+}
+
 func (self *Storage) ReferBlockId(id string) {
-	self.jobChannel <- &jobIn{jobType: jobUpdateBlockIdRefCount,
-		id: id, count: 1,
-	}
+	self.addBlockIdRefCount(id, 1)
 }
 
 func (self *Storage) ReferStorageBlockId(id string) {
 	mlog.Printf2("storage/storagejob", "ReferStorageBlockId %x", id)
-	self.jobChannel <- &jobIn{jobType: jobUpdateBlockIdStorageRefCount,
-		id: id, count: 1,
-	}
+	defer self.job(jobUpdateBlockIdStorageRefCount)()
+	self.addBlockIdStorageRefCount(id, 1)
 }
 
 func (self *Storage) ReleaseBlockId(id string) {
-	self.jobChannel <- &jobIn{jobType: jobUpdateBlockIdRefCount,
-		id: id, count: -1,
-	}
+	self.addBlockIdRefCount(id, -1)
 }
 
 func (self *Storage) ReleaseStorageBlockId(id string) {
 	mlog.Printf2("storage/storagejob", "ReleaseStorageBlockId %x", id)
-	self.jobChannel <- &jobIn{jobType: jobUpdateBlockIdStorageRefCount,
-		id: id, count: -1,
-	}
+	defer self.job(jobUpdateBlockIdStorageRefCount)()
+	self.addBlockIdStorageRefCount(id, -1)
 }
 
 func (self *Storage) SetNameToBlockId(name, block_id string) {
-	self.jobChannel <- &jobIn{jobType: jobSetNameToBlockId,
-		id: block_id, name: name,
-	}
+	defer self.job(jobSetNameToBlockId)()
+	self.setNamesToBlockIds(map[string]string{name: block_id})
+}
+
+// SetNamesToBlockIds sets all of the given names at once; they reach
+// the backend in the same (atomic) update.
+func (self *Storage) SetNamesToBlockIds(names map[string]string) {
+	defer self.job(jobSetNameToBlockId)()
+	self.setNamesToBlockIds(names)
 }
 
 func (self *Storage) StoreBlock(id string, status BlockStatus, data []byte) *StorageBlock {
@@ -212,12 +171,42 @@ func (self *Storage) StoreBlock0(id string, status BlockStatus, data []byte) *St
 	return self.storeBlockInternal(jobStoreBlock, id, status, data, nil, 0)
 }
 
-func (self *Storage) setStorageBlockStatus(sb *StorageBlock, status BlockStatus) bool {
+func (self *Storage) setStorageBlockStatus(sb *StorageBlock, status BlockStatus) (ok bool) {
+	defer self.job(jobSetStorageBlockStatus)()
+	b := sb.block.Get()
 
-	out := make(chan *jobOut, 1)
-	self.jobChannel <- &jobIn{jobType: jobSetStorageBlockStatus, out: out,
-		sb: sb, status: status,
+	// If the block will have dependencies, they have to exist
+	// (and as only flush removes blocks, they will keep on
+	// existing until we are done)
+	var ids []string
+	self.withBlockId(b.Id, func() {
+		if b.Status >= BS_WANT_NORMAL && status < BS_WANT_NORMAL {
+			ids = make([]string, 0)
+			b.iterateReferences(func(id string) {
+				ids = append(ids, id)
+			})
+		}
+	})
+	for _, id := range ids {
+		found := false
+		self.withBlock(id, func(rb *Block) {
+			if rb != nil {
+				found = true
+				// ensure it is not kept in memory
+				// needlessly
+				rb.addStorageRefCount(0)
+			}
+		})
+		if !found {
+			return false
+		}
 	}
-	jr := <-out
-	return jr.ok
+
+	self.withBlockId(b.Id, func() {
+		ok = b.setStatus(status)
+		if ok {
+			self.logStatus(b.Id, status)
+		}
+	})
+	return
 }
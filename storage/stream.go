@@ -0,0 +1,203 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Thu Apr 12 09:41:52 2018 mstenber
+ * Last modified: Thu Apr 12 11:20:33 2018 mstenber
+ * Edit time:     74 min
+ *
+ */
+
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fingon/go-tfhfs/mlog"
+)
+
+// Stream is a self-contained sequence of blocks that can be stored
+// elsewhere (e.g. as a backup), and received later on by a storage
+// with the same data key. It consists of streamMagic, StreamHeader,
+// the blocks as ILR_BLOCK intent log records (data encoded with the
+// storage StreamCodec, so it is no more readable than the storage
+// itself), and a final ILR_NAME record; streams without one are
+// incomplete.
+//
+// Blocks MUST be written after the blocks they refer to, as the
+// receiver stores them in the order they are in the stream.
+
+const streamMagic = "tfhfs-stream-1\n"
+
+// streamFlushInterval is the number of blocks the receiver stores
+// before flushing them to the backend.
+const streamFlushInterval = 1000
+
+var ErrInvalidStream = errors.New("invalid stream")
+var ErrIncompleteStream = errors.New("incomplete stream")
+
+type StreamWriter struct {
+	storage *Storage
+	writer  *bufio.Writer
+	header  StreamHeader
+}
+
+// NewStreamWriter starts a stream of the root described by header to
+// w.
+func (self *Storage) NewStreamWriter(w io.Writer, header StreamHeader) (*StreamWriter, error) {
+	mlog.Printf2("storage/stream", "st.NewStreamWriter %v", header)
+	sw := &StreamWriter{storage: self, writer: bufio.NewWriter(w),
+		header: header}
+	_, err := sw.writer.WriteString(streamMagic)
+	if err != nil {
+		return nil, err
+	}
+	_, err = sw.writer.Write(encodeRecord(&header))
+	if err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// WriteBlock appends the block to the stream.
+func (self *StreamWriter) WriteBlock(id string) error {
+	mlog.Printf2("storage/stream", "sw.WriteBlock %x", id)
+	b := self.storage.GetBlockById(id)
+	if b == nil {
+		return fmt.Errorf("block %x missing", id)
+	}
+	defer b.Close()
+	if b.Status() == BS_MISSING {
+		// Evicted from partial replica; the stream needs the data
+		if !self.storage.FetchBlock(id) || b.Status() == BS_MISSING {
+			return fmt.Errorf("block %x has no data locally, and it could not be fetched from the replica peer", id)
+		}
+	}
+	data, err := self.storage.StreamCodec.EncodeBytes(b.Data(), []byte(id))
+	if err != nil {
+		return err
+	}
+	r := &IntentLogRecord{Type: ILR_BLOCK, Id: id, Status: b.Status(),
+		Data: data}
+	_, err = self.writer.Write(encodeRecord(r))
+	return err
+}
+
+// Close finishes the stream; it does not close the underlying writer.
+func (self *StreamWriter) Close() error {
+	r := &IntentLogRecord{Type: ILR_NAME, Id: self.header.RootId,
+		Name: self.header.Name}
+	_, err := self.writer.Write(encodeRecord(r))
+	if err != nil {
+		return err
+	}
+	return self.writer.Flush()
+}
+
+type StreamReader struct {
+	reader *bufio.Reader
+
+	// Header is the header of the stream
+	Header StreamHeader
+}
+
+// NewStreamReader reads the start of the stream from r; the rest is
+// stored by Storage.Receive.
+func NewStreamReader(r io.Reader) (*StreamReader, error) {
+	sr := &StreamReader{reader: bufio.NewReader(r)}
+	magic := make([]byte, len(streamMagic))
+	_, err := io.ReadFull(sr.reader, magic)
+	if err != nil || string(magic) != streamMagic {
+		return nil, ErrInvalidStream
+	}
+	err = readRecord(sr.reader, &sr.Header)
+	if err != nil {
+		return nil, ErrInvalidStream
+	}
+	return sr, nil
+}
+
+// ReceiveStream stores the blocks of the stream read from r, and
+// points name (or the name in the stream, if empty) at its root.
+func (self *Storage) ReceiveStream(r io.Reader, name string) (*StreamHeader, error) {
+	sr, err := NewStreamReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return self.Receive(sr, name)
+}
+
+// Receive is ReceiveStream for stream whose header has been read
+// already.
+//
+// The blocks are referred to until the name is set, so interrupted
+// receive leaves them in the storage (fsck -repair removes them).
+func (self *Storage) Receive(sr *StreamReader, name string) (*StreamHeader, error) {
+	br := sr.reader
+	header := sr.Header
+	mlog.Printf2("storage/stream", "st.Receive %v as %s", header, name)
+	if name == "" {
+		name = header.Name
+	}
+	if header.BaseId != "" {
+		b := self.GetBlockById(header.BaseId)
+		if b == nil {
+			return nil, fmt.Errorf("base root %x missing", header.BaseId)
+		}
+		b.Close()
+	}
+	ids := make([]string, 0)
+	defer func() {
+		for _, id := range ids {
+			self.ReleaseBlockId(id)
+		}
+		self.Flush()
+	}()
+	for {
+		var rec IntentLogRecord
+		err := readRecord(br, &rec)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrIncompleteStream
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch rec.Type {
+		case ILR_BLOCK:
+			data, err := self.StreamCodec.DecodeBytes(rec.Data, []byte(rec.Id))
+			if err != nil {
+				return nil, err
+			}
+			if !self.VerifyBlockId(rec.Id, data) {
+				return nil, fmt.Errorf("block %x does not match its id", rec.Id)
+			}
+			b := self.ReferOrStoreBlock(rec.Id, rec.Status, data)
+			if b.Status() == BS_WEAK && rec.Status == BS_NORMAL {
+				b.SetStatus(BS_NORMAL)
+			}
+			b.Close()
+			ids = append(ids, rec.Id)
+			if len(ids)%streamFlushInterval == 0 {
+				self.Flush()
+			}
+		case ILR_NAME:
+			if rec.Id != header.RootId {
+				return nil, ErrInvalidStream
+			}
+			b := self.GetBlockById(rec.Id)
+			if b == nil {
+				return nil, fmt.Errorf("root %x missing", rec.Id)
+			}
+			b.Close()
+			self.SetNameToBlockId(name, rec.Id)
+			return &header, nil
+		default:
+			mlog.Printf2("storage/stream", " invalid record type %v", rec.Type)
+			return nil, ErrInvalidStream
+		}
+	}
+}
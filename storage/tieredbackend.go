@@ -0,0 +1,340 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Fri Apr 13 14:02:11 2018 mstenber
+ * Last modified: Fri Apr 13 17:15:48 2018 mstenber
+ * Edit time:     141 min
+ *
+ */
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// defaultTierColdAge is used if TierColdAge is not set.
+const defaultTierColdAge = 24 * time.Hour
+
+// tieredBackend keeps names and block metadata in the fast tier, and
+// block data in either of the tiers. New blocks go to the fast tier,
+// and the data of blocks that are not read for TierColdAge is moved
+// in the background to the slow tier (leaving behind block with the
+// metadata but no data). If TierPromote is set, reading block from
+// the slow tier moves it back to the fast one.
+//
+// Copy of the metadata is kept with the data in the slow tier, so
+// that blocks can be recovered on Init if a move was interrupted.
+//
+// The tiers are given subdirectories fast and slow of the directory.
+type tieredBackend struct {
+	proxyBackend
+	slow Backend
+
+	// hot contains the last read time of the blocks whose data
+	// is in the fast tier
+	hot     map[string]time.Time
+	hotLock util.MutexLocked
+
+	// locks serializes the operations on a block
+	locks util.MutexLockedMap
+
+	quit, done chan struct{}
+}
+
+var _ Backend = &tieredBackend{}
+var _ TieredBackend = &tieredBackend{}
+
+// NewTieredBackend returns backend that stores recently used blocks
+// in fast, and the rest in slow.
+func NewTieredBackend(fast, slow Backend) Backend {
+	self := &tieredBackend{slow: slow}
+	self.Backend = fast
+	return self
+}
+
+func (self *tieredBackend) Init(config BackendConfiguration) {
+	self.BackendConfiguration = config
+	if self.TierColdAge == 0 {
+		self.TierColdAge = defaultTierColdAge
+	}
+	if !self.Supports(CodecFeature) {
+		config.Codec = nil
+	}
+	for name, be := range map[string]Backend{"fast": self.Backend, "slow": self.slow} {
+		cconfig := config
+		if config.Directory != "" {
+			cconfig.Directory = filepath.Join(config.Directory, name)
+			os.MkdirAll(cconfig.Directory, 0700)
+		}
+		be.Init(cconfig)
+	}
+	self.scan()
+	self.quit = make(chan struct{})
+	self.done = make(chan struct{})
+	go func() { // ok, singleton per backend
+		self.run()
+	}()
+}
+
+// stubBlock returns block without data; they are left in the fast
+// tier for blocks whose data is in the slow tier.
+func stubBlock(id string, meta BlockMetadata) *Block {
+	b := &Block{Id: id, BlockMetadata: meta}
+	data := []byte{}
+	b.Data.Set(&data)
+	return b
+}
+
+// scan finds out which blocks are hot, and recovers the blocks whose
+// move to or from the slow tier was interrupted.
+//
+// Blocks without status are internal to the tiers (e.g. the name
+// blocks of storage/file), so they stay where they are.
+func (self *tieredBackend) scan() {
+	cold := make(map[string]*Block)
+	self.slow.IterateBlocks(func(b *Block) {
+		if b.Status != BS_UNSET {
+			cold[b.Id] = b
+		}
+	})
+	now := time.Now()
+	self.hot = make(map[string]time.Time)
+	self.Backend.IterateBlocks(func(b *Block) {
+		if b.Status == BS_UNSET {
+			return
+		}
+		if cold[b.Id] == nil {
+			self.hot[b.Id] = now
+		} else {
+			delete(cold, b.Id)
+		}
+	})
+	for id, b := range cold {
+		mlog.Printf2("storage/tieredbackend", " recovering %x", id)
+		self.Backend.StoreBlock(stubBlock(id, b.BlockMetadata))
+	}
+	mlog.Printf2("storage/tieredbackend", "tb.scan %d hot", len(self.hot))
+}
+
+func (self *tieredBackend) run() {
+	defer close(self.done)
+	ticker := time.NewTicker(self.TierColdAge / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.quit:
+			return
+		case <-ticker.C:
+			self.MoveColdBlocks()
+		}
+	}
+}
+
+// MoveColdBlocks moves the data of blocks that have not been read
+// for TierColdAge to the slow tier, and returns how many were moved.
+// It is called periodically in the background.
+func (self *tieredBackend) MoveColdBlocks() int {
+	limit := time.Now().Add(-self.TierColdAge)
+	ids := make([]string, 0)
+	self.hotLock.Lock()
+	for id, t := range self.hot {
+		if t.Before(limit) {
+			ids = append(ids, id)
+		}
+	}
+	self.hotLock.Unlock()
+	count := 0
+	for _, id := range ids {
+		if self.moveCold(id, limit) {
+			count++
+		}
+	}
+	if count > 0 {
+		mlog.Printf2("storage/tieredbackend", "tb.MoveColdBlocks moved %d", count)
+	}
+	return count
+}
+
+func (self *tieredBackend) moveCold(id string, limit time.Time) bool {
+	defer self.locks.Locked(id)()
+	self.hotLock.Lock()
+	t, ok := self.hot[id]
+	self.hotLock.Unlock()
+	if !ok || !t.Before(limit) {
+		// Deleted or read in the meanwhile
+		return false
+	}
+	b := self.Backend.GetBlockById(id)
+	if b == nil || b.Status == BS_UNSET {
+		return false
+	}
+	data := self.Backend.GetBlockData(b)
+	sb := &Block{Id: id, BlockMetadata: b.BlockMetadata}
+	sb.Data.Set(&data)
+	self.slow.StoreBlock(sb)
+	self.Backend.ReplaceBlock(stubBlock(id, b.BlockMetadata))
+	self.hotLock.Lock()
+	delete(self.hot, id)
+	self.hotLock.Unlock()
+	return true
+}
+
+// touch updates the read time of the block, and returns whether it
+// is hot.
+func (self *tieredBackend) touch(id string) bool {
+	defer self.hotLock.Locked()()
+	_, ok := self.hot[id]
+	if ok {
+		self.hot[id] = time.Now()
+	}
+	return ok
+}
+
+func (self *tieredBackend) setHot(id string, hot bool) {
+	defer self.hotLock.Locked()()
+	if hot {
+		self.hot[id] = time.Now()
+	} else {
+		delete(self.hot, id)
+	}
+}
+
+func (self *tieredBackend) GetBlockData(b *Block) []byte {
+	defer self.locks.Locked(b.Id)()
+	if self.touch(b.Id) {
+		return self.Backend.GetBlockData(b)
+	}
+	sb := self.slow.GetBlockById(b.Id)
+	if sb == nil {
+		return nil
+	}
+	data := self.slow.GetBlockData(sb)
+	if self.TierPromote && data != nil {
+		mlog.Printf2("storage/tieredbackend", "tb.GetBlockData promoting %x", b.Id)
+		fb := self.Backend.GetBlockById(b.Id)
+		nb := &Block{Id: b.Id, BlockMetadata: fb.BlockMetadata}
+		nb.Data.Set(&data)
+		self.Backend.ReplaceBlock(nb)
+		self.slow.DeleteBlock(sb)
+		self.setHot(b.Id, true)
+	}
+	return data
+}
+
+func (self *tieredBackend) PeekBlockData(b *Block) []byte {
+	defer self.locks.Locked(b.Id)()
+	self.hotLock.Lock()
+	_, hot := self.hot[b.Id]
+	self.hotLock.Unlock()
+	if hot {
+		return self.Backend.GetBlockData(b)
+	}
+	sb := self.slow.GetBlockById(b.Id)
+	if sb == nil {
+		return nil
+	}
+	return self.slow.GetBlockData(sb)
+}
+
+// The blocks of the fast tier may have (stub) data already set, so
+// it is cleared to get the data via GetBlockData.
+
+func (self *tieredBackend) GetBlockById(id string) *Block {
+	b := self.Backend.GetBlockById(id)
+	if b == nil {
+		return nil
+	}
+	nb := *b
+	nb.Backend = self
+	nb.Data.Set(nil)
+	return &nb
+}
+
+func (self *tieredBackend) IterateBlocks(cb func(b *Block)) {
+	self.Backend.IterateBlocks(func(b *Block) {
+		b.Backend = self
+		b.Data.Set(nil)
+		cb(b)
+	})
+}
+
+func (self *tieredBackend) IterateBlocksWithStatus(status BlockStatus, cb func(b *Block)) {
+	self.Backend.IterateBlocksWithStatus(status, func(b *Block) {
+		b.Backend = self
+		b.Data.Set(nil)
+		cb(b)
+	})
+}
+
+func (self *tieredBackend) StoreBlock(b *Block) {
+	defer self.locks.Locked(b.Id)()
+	self.Backend.StoreBlock(b)
+	self.setHot(b.Id, b.Status != BS_UNSET)
+}
+
+// ReplaceBlock replaces the block in the tier it is in.
+func (self *tieredBackend) ReplaceBlock(b *Block) {
+	defer self.locks.Locked(b.Id)()
+	if sb := self.slow.GetBlockById(b.Id); sb != nil {
+		self.slow.ReplaceBlock(b)
+		self.Backend.UpdateBlock(b)
+		return
+	}
+	self.Backend.ReplaceBlock(b)
+}
+
+func (self *tieredBackend) UpdateBlock(b *Block) int {
+	defer self.locks.Locked(b.Id)()
+	return self.Backend.UpdateBlock(b)
+}
+
+func (self *tieredBackend) DeleteBlock(b *Block) {
+	defer self.locks.Locked(b.Id)()
+	// Slow tier first, so that interrupted delete does not
+	// resurrect the block
+	sb := self.slow.GetBlockById(b.Id)
+	if sb != nil {
+		self.slow.DeleteBlock(sb)
+	}
+	self.Backend.DeleteBlock(b)
+	self.setHot(b.Id, false)
+}
+
+func (self *tieredBackend) Flush() {
+	self.Backend.Flush()
+	self.slow.Flush()
+}
+
+func (self *tieredBackend) Close() {
+	close(self.quit)
+	<-self.done
+	self.Backend.Close()
+	self.slow.Close()
+}
+
+func (self *tieredBackend) Supports(feature BackendFeature) bool {
+	return self.Backend.Supports(feature) && self.slow.Supports(feature)
+}
+
+// GetBytesAvailable returns what is available in the fast tier, as
+// all new data is written there.
+func (self *tieredBackend) GetBytesAvailable() uint64 {
+	return self.Backend.GetBytesAvailable()
+}
+
+func (self *tieredBackend) GetBytesUsed() uint64 {
+	return self.Backend.GetBytesUsed() + self.slow.GetBytesUsed()
+}
+
+func (self *tieredBackend) GetTierBytesUsed() map[string]uint64 {
+	return map[string]uint64{"fast": self.Backend.GetBytesUsed(),
+		"slow": self.slow.GetBytesUsed()}
+}
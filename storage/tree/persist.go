@@ -18,6 +18,7 @@ import (
 	"os"
 
 	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
 )
 
 // treePersister provides convenience API for pretend files.
@@ -75,8 +76,9 @@ func (self *inMemoryFile) WriteData(location LocationSlice, data []byte) {
 var _ treePersister = &inMemoryFile{}
 
 type systemFile struct {
-	f    *os.File
-	path string
+	f     *os.File
+	path  string
+	retry func(op func() error) error
 }
 
 var _ treePersister = &systemFile{}
@@ -128,11 +130,11 @@ func (self *systemFile) Size() uint64 {
 func (self *systemFile) WriteData(location LocationSlice, data []byte) {
 	ofs := uint64(0)
 	for _, v := range location {
-		_, err := self.f.Seek(int64(v.Offset), 0)
-		if err != nil {
-			log.Panic(err)
-		}
-		_, err = self.f.Write(data[ofs : ofs+v.Size])
+		err := self.retry(func() error {
+			_, err := self.f.WriteAt(data[ofs:ofs+v.Size], int64(v.Offset))
+			return err
+		})
+		storage.PanicIfNoSpace(err)
 		if err != nil {
 			log.Panic(err)
 		}
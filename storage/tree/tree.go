@@ -14,6 +14,7 @@ package tree
 import (
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/fingon/go-tfhfs/codec"
 	"github.com/fingon/go-tfhfs/ibtree"
@@ -33,11 +34,12 @@ const superBlockSize = 1 << 16
 // It has its own ibtree subtree for:
 // - free space (actually two; offset -> size, size -> offset)
 // - block name => data + location mapping
+// - status + block name => nothing (status index)
 type treeBackend struct {
 	Superblock
 
 	storage.DirectoryBackendBase
-	storage.NameInBlockBackend
+	storage.GenerationNameBackend
 	lock                util.MutexLocked
 	tree                *ibtree.Tree
 	savedRoot           *ibtree.Node // what is on disk (+sb)
@@ -48,6 +50,7 @@ type treeBackend struct {
 	freeSize2OffsetTree *ibtree.SubTree // (size,offset)
 	freeOffset2SizeTree *ibtree.SubTree // (offset, size)
 	blockTree           *ibtree.SubTree // (block id => block data)
+	statusTree          *ibtree.SubTree // (status, block id)
 	nodeDataCache       ibtree.NodeDataCart
 	currentMap          map[ibtree.BlockId]bool
 	superIndex          int
@@ -58,7 +61,7 @@ var _ storage.Backend = &treeBackend{}
 
 func (self *treeBackend) Init(config storage.BackendConfiguration) {
 	self.DirectoryBackendBase.Init(config)
-	self.NameInBlockBackend.Init("names", self)
+	self.GenerationNameBackend.Init("names", self)
 
 	self.nodeDataCache.Init(util.IOr(config.CacheSize, 1234))
 
@@ -67,7 +70,7 @@ func (self *treeBackend) Init(config storage.BackendConfiguration) {
 	}
 
 	if config.Directory != "" {
-		self.p = systemFile{}.Init(config.Directory)
+		self.p = systemFile{retry: self.RetryWrite}.Init(config.Directory)
 	} else {
 		self.p = &inMemoryFile{}
 	}
@@ -128,6 +131,44 @@ func (self *treeBackend) Init(config storage.BackendConfiguration) {
 	if best != nil {
 		// Stick stuff in pending to tree, if any
 		self.flushPending()
+
+		if self.statusTree.NextKey(ibtree.Key("")) == nil {
+			self.indexStatuses()
+		}
+	}
+}
+
+// indexStatuses populates the status index of tree that was created
+// without one.
+func (self *treeBackend) indexStatuses() {
+	mlog.Printf2("storage/tree/tree", "indexStatuses")
+	k := ibtree.Key("")
+	for {
+		kp := self.blockTree.NextKey(k)
+		if kp == nil {
+			break
+		}
+		k = *kp
+		bd := self.getBlockData(string(k))
+		self.setStatus(string(k), storage.BS_UNSET, bd.Status)
+	}
+}
+
+func statusKey(id string, status storage.BlockStatus) ibtree.Key {
+	return ibtree.Key(append([]byte{byte(status)}, []byte(id)...))
+}
+
+// setStatus updates the status index; BS_UNSET is used for blocks
+// that do not exist.
+func (self *treeBackend) setStatus(id string, old, status storage.BlockStatus) {
+	if old == status {
+		return
+	}
+	if old != storage.BS_UNSET {
+		self.statusTree.Delete(statusKey(id, old))
+	}
+	if status != storage.BS_UNSET {
+		self.statusTree.Set(statusKey(id, status), "")
 	}
 }
 
@@ -146,6 +187,7 @@ func (self *treeBackend) newTransaction(root *ibtree.Node) {
 	self.freeSize2OffsetTree = self.t.NewSubTree(ibtree.Key("s"))
 	self.freeOffset2SizeTree = self.t.NewSubTree(ibtree.Key("o"))
 	self.blockTree = self.t.NewSubTree(ibtree.Key("b"))
+	self.statusTree = self.t.NewSubTree(ibtree.Key("t"))
 }
 
 func (self *treeBackend) Close() {
@@ -481,6 +523,7 @@ func (self *treeBackend) DeleteBlock(b *storage.Block) {
 		mlog.Panicf("Nonexistent DeleteBlock: %v", b)
 	}
 	self.freeSlice(bd.Location)
+	self.setStatus(b.Id, bd.Status, storage.BS_UNSET)
 	self.blockTree.Delete(ibtree.Key(b.Id))
 }
 
@@ -507,6 +550,52 @@ func (self *treeBackend) GetBlockById(id string) *storage.Block {
 	return b
 }
 
+func (self *treeBackend) IterateBlocks(cb func(b *storage.Block)) {
+	blocks := make([]*storage.Block, 0)
+	self.lock.Lock()
+	k := ibtree.Key("")
+	for {
+		kp := self.blockTree.NextKey(k)
+		if kp == nil {
+			break
+		}
+		k = *kp
+		bd := self.getBlockData(string(k))
+		b := &storage.Block{Backend: self, Id: string(k)}
+		b.RefCount = bd.RefCount
+		b.Status = storage.BlockStatus(bd.Status)
+		blocks = append(blocks, b)
+	}
+	self.lock.Unlock()
+	for _, b := range blocks {
+		cb(b)
+	}
+}
+
+func (self *treeBackend) IterateBlocksWithStatus(status storage.BlockStatus, cb func(b *storage.Block)) {
+	blocks := make([]*storage.Block, 0)
+	self.lock.Lock()
+	prefix := string(statusKey("", status))
+	k := ibtree.Key(prefix)
+	for {
+		kp := self.statusTree.NextKey(k)
+		if kp == nil || !strings.HasPrefix(string(*kp), prefix) {
+			break
+		}
+		k = *kp
+		id := string(k)[len(prefix):]
+		bd := self.getBlockData(id)
+		b := &storage.Block{Backend: self, Id: id}
+		b.RefCount = bd.RefCount
+		b.Status = storage.BlockStatus(bd.Status)
+		blocks = append(blocks, b)
+	}
+	self.lock.Unlock()
+	for _, b := range blocks {
+		cb(b)
+	}
+}
+
 func (self *treeBackend) setBlockData(id string, bdata *BlockData) {
 	b, err := bdata.MarshalMsg(nil)
 	if err != nil {
@@ -528,12 +617,37 @@ func (self *treeBackend) StoreBlock(bl *storage.Block) {
 	self.p.WriteData(ls, b)
 	bdata := BlockData{Location: ls, BlockMetadata: bl.BlockMetadata}
 	self.setBlockData(bl.Id, &bdata)
+	self.setStatus(bl.Id, storage.BS_UNSET, bl.Status)
+}
+
+// ReplaceBlock writes the new data to newly allocated location
+// before freeing the old one; the change becomes persistent
+// (atomically) with the next superblock.
+func (self *treeBackend) ReplaceBlock(bl *storage.Block) {
+	defer self.lock.Locked()()
+	mlog.Printf2("storage/tree/tree", "%v.ReplaceBlock %v", self, bl)
+	bd := self.getBlockData(bl.Id)
+	if bd == nil {
+		mlog.Panicf("Nonexistent ReplaceBlock: %v", bl)
+	}
+	b := *bl.Data.Get()
+	b, err := self.Codec.EncodeBytes(b, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	ls := self.allocateSlice(uint64(len(b)))
+	self.p.WriteData(ls, b)
+	self.freeSlice(bd.Location)
+	self.setStatus(bl.Id, bd.Status, bl.Status)
+	bdata := BlockData{Location: ls, BlockMetadata: bl.BlockMetadata}
+	self.setBlockData(bl.Id, &bdata)
 }
 
 func (self *treeBackend) UpdateBlock(bl *storage.Block) int {
 	defer self.lock.Locked()()
 	mlog.Printf2("storage/tree/tree", "%v.UpdateBlock %v", self, bl)
 	bd := self.getBlockData(bl.Id)
+	self.setStatus(bl.Id, bd.Status, bl.Status)
 	bd.BlockMetadata = bl.BlockMetadata
 	self.setBlockData(bl.Id, bd)
 	return 1
@@ -608,6 +722,9 @@ func (self *treeBackend) GetBytesUsed() uint64 {
 
 func (self *treeBackend) GetBytesAvailable() uint64 {
 	defer self.lock.Locked()()
+	if self.IsOutOfSpace() {
+		return 0
+	}
 	return self.DirectoryBackendBase.GetBytesAvailable() + self.BytesTotal - self.BytesUsed
 }
 
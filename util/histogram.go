@@ -0,0 +1,52 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2018 Markus Stenberg
+ *
+ * Created:       Thu Apr  5 10:02:11 2018 mstenber
+ * Last modified: Thu Apr  5 10:41:30 2018 mstenber
+ * Edit time:     25 min
+ *
+ */
+
+package util
+
+// Histogram counts observed values in buckets. It is safe for
+// concurrent use.
+type Histogram struct {
+	// Bounds are the (inclusive) upper bounds of the buckets in
+	// ascending order. Values above the last one are included
+	// only in the total count.
+	Bounds []int64
+
+	counts     []AtomicInt
+	count, sum AtomicInt
+}
+
+func NewHistogram(bounds ...int64) *Histogram {
+	return &Histogram{Bounds: bounds, counts: make([]AtomicInt, len(bounds))}
+}
+
+func (self *Histogram) Observe(value int64) {
+	for i, bound := range self.Bounds {
+		if value <= bound {
+			self.counts[i].Add(1)
+			break
+		}
+	}
+	self.count.Add(1)
+	self.sum.Add(value)
+}
+
+// Get returns the number of values in each bucket (cumulative, so
+// that each includes also the preceding ones), as well as the total
+// count and sum of the observed values.
+func (self *Histogram) Get() (buckets []int64, count, sum int64) {
+	buckets = make([]int64, len(self.counts))
+	var total int64
+	for i := range self.counts {
+		total += self.counts[i].Get()
+		buckets[i] = total
+	}
+	return buckets, self.count.Get(), self.sum.Get()
+}
@@ -35,3 +35,15 @@ func TestIMax(t *testing.T) {
 	assert.Equal(t, IMax(1, 2, 3), 3)
 	assert.Equal(t, IMax(3, 2, 1), 3)
 }
+
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+	h := NewHistogram(1, 10, 100)
+	for _, v := range []int64{0, 1, 5, 50, 500} {
+		h.Observe(v)
+	}
+	buckets, count, sum := h.Get()
+	assert.Equal(t, buckets, []int64{2, 3, 4})
+	assert.Equal(t, count, int64(5))
+	assert.Equal(t, sum, int64(556))
+}
@@ -40,6 +40,13 @@ type XXXCart struct {
 	// q = maximum length of b1
 	// ns = number of short-lived entries (in t1+t2)
 	// nl = number of long-lived entries (in t1+t2)
+
+	// Size (if set) returns the size of a value. The total size
+	// of the cached values is then kept at most MaximumSize, in
+	// addition to the maximum number of entries given to Init.
+	Size        func(value XXXType) int
+	MaximumSize int
+	size        int
 }
 
 // XXXCartEntry represents a single cache entry; maps point at it under key
@@ -55,6 +62,19 @@ func (self *XXXCartEntry) String() string {
 	return fmt.Sprintf("ce{%s,r:%v,l:%v,f:%v}", self.key, self.refbit, self.filterlong, self.frequentbit)
 }
 
+func (self *XXXCart) sizeOf(value XXXType) int {
+	if self.Size == nil || value == nil {
+		return 0
+	}
+	return self.Size(value)
+}
+
+// CurrentSize returns the total size of the cached values (see
+// Size).
+func (self *XXXCart) CurrentSize() int {
+	return self.size
+}
+
 func (self *XXXCart) Init(maximumSize int) *XXXCart {
 	self.cache = make(map[ZZZType]*XXXCartEntry)
 	self.c = maximumSize
@@ -102,7 +122,12 @@ func (self *XXXCart) Set(key ZZZType, value XXXType) {
 		mlog.Printf2("xxx/cart", " not enabled")
 		return
 	}
+	defer self.shrink()
 	e, found := self.cache[key]
+	self.size += self.sizeOf(value)
+	if found {
+		self.size -= self.sizeOf(e.value)
+	}
 	if value == nil {
 		// just like in gcache, setting nil = delete.
 		if found && e.value != nil {
@@ -133,17 +158,8 @@ func (self *XXXCart) Set(key ZZZType, value XXXType) {
 
 		// also clear history space if it missed altogether
 		// and history is full
-		if !found && self.b1.Length+self.b2.Length > self.c {
-			if self.b1.Length > self.q || self.b2.Length == 0 {
-				mlog.Printf2("xxx/cart", " bumped from b1")
-				delete(self.cache, self.b1.Front.Value.key)
-				self.b1.RemoveElement(self.b1.Front)
-			} else {
-				mlog.Printf2("xxx/cart", " bumped from b2")
-				delete(self.cache, self.b2.Front.Value.key)
-				self.b2.RemoveElement(self.b2.Front)
-			}
-
+		if !found {
+			self.trimHistory()
 		}
 	}
 
@@ -181,6 +197,30 @@ func (self *XXXCart) Set(key ZZZType, value XXXType) {
 	self.nl++
 }
 
+func (self *XXXCart) trimHistory() {
+	if self.b1.Length+self.b2.Length <= self.c {
+		return
+	}
+	if self.b1.Length > self.q || self.b2.Length == 0 {
+		mlog.Printf2("xxx/cart", " bumped from b1")
+		delete(self.cache, self.b1.Front.Value.key)
+		self.b1.RemoveElement(self.b1.Front)
+	} else {
+		mlog.Printf2("xxx/cart", " bumped from b2")
+		delete(self.cache, self.b2.Front.Value.key)
+		self.b2.RemoveElement(self.b2.Front)
+	}
+}
+
+// shrink evicts entries until the values fit in MaximumSize (if set).
+func (self *XXXCart) shrink() {
+	for self.MaximumSize > 0 && self.size > self.MaximumSize && self.t1.Length+self.t2.Length > 0 {
+		mlog.Printf2("xxx/cart", " too large: %d > %d", self.size, self.MaximumSize)
+		self.replace()
+		self.trimHistory()
+	}
+}
+
 func (self *XXXCart) replace() {
 	// replace() in the paper p11
 	mlog.Printf2("xxx/cart", "replace()")
@@ -221,9 +261,11 @@ func (self *XXXCart) replace() {
 		}
 
 	}
-	if self.t1.Length >= util.IMax(1, self.p) {
+	// t2 may be empty only if shrinking a cache that is not full
+	if self.t1.Length >= util.IMax(1, self.p) || self.t2.Front == nil {
 		e := self.t1.Front.Value
 		mlog.Printf2("xxx/cart", " evicting %v from t1", e)
+		self.size -= self.sizeOf(e.value)
 		e.value = nil
 		self.t1.RemoveElement(&e.e)
 		self.b1.PushBackElement(&e.e)
@@ -231,6 +273,7 @@ func (self *XXXCart) replace() {
 	} else {
 		e := self.t2.Front.Value
 		mlog.Printf2("xxx/cart", " evicting %v from t2", e)
+		self.size -= self.sizeOf(e.value)
 		e.value = nil
 		self.t2.RemoveElement(&e.e)
 		self.b2.PushBackElement(&e.e)
@@ -162,3 +162,32 @@ func TestCartTorture(t *testing.T) {
 	assert.True(t, hits > 0)
 	mlog.Printf2("xxx/cart_test", "Torture had %d hits and %d misses", hits, misses)
 }
+
+func TestCartSize(t *testing.T) {
+	t.Parallel()
+
+	c := XXXCart{MaximumSize: 10,
+		Size: func(value XXXType) int { return len(*value) }}
+	c.Init(100)
+	rng := util.GetSeededRng()
+	for i := 0; i < 1000; i++ {
+		s := fmt.Sprintf("%d", rng.Int()%1000)
+		k := ZZZType(s)
+		if _, ok := c.Get(k); !ok {
+			c.Set(k, xxx(s))
+		}
+		total := 0
+		for _, v := range c.cache {
+			if v.value != nil {
+				total += len(*v.value)
+			}
+		}
+		assert.Equal(t, c.CurrentSize(), total)
+		assert.True(t, total <= 10)
+		sanityCheckCart(t, c)
+	}
+	// Values larger than MaximumSize do not stick
+	c.Set("big", xxx("12345678901"))
+	_, ok := c.Get("big")
+	assert.True(t, !ok)
+}